@@ -0,0 +1,394 @@
+package csocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	aclActionAllow = "allow"
+	aclActionDeny  = "deny"
+)
+
+var errAccessDenied = errors.New("access denied by acl")
+
+// ACLRule 是服务端的一条访问控制规则，按顺序匹配，第一条命中的规则生效。
+//
+// 规则内各维度之间是“与”：Users、目标、Ports 都要满足（空表示不限制）。
+// 目标维度由 CIDRs、Domains、DomainRegex 组成，三者之间是“或”。
+type ACLRule struct {
+	Action string `json:"action" yaml:"action" toml:"action"`
+
+	Users []string `json:"users" yaml:"users" toml:"users"`
+
+	CIDRs []string `json:"cidrs" yaml:"cidrs" toml:"cidrs"`
+
+	// Domains 按后缀匹配："example.com" 同时匹配 example.com 与 *.example.com。
+	Domains     []string `json:"domains" yaml:"domains" toml:"domains"`
+	DomainRegex []string `json:"domain_regex" yaml:"domain_regex" toml:"domain_regex"`
+
+	// Ports 支持单个端口 "443" 或范围 "8000-9000"。
+	Ports []string `json:"ports" yaml:"ports" toml:"ports"`
+}
+
+type aclPortRange struct {
+	from, to int
+}
+
+type compiledACLRule struct {
+	allow bool
+
+	users    map[string]struct{}
+	prefixes []netip.Prefix
+	domains  []string
+	regexes  []*regexp.Regexp
+	ports    []aclPortRange
+}
+
+// accessPolicy 在拨号前决定目标是否允许访问，同时带上拨号与转发使用的超时。
+type accessPolicy struct {
+	rules        []compiledACLRule
+	defaultAllow bool
+	allowPrivate bool
+
+	// unrestricted 表示不做任何限制（forward 端直连使用）。
+	unrestricted bool
+
+	inst *instance
+
+	// role 是指标中的 role 标签：服务端为 server，forward 端直连为 client。
+	role string
+
+	timeout     time.Duration
+	idleTimeout time.Duration
+}
+
+func newAccessPolicy(listenConfig *ListenConfig, inst *instance) (*accessPolicy, error) {
+	policy := &accessPolicy{
+		inst:         inst,
+		role:         metricsRoleServer,
+		defaultAllow: true,
+		allowPrivate: listenConfig.AllowPrivateTargets,
+		timeout:      listenConfig.timeout(),
+		idleTimeout:  listenConfig.idleTimeout(),
+	}
+
+	switch strings.ToLower(strings.TrimSpace(listenConfig.ACLDefault)) {
+	case "", aclActionAllow:
+	case aclActionDeny:
+		policy.defaultAllow = false
+	default:
+		return nil, fmt.Errorf("acl_default: unknown action %q", listenConfig.ACLDefault)
+	}
+
+	for i, rule := range listenConfig.ACL {
+		compiled, err := compileACLRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("acl[%d]: %w", i, err)
+		}
+		policy.rules = append(policy.rules, compiled)
+	}
+
+	return policy, nil
+}
+
+// newDirectPolicy 返回不做访问限制的策略，用于 forward 端直连。
+func newDirectPolicy(listenConfig *ListenConfig, inst *instance) *accessPolicy {
+	return &accessPolicy{
+		inst:         inst,
+		role:         metricsRoleClient,
+		unrestricted: true,
+		timeout:      listenConfig.timeout(),
+		idleTimeout:  listenConfig.idleTimeout(),
+	}
+}
+
+func compileACLRule(rule ACLRule) (compiledACLRule, error) {
+	var out compiledACLRule
+
+	switch strings.ToLower(strings.TrimSpace(rule.Action)) {
+	case aclActionAllow:
+		out.allow = true
+	case aclActionDeny:
+	default:
+		return out, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	if len(rule.Users) > 0 {
+		out.users = make(map[string]struct{}, len(rule.Users))
+		for _, u := range rule.Users {
+			out.users[strings.TrimSpace(u)] = struct{}{}
+		}
+	}
+
+	for _, c := range rule.CIDRs {
+		prefix, err := parseACLPrefix(c)
+		if err != nil {
+			return out, err
+		}
+		out.prefixes = append(out.prefixes, prefix)
+	}
+
+	for _, d := range rule.Domains {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d == "" {
+			return out, errors.New("empty domain")
+		}
+		out.domains = append(out.domains, d)
+	}
+
+	for _, expr := range rule.DomainRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return out, fmt.Errorf("domain regex %q: %w", expr, err)
+		}
+		out.regexes = append(out.regexes, re)
+	}
+
+	ports, err := parsePortRanges(rule.Ports)
+	if err != nil {
+		return out, err
+	}
+	out.ports = ports
+
+	return out, nil
+}
+
+func parseACLPrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr %q", s)
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func parsePortRanges(specs []string) ([]aclPortRange, error) {
+	var out []aclPortRange
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+
+		fromText, toText, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			toText = fromText
+		}
+
+		from, err1 := strconv.Atoi(strings.TrimSpace(fromText))
+		to, err2 := strconv.Atoi(strings.TrimSpace(toText))
+
+		if err1 != nil || err2 != nil || from < 0 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid port range %q", spec)
+		}
+
+		out = append(out, aclPortRange{from: from, to: to})
+	}
+
+	return out, nil
+}
+
+func (r *compiledACLRule) match(user, domain string, ip netip.Addr, port int) bool {
+	if r.users != nil {
+		if _, ok := r.users[user]; !ok {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 && !portInRanges(r.ports, port) {
+		return false
+	}
+
+	if len(r.prefixes) == 0 && len(r.domains) == 0 && len(r.regexes) == 0 {
+		return true
+	}
+
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	if domain == "" {
+		return false
+	}
+
+	for _, d := range r.domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+
+	for _, re := range r.regexes {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *compiledACLRule) containsIP(ip netip.Addr) bool {
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func portInRanges(ranges []aclPortRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed 判断单个解析后的目标地址。domain 为空表示客户端直接给了 IP。
+// 私有地址（未设置 AllowPrivateTargets 时）只能由 CIDRs 包含该地址的 allow 规则放行：按用户、端口或域名命中的
+// allow 规则不算，否则域名解析到内网地址即可绕过（DNS rebinding）。
+func (p *accessPolicy) allowed(user, domain string, ip netip.Addr, port int) bool {
+	private := !p.allowPrivate && isPrivateTarget(ip)
+
+	for i := range p.rules {
+		rule := &p.rules[i]
+
+		if !rule.match(user, domain, ip, port) {
+			continue
+		}
+
+		if !rule.allow {
+			return false
+		}
+
+		if !private || rule.containsIP(ip) {
+			return true
+		}
+	}
+
+	if private {
+		return false
+	}
+
+	return p.defaultAllow
+}
+
+// isPrivateTarget 包含回环、RFC1918/ULA、链路本地（含云厂商元数据地址 169.254.169.254）、
+// CGNAT、组播与未指定地址。
+func isPrivateTarget(ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		cgnatPrefix.Contains(ip)
+}
+
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// resolveTarget 解析目标并返回允许访问的地址列表；全部被拒绝时返回 errAccessDenied。
+// 调用方只能拨号返回的地址，避免校验后再次解析被 DNS rebinding 绕过。
+func (p *accessPolicy) resolveTarget(ctx context.Context, user, address string) ([]netip.AddrPort, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %q", address)
+	}
+
+	var domain string
+	var addrs []netip.Addr
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{ip.Unmap()}
+	} else {
+		domain = strings.ToLower(strings.TrimSuffix(host, "."))
+
+		resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", domain)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range resolved {
+			addrs = append(addrs, ip.Unmap())
+		}
+	}
+
+	var out []netip.AddrPort
+
+	for _, ip := range addrs {
+		if p.unrestricted || p.allowed(user, domain, ip, port) {
+			out = append(out, netip.AddrPortFrom(ip, uint16(port)))
+		}
+	}
+
+	if len(out) == 0 {
+		return nil, errAccessDenied
+	}
+
+	return out, nil
+}
+
+// dialTarget 在 ACL 校验通过后拨号目标。
+func dialTarget(ctx context.Context, policy *accessPolicy, user, network, address string) (net.Conn, error) {
+	conn, err := dialTargetAddrs(ctx, policy, user, network, address)
+	if err != nil && ctx.Err() == nil {
+		policy.inst.metrics.dialFailure(policy.role, user, err)
+	}
+	return conn, err
+}
+
+func dialTargetAddrs(ctx context.Context, policy *accessPolicy, user, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: policy.timeout,
+	}
+
+	if policy.unrestricted {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := policy.resolveTarget(ctx, user, address)
+	if err != nil {
+		if errors.Is(err, errAccessDenied) {
+			policy.inst.logger.PrintfX("[x] acl denied user=[%s] target=[%s]\n", user, address)
+		}
+		return nil, err
+	}
+
+	var lastErr error
+
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, addr.String())
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
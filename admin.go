@@ -0,0 +1,160 @@
+package csocks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminStats 是 GET /stats 的响应。
+type adminStats struct {
+	Total    TunnelStatsSnapshot            `json:"total"`
+	Users    map[string]TunnelStatsSnapshot `json:"users"`
+	Upstream []UpstreamStatsSnapshot        `json:"upstream,omitempty"`
+}
+
+// newAdminHandler 返回管理接口：
+//
+//	GET    /sessions[?user=NAME]   列出活跃连接
+//	DELETE /sessions/{id}          关闭一个连接
+//	DELETE /sessions?user=NAME     关闭该用户的所有连接
+//	GET    /stats                  总体、按用户与上游服务端的统计
+//	POST   /stats/reset            清零累计统计
+//	GET    /bans                   列出被封禁的来源 IP
+//	DELETE /bans/{ip}              解封一个来源 IP
+//
+// 所有请求都需要 Authorization: Bearer <token>。
+func newAdminHandler(inst *instance, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, inst.sessions.list(r.URL.Query().Get("user")))
+	})
+
+	mux.HandleFunc("DELETE /sessions", func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		if user == "" {
+			writeAdminError(w, http.StatusBadRequest, "user is required")
+			return
+		}
+
+		n := inst.sessions.closeUser(user)
+		inst.logger.Printf("[*] admin closed %d session(s) of user [%s]\n", n, user)
+
+		writeAdminJSON(w, http.StatusOK, map[string]int{"closed": n})
+	})
+
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid session id")
+			return
+		}
+
+		if !inst.sessions.close(id) {
+			writeAdminError(w, http.StatusNotFound, "session not found")
+			return
+		}
+
+		inst.logger.Printf("[*] admin closed session [%d]\n", id)
+
+		writeAdminJSON(w, http.StatusOK, map[string]int{"closed": 1})
+	})
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, adminStats{
+			Total:    inst.stats.total.snapshot(),
+			Users:    inst.stats.userSnapshots(),
+			Upstream: inst.stats.upstreamSnapshots(),
+		})
+	})
+
+	mux.HandleFunc("POST /stats/reset", func(w http.ResponseWriter, r *http.Request) {
+		inst.stats.reset()
+		inst.logger.Printf("[*] admin reset stats\n")
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, inst.bans.list())
+	})
+
+	mux.HandleFunc("DELETE /bans/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip := r.PathValue("ip")
+
+		active, err := inst.bans.unban(inst, ip)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid ip")
+			return
+		}
+
+		if !active {
+			writeAdminError(w, http.StatusNotFound, "ip is not banned")
+			return
+		}
+
+		inst.logger.Printf("[*] admin unbanned [%s]\n", ip)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="csocks"`)
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	writeAdminJSON(w, code, map[string]string{"error": msg})
+}
+
+// serveAdmin 在 AdminListen 上提供管理接口，直到 ctx 结束。
+func serveAdmin(ctx context.Context, listenConfig *ListenConfig, inst *instance) error {
+	if listenConfig.AdminListen == "" {
+		return nil
+	}
+
+	ln, err := listen(listenConfig.AdminListen)
+	if err != nil {
+		return fmt.Errorf("admin_listen: %w", err)
+	}
+
+	server := &http.Server{
+		Handler:           newAdminHandler(inst, listenConfig.AdminToken),
+		ReadHeaderTimeout: listenConfig.timeout(),
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	inst.logger.Printf("[*] admin api listen on: [%s]\n", ln.Addr().String())
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package csocks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// authKeyType 是 AuthorizedKeysFile 每行的第一个字段；KeyID 请求头以 authKeyType + ":" 开头时按 Ed25519 验证。
+const authKeyType = "ed25519"
+
+const authKeyIDPrefix = authKeyType + ":"
+
+// authorizedKey 是 AuthorizedKeysFile 中的一个公钥。
+type authorizedKey struct {
+	user string
+	key  ed25519.PublicKey
+}
+
+// GenerateAuthKey 生成客户端认证使用的 Ed25519 私钥，返回 PEM 编码的 PKCS#8 私钥（客户端的 AuthKeyFile），
+// 以及服务端 AuthorizedKeysFile 中对应的一行，user 是这个公钥的用户名。
+func GenerateAuthKey(user string) (keyPEM []byte, authorizedLine string, err error) {
+	if err := validateAuthKeyUser(user); err != nil {
+		return nil, "", err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	return keyPEM, formatAuthorizedKey(pub, user), nil
+}
+
+// WriteAuthKey 生成私钥写到 keyFile（权限 0600），返回 AuthorizedKeysFile 中对应的一行。
+// keyFile 已存在时返回 fs.ErrExist，不会覆盖。
+func WriteAuthKey(keyFile, user string) (string, error) {
+	if _, err := os.Stat(keyFile); err == nil {
+		return "", fmt.Errorf("%s: %w", keyFile, fs.ErrExist)
+	}
+
+	keyPEM, line, err := GenerateAuthKey(user)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return "", err
+	}
+
+	return line, nil
+}
+
+// AuthorizedKey 返回 keyFile 中私钥在 AuthorizedKeysFile 中对应的一行。
+func AuthorizedKey(keyFile, user string) (string, error) {
+	if err := validateAuthKeyUser(user); err != nil {
+		return "", err
+	}
+
+	priv, err := loadAuthKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	return formatAuthorizedKey(priv.Public().(ed25519.PublicKey), user), nil
+}
+
+func validateAuthKeyUser(user string) error {
+	switch {
+	case user == "":
+		return errors.New("user is empty")
+	case strings.ContainsFunc(user, func(r rune) bool { return r <= ' ' }):
+		return errors.New("user must not contain whitespace")
+	case user == legacyTunnelUser:
+		return fmt.Errorf("user %q is reserved", user)
+	}
+	return nil
+}
+
+func formatAuthorizedKey(pub ed25519.PublicKey, user string) string {
+	return authKeyType + " " + base64.StdEncoding.EncodeToString(pub) + " " + user
+}
+
+// loadAuthKey 读取 PEM 编码的 PKCS#8 Ed25519 私钥。
+func loadAuthKey(name string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("failed to parse private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+
+	return priv, nil
+}
+
+// loadAuthorizedKeys 读取 AuthorizedKeysFile：每行 "ed25519 <base64 公钥> <用户名>"，空行与 # 开头的行忽略。
+// 同一用户可以有多个公钥；未设置时返回 nil。
+func loadAuthorizedKeys(name string) (map[string]authorizedKey, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("authorized_keys_file: %w", err)
+	}
+
+	keys := make(map[string]authorizedKey)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("authorized_keys_file line %d: expected \"%s <public key> <user>\"", n, authKeyType)
+		}
+
+		if fields[0] != authKeyType {
+			return nil, fmt.Errorf("authorized_keys_file line %d: unsupported key type %q", n, fields[0])
+		}
+
+		pub, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("authorized_keys_file line %d: invalid public key", n)
+		}
+
+		if err := validateAuthKeyUser(fields[2]); err != nil {
+			return nil, fmt.Errorf("authorized_keys_file line %d: %w", n, err)
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(pub)
+		if _, ok := keys[encoded]; ok {
+			return nil, fmt.Errorf("authorized_keys_file line %d: duplicate public key", n)
+		}
+
+		keys[encoded] = authorizedKey{user: fields[2], key: pub}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("authorized_keys_file: %w", err)
+	}
+
+	return keys, nil
+}
+
+// verifyAuthKey 用 KeyID 请求头中的公钥验证 Ed25519 签名，成功时返回公钥对应的用户名。
+// 公钥不在 AuthorizedKeysFile 中，或用户在 Users 中被禁用 / 已过期时 reason 为 unknown_key。
+func (r *proxyRuntime) verifyAuthKey(encoded string, msg []byte, signature string) (user, reason string, ok bool) {
+	key, found := r.authKeys[encoded]
+	if !found || !r.userActive(key.user) {
+		return "", "unknown_key", false
+	}
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key.key, msg, sig) {
+		return "", "bad_signature", false
+	}
+
+	return key.user, "", true
+}
+
+// signTunnelRequest 签名隧道请求并返回签名与 KeyID 请求头的值：设置了 AuthKeyFile 时使用 Ed25519 私钥，
+// KeyID 是 "ed25519:<公钥>"；否则使用 Secret 的 HMAC 与配置的 KeyID。
+func (c *ListenConfig) signTunnelRequest(method, host, nonce string, ts int64, proto string) (signature, keyID string) {
+	if c.authKey != nil {
+		msg := tunnelAuthMessageV2(method, c.tunnelPath(), host, nonce, ts, proto)
+		pub := c.authKey.Public().(ed25519.PublicKey)
+
+		return hex.EncodeToString(ed25519.Sign(c.authKey, msg)), authKeyIDPrefix + base64.StdEncoding.EncodeToString(pub)
+	}
+
+	return makeTunnelAuthSignatureV2(c.Secret, method, c.tunnelPath(), host, nonce, ts, proto), c.KeyID
+}
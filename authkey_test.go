@@ -0,0 +1,201 @@
+package csocks
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEd25519Key(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey, string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub, priv, base64.StdEncoding.EncodeToString(pub)
+}
+
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	_, _, alice := newTestEd25519Key(t)
+	_, _, bob := newTestEd25519Key(t)
+
+	tests := []struct {
+		name    string
+		content string
+		users   map[string]string
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			content: "# comment\n\ned25519 " + alice + " alice\n  ed25519\t" + bob + " bob trailing comment\r\n",
+			users:   map[string]string{alice: "alice", bob: "bob"},
+		},
+		{
+			name:    "same user with two keys",
+			content: "ed25519 " + alice + " alice\ned25519 " + bob + " alice\n",
+			users:   map[string]string{alice: "alice", bob: "alice"},
+		},
+		{name: "empty file", content: "", users: map[string]string{}},
+		{name: "missing user", content: "ed25519 " + alice + "\n", wantErr: "line 1: expected"},
+		{name: "unsupported key type", content: "\nssh-rsa " + alice + " alice\n", wantErr: "line 2: unsupported key type"},
+		{name: "invalid base64", content: "ed25519 !!!! alice\n", wantErr: "line 1: invalid public key"},
+		{name: "short key", content: "ed25519 " + base64.StdEncoding.EncodeToString(make([]byte, 31)) + " alice\n", wantErr: "line 1: invalid public key"},
+		{name: "long key", content: "ed25519 " + base64.StdEncoding.EncodeToString(make([]byte, 33)) + " alice\n", wantErr: "line 1: invalid public key"},
+		{name: "reserved user", content: "ed25519 " + alice + " " + legacyTunnelUser + "\n", wantErr: "line 1: user \"default\" is reserved"},
+		{name: "duplicate key", content: "ed25519 " + alice + " alice\ned25519 " + alice + " bob\n", wantErr: "line 2: duplicate public key"},
+		{name: "line too long", content: "ed25519 " + strings.Repeat("A", 70000) + " alice\n", wantErr: "token too long"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := loadAuthorizedKeys(writeTestFile(t, tt.content))
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadAuthorizedKeys error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(keys) != len(tt.users) {
+				t.Fatalf("loaded %d keys, want %d", len(keys), len(tt.users))
+			}
+
+			for encoded, user := range tt.users {
+				if got := keys[encoded]; got.user != user || base64.StdEncoding.EncodeToString(got.key) != encoded {
+					t.Fatalf("key %s = %+v, want user %q", encoded, got, user)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadAuthorizedKeysMissingFile(t *testing.T) {
+	if keys, err := loadAuthorizedKeys(""); keys != nil || err != nil {
+		t.Fatalf("loadAuthorizedKeys(\"\") = %v, %v; want nil, nil", keys, err)
+	}
+
+	if _, err := loadAuthorizedKeys(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("loadAuthorizedKeys succeeded for a missing file")
+	}
+}
+
+func TestVerifyAuthKey(t *testing.T) {
+	alicePub, alicePriv, alice := newTestEd25519Key(t)
+	_, bobPriv, bob := newTestEd25519Key(t)
+	_, strangerPriv, stranger := newTestEd25519Key(t)
+
+	r := &proxyRuntime{
+		authKeys: map[string]authorizedKey{
+			alice: {user: "alice", key: alicePub},
+			bob:   {user: "bob", key: bobPriv.Public().(ed25519.PublicKey)},
+		},
+		users: map[string]TunnelUser{
+			"bob": {Name: "bob", Disabled: true},
+		},
+	}
+
+	msg := tunnelAuthMessageV2("POST", "/tunnel", "example.com", "nonce", time.Now().Unix(), "h2")
+	sign := func(priv ed25519.PrivateKey, msg []byte) string {
+		return hex.EncodeToString(ed25519.Sign(priv, msg))
+	}
+
+	other := tunnelAuthMessageV2("POST", "/tunnel", "example.com", "other-nonce", time.Now().Unix(), "h2")
+	valid := sign(alicePriv, msg)
+
+	tampered, _ := hex.DecodeString(valid)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name      string
+		key       string
+		signature string
+		user      string
+		reason    string
+	}{
+		{name: "valid", key: alice, signature: valid, user: "alice"},
+		{name: "unknown key", key: stranger, signature: sign(strangerPriv, msg), reason: "unknown_key"},
+		{name: "disabled user", key: bob, signature: sign(bobPriv, msg), reason: "unknown_key"},
+		{name: "signed by another key", key: alice, signature: sign(strangerPriv, msg), reason: "bad_signature"},
+		{name: "different message", key: alice, signature: sign(alicePriv, other), reason: "bad_signature"},
+		{name: "flipped bit", key: alice, signature: hex.EncodeToString(tampered), reason: "bad_signature"},
+		{name: "truncated signature", key: alice, signature: valid[:len(valid)-2], reason: "bad_signature"},
+		{name: "extra bytes", key: alice, signature: valid + "00", reason: "bad_signature"},
+		{name: "not hex", key: alice, signature: strings.Repeat("zz", ed25519.SignatureSize), reason: "bad_signature"},
+		{name: "odd length hex", key: alice, signature: valid[:len(valid)-1], reason: "bad_signature"},
+		{name: "empty signature", key: alice, signature: "", reason: "bad_signature"},
+		{name: "empty key", key: "", signature: valid, reason: "unknown_key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, reason, ok := r.verifyAuthKey(tt.key, msg, tt.signature)
+
+			if ok != (tt.reason == "") || user != tt.user || reason != tt.reason {
+				t.Fatalf("verifyAuthKey = %q, %q, %v; want %q, %q", user, reason, ok, tt.user, tt.reason)
+			}
+		})
+	}
+}
+
+// 客户端用 AuthKeyFile 签名的请求能通过服务端的验证。
+func TestSignTunnelRequestAuthKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "client.key")
+
+	line, err := WriteAuthKey(keyFile, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadAuthorizedKeys(writeTestFile(t, line+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := loadAuthKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ListenConfig{authKey: priv}
+	ts := time.Now().Unix()
+
+	signature, keyID := c.signTunnelRequest("POST", "example.com", "nonce", ts, "h2")
+	if !strings.HasPrefix(keyID, authKeyIDPrefix) {
+		t.Fatalf("keyID = %q, want prefix %q", keyID, authKeyIDPrefix)
+	}
+
+	r := &proxyRuntime{authKeys: keys}
+	msg := tunnelAuthMessageV2("POST", c.tunnelPath(), "example.com", "nonce", ts, "h2")
+
+	if user, reason, ok := r.verifyAuthKey(strings.TrimPrefix(keyID, authKeyIDPrefix), msg, signature); !ok || user != "alice" {
+		t.Fatalf("verifyAuthKey = %q, %q, %v; want alice", user, reason, ok)
+	}
+
+	if _, err := WriteAuthKey(keyFile, "alice"); err == nil {
+		t.Fatal("WriteAuthKey overwrote an existing key file")
+	}
+}
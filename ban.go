@@ -0,0 +1,437 @@
+package csocks
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 封禁失败原因中不来自认证指标的几种。
+const (
+	banReasonHandshake = "handshake"
+	banReasonFirstByte = "unknown_first_byte"
+	banReasonReplay    = "replay"
+)
+
+const (
+	defaultBanWindow      = time.Minute
+	defaultBanDuration    = time.Minute
+	defaultBanMaxDuration = 24 * time.Hour
+
+	// 最多记录的来源数。记满后先淘汰失败窗口已过的记录，没有时淘汰失败次数最少的未封禁记录；
+	// 全部处于封禁中时不再记录新来源的失败。
+	maxBanSources = 1 << 16
+
+	// IPv6 来源按 /64 计数与封禁，否则一个 /64 的持有者可以换地址绕过封禁，或填满来源表。
+	banIPv6PrefixBits = 64
+
+	// 同时处于 tarpit 的连接数上限，超过后直接关闭。
+	maxTarpitConns = 1024
+)
+
+// BanConfig 是服务端按来源 IP 的探测与暴力破解限制：Window 内的失败（TLS 握手失败、认证失败、重放、
+// 无法识别的首字节）达到 MaxFailures 次后封禁该 IP。同一 IP 再次被封禁时封禁时长翻倍，不超过 MaxDuration；
+// 解封后 MaxDuration 内没有再被封禁则重新从 Duration 开始。MaxFailures 为 0 时不启用。
+type BanConfig struct {
+	MaxFailures int      `json:"max_failures" yaml:"max_failures" toml:"max_failures"`
+	Window      Duration `json:"window" yaml:"window" toml:"window"`                   // 默认 1m
+	Duration    Duration `json:"duration" yaml:"duration" toml:"duration"`             // 首次封禁时长，默认 1m
+	MaxDuration Duration `json:"max_duration" yaml:"max_duration" toml:"max_duration"` // 默认 24h
+
+	// Tarpit 非 0 时，被封禁来源的新连接保持这么久不响应再关闭，而不是立即关闭。
+	Tarpit Duration `json:"tarpit" yaml:"tarpit" toml:"tarpit"`
+
+	// Allowlist 中的 IP 或 CIDR（例如自己的监控）不计失败，也不会被封禁。
+	Allowlist []string `json:"allowlist" yaml:"allowlist" toml:"allowlist"`
+}
+
+// BanInfo 是一个被封禁来源的快照。IPv6 来源的 IP 是 /64 前缀。
+type BanInfo struct {
+	IP         string    `json:"ip"`
+	Until      time.Time `json:"until"`
+	Bans       int       `json:"bans"`
+	LastReason string    `json:"last_reason"`
+}
+
+type banPolicy struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+	tarpit      time.Duration
+	allowlist   []netip.Prefix
+}
+
+func compileBanConfig(c BanConfig) (*banPolicy, error) {
+	if c.MaxFailures < 0 {
+		return nil, errors.New("max_failures must not be negative")
+	}
+
+	if c.Window < 0 || c.Duration < 0 || c.MaxDuration < 0 || c.Tarpit < 0 {
+		return nil, errors.New("durations must not be negative")
+	}
+
+	p := &banPolicy{
+		maxFailures: c.MaxFailures,
+		window:      cmp.Or(time.Duration(c.Window), defaultBanWindow),
+		duration:    cmp.Or(time.Duration(c.Duration), defaultBanDuration),
+		maxDuration: cmp.Or(time.Duration(c.MaxDuration), defaultBanMaxDuration),
+		tarpit:      time.Duration(c.Tarpit),
+	}
+
+	p.maxDuration = max(p.maxDuration, p.duration)
+
+	for i, s := range c.Allowlist {
+		prefix, err := parseBanPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist[%d]: %w", i, err)
+		}
+		p.allowlist = append(p.allowlist, prefix)
+	}
+
+	return p, nil
+}
+
+func parseBanPrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (p *banPolicy) allowed(addr netip.Addr) bool {
+	for _, prefix := range p.allowlist {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type banSource struct {
+	failures    int
+	windowStart time.Time
+
+	until      time.Time
+	bans       int
+	lastReason string
+
+	// lastBanEnd 用来判断何时重置翻倍。
+	lastBanEnd time.Time
+}
+
+// banList 是一个实例按来源 IP 的失败计数与封禁表。策略为 nil（未启用）时不记录任何东西。
+// bannedSources 指标等于 until 非零的记录数：封禁时置位加一，sweep 清零、unban 与淘汰删除时减一。
+type banList struct {
+	policy atomic.Pointer[banPolicy]
+
+	mu      sync.Mutex
+	sources map[netip.Prefix]*banSource
+
+	tarpitting atomic.Int64
+}
+
+// configure 应用新的策略，已有的计数与封禁保留。
+func (b *banList) configure(p *banPolicy) {
+	if p.maxFailures == 0 {
+		p = nil
+	}
+	b.policy.Store(p)
+}
+
+func remoteAddrIP(addr string) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// banKey 返回 ip 所在的来源：IPv4 是单个地址，IPv6 是所在的 /64。
+func banKey(ip netip.Addr) netip.Prefix {
+	bits := ip.BitLen()
+	if ip.Is6() {
+		bits = banIPv6PrefixBits
+	}
+
+	prefix, _ := ip.Prefix(bits)
+
+	return prefix
+}
+
+func banKeyString(key netip.Prefix) string {
+	if key.IsSingleIP() {
+		return key.Addr().String()
+	}
+	return key.String()
+}
+
+// strike 记录 addr（host:port）的一次失败，达到阈值时封禁。
+func (b *banList) strike(inst *instance, addr, reason string) {
+	p := b.policy.Load()
+	if p == nil {
+		return
+	}
+
+	ip, ok := remoteAddrIP(addr)
+	if !ok || p.allowed(ip) {
+		return
+	}
+
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := banKey(ip)
+
+	src := b.sources[key]
+	if src == nil {
+		if len(b.sources) >= maxBanSources && !b.evict(inst, p, now) {
+			return
+		}
+		if b.sources == nil {
+			b.sources = make(map[netip.Prefix]*banSource)
+		}
+		src = &banSource{}
+		b.sources[key] = src
+	}
+
+	// 已封禁期间（例如封禁前建立的 h2 连接）的失败不再计数。
+	if now.Before(src.until) {
+		return
+	}
+
+	if now.Sub(src.windowStart) > p.window {
+		src.failures, src.windowStart = 0, now
+	}
+
+	src.failures++
+	src.lastReason = reason
+
+	if src.failures < p.maxFailures {
+		return
+	}
+
+	if !src.lastBanEnd.IsZero() && now.Sub(src.lastBanEnd) > p.maxDuration {
+		src.bans = 0
+	}
+
+	d := p.duration
+	for i := 0; i < src.bans && d < p.maxDuration; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxDuration)
+
+	// 上一次封禁已到期但 sweep 还没清零时，它已经计入 bannedSources。
+	if src.until.IsZero() {
+		inst.metrics.bannedSources.with().Add(1)
+	}
+
+	src.bans++
+	src.failures = 0
+	src.until = now.Add(d)
+	src.lastBanEnd = src.until
+
+	inst.metrics.bans.with(reason).Add(1)
+
+	inst.logger.Printf("[*] banned [%s] for [%s] after %d failure(s), last [%s]\n", banKeyString(key), d, p.maxFailures, reason)
+}
+
+// evict 在来源表记满时腾出空间：删除所有失败窗口已过、且不在封禁中的记录；没有这样的记录时，
+// 删除失败次数最少的一条未封禁记录。全部处于封禁中时返回 false。调用时持有 b.mu。
+func (b *banList) evict(inst *instance, p *banPolicy, now time.Time) bool {
+	var (
+		victim    netip.Prefix
+		victimSrc *banSource
+		evicted   bool
+	)
+
+	for key, src := range b.sources {
+		if now.Before(src.until) {
+			continue
+		}
+
+		if now.Sub(src.windowStart) > p.window {
+			b.remove(inst, key, src)
+			evicted = true
+			continue
+		}
+
+		if victimSrc == nil || src.failures < victimSrc.failures {
+			victim, victimSrc = key, src
+		}
+	}
+
+	if !evicted && victimSrc != nil {
+		b.remove(inst, victim, victimSrc)
+		evicted = true
+	}
+
+	return evicted
+}
+
+// remove 删除一条记录，它仍计入 bannedSources 时减一。调用时持有 b.mu。
+func (b *banList) remove(inst *instance, key netip.Prefix, src *banSource) {
+	if !src.until.IsZero() {
+		inst.metrics.bannedSources.with().Add(-1)
+	}
+	delete(b.sources, key)
+}
+
+// banned 返回 addr（host:port）当前是否被封禁。
+func (b *banList) banned(addr string) bool {
+	if b.policy.Load() == nil {
+		return false
+	}
+
+	ip, ok := remoteAddrIP(addr)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	src := b.sources[banKey(ip)]
+
+	return src != nil && time.Now().Before(src.until)
+}
+
+// reject 处理被封禁来源的新连接：配置了 Tarpit 时保持连接到超时或 ctx 结束，否则立即关闭。
+func (b *banList) reject(ctx context.Context, conn net.Conn) {
+	p := b.policy.Load()
+
+	if p == nil || p.tarpit == 0 || b.tarpitting.Add(1) > maxTarpitConns {
+		if p != nil && p.tarpit != 0 {
+			b.tarpitting.Add(-1)
+		}
+		_ = conn.Close()
+		return
+	}
+
+	go func() {
+		defer b.tarpitting.Add(-1)
+		defer conn.Close()
+
+		timer := time.NewTimer(p.tarpit)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+	}()
+}
+
+// list 返回当前被封禁的来源，按解封时间排序。
+func (b *banList) list() []BanInfo {
+	now := time.Now()
+	out := []BanInfo{}
+
+	b.mu.Lock()
+	for key, src := range b.sources {
+		if now.Before(src.until) {
+			out = append(out, BanInfo{
+				IP:         banKeyString(key),
+				Until:      src.until,
+				Bans:       src.bans,
+				LastReason: src.lastReason,
+			})
+		}
+	}
+	b.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b BanInfo) int {
+		return a.Until.Compare(b.Until)
+	})
+
+	return out
+}
+
+// unban 立即解封 ip 所在的来源（IPv6 是所在的 /64）并清除它的失败计数，返回它是否处于封禁中。
+func (b *banList) unban(inst *instance, s string) (bool, error) {
+	ip, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return false, err
+	}
+	key := banKey(ip.Unmap())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	src := b.sources[key]
+	if src == nil {
+		return false, nil
+	}
+
+	active := time.Now().Before(src.until)
+	b.remove(inst, key, src)
+
+	return active, nil
+}
+
+// run 定期输出解封日志并清理不再需要的记录，直到 ctx 结束。
+func (b *banList) run(ctx context.Context, inst *instance) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.sweep(inst)
+		}
+	}
+}
+
+func (b *banList) sweep(inst *instance) {
+	p := b.policy.Load()
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, src := range b.sources {
+		if !src.until.IsZero() && !now.Before(src.until) {
+			src.until = time.Time{}
+			inst.metrics.bannedSources.with().Add(-1)
+			inst.logger.Printf("[*] unbanned [%s]\n", banKeyString(key))
+		}
+
+		if !src.until.IsZero() {
+			continue
+		}
+
+		// 失败窗口已过，且翻倍记录已重置（或策略已关闭）时删除。
+		windowDone := p == nil || now.Sub(src.windowStart) > p.window
+		bansDone := p == nil || src.lastBanEnd.IsZero() || now.Sub(src.lastBanEnd) > p.maxDuration
+
+		if windowDone && bansDone {
+			delete(b.sources, key)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package csocks
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestBanList(t *testing.T, c BanConfig) (*banList, *instance) {
+	t.Helper()
+
+	p, err := compileBanConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &banList{}
+	b.configure(p)
+
+	return b, newInstance(true, nil)
+}
+
+func TestBanIPv6Prefix(t *testing.T) {
+	b, inst := newTestBanList(t, BanConfig{MaxFailures: 2})
+
+	b.strike(inst, "[2001:db8:1:2::1]:1000", "bad_signature")
+	b.strike(inst, "[2001:db8:1:2::ffff]:1000", "bad_signature")
+
+	if !b.banned("[2001:db8:1:2:aaaa::1]:443") {
+		t.Fatal("address in the same /64 is not banned")
+	}
+
+	if b.banned("[2001:db8:1:3::1]:443") {
+		t.Fatal("address in another /64 is banned")
+	}
+
+	if got := b.list(); len(got) != 1 || got[0].IP != "2001:db8:1:2::/64" {
+		t.Fatalf("list = %+v", got)
+	}
+
+	if active, err := b.unban(inst, "2001:db8:1:2::abcd"); !active || err != nil {
+		t.Fatalf("unban = %v, %v; want true, nil", active, err)
+	}
+
+	if b.banned("[2001:db8:1:2::1]:1000") {
+		t.Fatal("still banned after unban")
+	}
+}
+
+func TestBanIPv4(t *testing.T) {
+	b, inst := newTestBanList(t, BanConfig{MaxFailures: 1, Allowlist: []string{"10.0.0.0/8"}})
+
+	b.strike(inst, "192.0.2.1:1000", "bad_signature")
+	b.strike(inst, "10.1.2.3:1000", "bad_signature")
+
+	if !b.banned("192.0.2.1:443") || b.banned("192.0.2.2:443") {
+		t.Fatal("IPv4 sources must be banned individually")
+	}
+
+	if b.banned("10.1.2.3:443") {
+		t.Fatal("allowlisted source is banned")
+	}
+
+	if got := b.list(); len(got) != 1 || got[0].IP != "192.0.2.1" {
+		t.Fatalf("list = %+v", got)
+	}
+}
+
+// 来源表记满后，新来源淘汰失败次数最少的未封禁记录，已封禁的来源保留。
+func TestBanEvict(t *testing.T) {
+	b, inst := newTestBanList(t, BanConfig{MaxFailures: 3})
+
+	now := time.Now()
+	b.sources = make(map[netip.Prefix]*banSource, maxBanSources)
+
+	banned := banKey(netip.MustParseAddr("192.0.2.1"))
+	b.sources[banned] = &banSource{until: now.Add(time.Hour), windowStart: now}
+
+	for i := 1; len(b.sources) < maxBanSources; i++ {
+		ip := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		b.sources[banKey(ip)] = &banSource{failures: 2, windowStart: now}
+	}
+
+	low := banKey(netip.MustParseAddr("10.0.0.1"))
+	b.sources[low].failures = 1
+
+	b.strike(inst, "198.51.100.1:1000", "bad_signature")
+
+	if len(b.sources) != maxBanSources {
+		t.Fatalf("len(sources) = %d, want %d", len(b.sources), maxBanSources)
+	}
+
+	if _, ok := b.sources[banKey(netip.MustParseAddr("198.51.100.1"))]; !ok {
+		t.Fatal("new source was not recorded")
+	}
+
+	if _, ok := b.sources[low]; ok {
+		t.Fatal("lowest-failure source was not evicted")
+	}
+
+	if !b.banned("192.0.2.1:443") {
+		t.Fatal("banned source was evicted")
+	}
+}
+
+// 到期但 sweep 还没处理的封禁再次被封禁、或被解封时，bannedSources 不能漂移。
+func TestBanGauge(t *testing.T) {
+	b, inst := newTestBanList(t, BanConfig{MaxFailures: 1, Duration: Duration(time.Millisecond)})
+	gauge := inst.metrics.bannedSources.with()
+
+	b.strike(inst, "192.0.2.1:1000", "bad_signature")
+	if got := gauge.Load(); got != 1 {
+		t.Fatalf("gauge after ban = %d, want 1", got)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	b.strike(inst, "192.0.2.1:1000", "bad_signature")
+	if got := gauge.Load(); got != 1 {
+		t.Fatalf("gauge after re-ban = %d, want 1", got)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := b.unban(inst, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := gauge.Load(); got != 0 {
+		t.Fatalf("gauge after unban of an expired ban = %d, want 0", got)
+	}
+
+	b.strike(inst, "192.0.2.2:1000", "bad_signature")
+	time.Sleep(5 * time.Millisecond)
+	b.sweep(inst)
+	if got := gauge.Load(); got != 0 {
+		t.Fatalf("gauge after sweep = %d, want 0", got)
+	}
+}
@@ -0,0 +1,180 @@
+package csocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// handleSocks5Bind 实现 SOCKS5 BIND：
+// 第一次应答返回监听地址，接受一个入站连接后第二次应答返回对端地址，然后拼接到隧道上。
+func handleSocks5Bind(ctx context.Context, policy *accessPolicy, negotiationRequest *negotiationRequest) {
+	conn := negotiationRequest.Conn
+	logger := policy.inst.logger
+	stats := policy.inst.stats.userTunnelStats(negotiationRequest.statsUser())
+
+	if err := checkBindTarget(ctx, policy, negotiationRequest.User, negotiationRequest.Address); err != nil {
+		logger.PrintfX("[x] bind for [%s] user=[%s] rejected [%s]\n",
+			negotiationRequest.Address,
+			negotiationRequest.User,
+			err.Error(),
+		)
+
+		stats.streamFail()
+		writeSocks5Reply(conn, socks5ReplyForDialError(err))
+		return
+	}
+
+	ln, err := listenForBind(ctx, policy, conn.LocalAddr(), negotiationRequest.Address)
+	if err != nil {
+		logger.PrintfX("[x] bind listen for [%s] user=[%s] error [%s]\n",
+			negotiationRequest.Address,
+			negotiationRequest.User,
+			err.Error(),
+		)
+
+		stats.streamFail()
+		writeSocks5Reply(conn, 0x01)
+		return
+	}
+
+	defer ln.Close()
+
+	logger.PrintfX("[+] bind for [%s] user=[%s] listen on [%s]\n",
+		negotiationRequest.Address,
+		negotiationRequest.User,
+		ln.Addr().String(),
+	)
+
+	writeSocks5ReplyAddr(conn, 0x00, ln.Addr())
+
+	acceptCtx, cancel := context.WithTimeout(ctx, bindAcceptTimeout)
+	defer cancel()
+
+	go func() {
+		<-acceptCtx.Done()
+		_ = ln.Close()
+	}()
+
+	conn1, err := acceptBindPeer(policy, negotiationRequest.User, ln, negotiationRequest.Address)
+	if err != nil {
+		logger.PrintfX("[x] bind accept for [%s] error [%s]\n",
+			negotiationRequest.Address,
+			err.Error(),
+		)
+
+		stats.streamFail()
+		if errors.Is(acceptCtx.Err(), context.DeadlineExceeded) {
+			writeSocks5Reply(conn, 0x06)
+		} else {
+			writeSocks5Reply(conn, 0x01)
+		}
+		return
+	}
+
+	_ = ln.Close()
+	cancel()
+
+	logger.PrintfX("[+] bind accepted [%s]\n", conn1.RemoteAddr().String())
+
+	writeSocks5ReplyAddr(conn, 0x00, conn1.RemoteAddr())
+
+	mutualCopyIO(ctx, conn, newStatsConn(conn1, stats, negotiationRequest.metrics), policy.idleTimeout)
+
+	logger.PrintfX("[-] client [%s] user=[%s] disconnected\n",
+		conn.RemoteAddr().String(),
+		negotiationRequest.User,
+	)
+}
+
+// checkBindTarget 对 BIND 的 DST.ADDR 做 ACL 校验；未指定地址表示接受任意对端，由 acceptBindPeer 逐个校验。
+func checkBindTarget(ctx context.Context, policy *accessPolicy, user, address string) error {
+	if policy.unrestricted {
+		return nil
+	}
+
+	if ip := net.ParseIP(hostFromAddress(address)); ip != nil && ip.IsUnspecified() {
+		return nil
+	}
+
+	_, err := policy.resolveTarget(ctx, user, address)
+	return err
+}
+
+// listenForBind 选择 BIND 的监听地址：优先使用收到这个请求的连接的本地地址，客户端就是通过这个地址找到服务端的，
+// 多网卡主机上第一次应答里的地址与实际监听的地址一致。该地址是回环地址或未知时（本地反向代理、forward 端直连），
+// 改用通往 DST.ADDR 的出口地址。两者都不可用时返回错误，不在所有网卡上监听。
+func listenForBind(ctx context.Context, policy *accessPolicy, local net.Addr, address string) (net.Listener, error) {
+	var lc net.ListenConfig
+
+	localIP := bindListenIP(local)
+
+	if localIP == nil {
+		dialer := &net.Dialer{
+			Timeout: policy.timeout,
+		}
+
+		// UDP "连接" 不发送任何数据，只用来让内核选出口地址。
+		probe, err := dialer.DialContext(ctx, "udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("no listen address for bind: %w", err)
+		}
+
+		localIP = probe.LocalAddr().(*net.UDPAddr).IP
+		_ = probe.Close()
+	}
+
+	return lc.Listen(ctx, "tcp", net.JoinHostPort(localIP.String(), "0"))
+}
+
+// bindListenIP 返回 addr 中可以用于 BIND 监听的 IP，回环、未指定或不是 IP 地址时返回 nil。
+func bindListenIP(addr net.Addr) net.IP {
+	var ip net.IP
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return nil
+	}
+
+	return ip
+}
+
+// acceptBindPeer 只接受来自 DST.ADDR 的连接；DST.ADDR 为域名或未指定地址时接受任意来源。
+// 接受的对端地址同样要通过 ACL，被拒绝的连接直接关闭并继续等待。
+func acceptBindPeer(policy *accessPolicy, user string, ln net.Listener, address string) (net.Conn, error) {
+	logger := policy.inst.logger
+
+	expectIP := net.ParseIP(hostFromAddress(address))
+	if expectIP != nil && expectIP.IsUnspecified() {
+		expectIP = nil
+	}
+
+	for {
+		conn1, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		peer, ok := conn1.RemoteAddr().(*net.TCPAddr)
+		if !ok || (expectIP != nil && !peer.IP.Equal(expectIP)) {
+			logger.PrintfX("[x] bind rejected unexpected peer [%s]\n", conn1.RemoteAddr().String())
+			_ = conn1.Close()
+			continue
+		}
+
+		if !policy.unrestricted && !policy.allowed(user, "", peer.AddrPort().Addr().Unmap(), peer.Port) {
+			logger.PrintfX("[x] bind rejected peer [%s] user=[%s] by acl\n", conn1.RemoteAddr().String(), user)
+			_ = conn1.Close()
+			continue
+		}
+
+		return conn1, nil
+	}
+}
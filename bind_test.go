@@ -0,0 +1,63 @@
+package csocks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBindListenIP(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{name: "tcp", addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, want: "192.0.2.1"},
+		{name: "udp", addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, want: "2001:db8::1"},
+		{name: "mapped ipv4", addr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443}, want: "192.0.2.1"},
+		{name: "loopback", addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}},
+		{name: "ipv6 loopback", addr: &net.TCPAddr{IP: net.IPv6loopback, Port: 1080}},
+		{name: "unspecified", addr: &net.TCPAddr{IP: net.IPv4zero, Port: 1080}},
+		{name: "h2 placeholder", addr: dummyAddr("h2-local")},
+		{name: "nil", addr: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bindListenIP(tt.addr)
+
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("bindListenIP = %v, want nil", got)
+				}
+				return
+			}
+
+			if got.String() != tt.want {
+				t.Fatalf("bindListenIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// 收到请求的地址不可用时使用通往 DST.ADDR 的出口地址，两者都不可用时不在所有网卡上监听。
+func TestListenForBindFallback(t *testing.T) {
+	policy := &accessPolicy{timeout: time.Second}
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+
+	ln, err := listenForBind(context.Background(), policy, local, "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("listen address = %v, want 127.0.0.1", ip)
+	}
+
+	if ln, err := listenForBind(context.Background(), policy, local, "no-port"); err == nil {
+		_ = ln.Close()
+		t.Fatalf("listenForBind listened on %v without a usable address", ln.Addr())
+	}
+}
@@ -0,0 +1,266 @@
+package csocks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CertOptions.KeyType 的可选值。
+const (
+	CertKeyECDSA   = "ecdsa"
+	CertKeyEd25519 = "ed25519"
+)
+
+const defaultCertValidity = 10 * 365 * 24 * time.Hour
+
+// CertOptions 是生成自签名证书的参数，零值使用默认值。
+// 客户端通过公钥固定校验服务端，证书的有效期与 SAN 只在经过 CDN 等需要校验证书的场景下有意义。
+type CertOptions struct {
+	KeyType  string   `json:"key_type" yaml:"key_type" toml:"key_type"` // ecdsa（默认，P-256）或 ed25519
+	Hosts    []string `json:"hosts" yaml:"hosts" toml:"hosts"`          // SAN，域名或 IP，默认 localhost
+	Validity Duration `json:"validity" yaml:"validity" toml:"validity"` // 默认 10 年
+}
+
+func (o CertOptions) validate() error {
+	switch strings.ToLower(o.KeyType) {
+	case "", CertKeyECDSA, CertKeyEd25519:
+	default:
+		return fmt.Errorf("unknown key type %q, expected %s or %s", o.KeyType, CertKeyECDSA, CertKeyEd25519)
+	}
+
+	if o.Validity < 0 {
+		return errors.New("validity must not be negative")
+	}
+
+	for _, host := range o.Hosts {
+		if strings.TrimSpace(host) == "" {
+			return errors.New("hosts must not contain empty names")
+		}
+	}
+
+	return nil
+}
+
+// GenerateCertificate 生成私钥与自签名证书，返回 PEM 编码的证书与 PKCS#8 私钥。
+func GenerateCertificate(opts CertOptions) (certPEM, keyPEM []byte, err error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		pub  crypto.PublicKey
+		priv crypto.Signer
+	)
+
+	switch strings.ToLower(opts.KeyType) {
+	case CertKeyEd25519:
+		pub, priv, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+	default:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		pub, priv = &key.PublicKey, key
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hosts := opts.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+
+	validity := time.Duration(opts.Validity)
+	if validity == 0 {
+		validity = defaultCertValidity
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+
+		// 留出一点余量，避免对端时钟稍慢时证书尚未生效。
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// WriteCertificate 生成私钥与自签名证书并写到 certFile / keyFile，私钥文件权限为 0600。
+// 任一文件已存在时返回 fs.ErrExist，不会覆盖。
+func WriteCertificate(certFile, keyFile string, opts CertOptions) error {
+	for _, name := range []string{certFile, keyFile} {
+		if _, err := os.Stat(name); err == nil {
+			return fmt.Errorf("%s: %w", name, fs.ErrExist)
+		}
+	}
+
+	certPEM, keyPEM, err := GenerateCertificate(opts)
+	if err != nil {
+		return err
+	}
+
+	// 先写私钥；证书存在即表示两个文件都已完整写入。
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(certFile, certPEM, 0644)
+}
+
+// WritePublicKey 把 certFile 中证书的公钥写到 publicKeyFile，供客户端的 PublicKeyFile 使用。
+func WritePublicKey(certFile, publicKeyFile string) error {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("failed to parse certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	return writeCertificatePublicKey(cert, publicKeyFile)
+}
+
+func writeCertificatePublicKey(cert *x509.Certificate, publicKeyFile string) error {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	})
+
+	if strings.TrimSpace(publicKeyFile) == "" {
+		publicKeyFile = "public.key"
+	}
+
+	return os.WriteFile(publicKeyFile, pemBytes, 0644)
+}
+
+// ensureServerCertificate 在 GenerateCert 打开且证书与私钥都不存在时生成它们，返回是否生成了新证书。
+// 只缺其中一个时报错，不覆盖已有的文件。
+func ensureServerCertificate(listenConfig *ListenConfig) (bool, error) {
+	if !listenConfig.GenerateCert {
+		return false, nil
+	}
+
+	_, certErr := os.Stat(listenConfig.ServerCertFile)
+	_, keyErr := os.Stat(listenConfig.ServerKeyFile)
+
+	switch {
+	case certErr == nil && keyErr == nil:
+		return false, nil
+
+	case errors.Is(certErr, fs.ErrNotExist) && errors.Is(keyErr, fs.ErrNotExist):
+		if err := WriteCertificate(listenConfig.ServerCertFile, listenConfig.ServerKeyFile, listenConfig.CertOptions); err != nil {
+			return false, err
+		}
+		return true, nil
+
+	case certErr != nil && !errors.Is(certErr, fs.ErrNotExist):
+		return false, certErr
+
+	case keyErr != nil && !errors.Is(keyErr, fs.ErrNotExist):
+		return false, keyErr
+
+	default:
+		return false, errors.New("only one of server_cert_file / server_key_file exists, refusing to generate a new certificate")
+	}
+}
+
+// writeFileAtomic 先写到同目录的临时文件再改名，进程中途退出不会留下写了一半的文件。
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
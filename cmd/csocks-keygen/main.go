@@ -0,0 +1,72 @@
+// csocks-keygen 生成服务端私钥、自签名证书，以及客户端固定使用的公钥文件。
+//
+//	csocks-keygen -cert server.crt -key server.key -pub public.key -type ed25519 -hosts example.com,203.0.113.1
+//
+// 使用 -auth-key 时改为生成客户端认证使用的 Ed25519 私钥，并输出服务端 authorized_keys_file 中对应的一行：
+//
+//	csocks-keygen -auth-key alice.key -user alice >> authorized_keys
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	csocks "github.com/refgd/csocks-core"
+)
+
+func main() {
+	certFile := flag.String("cert", "server.crt", "certificate output file")
+	keyFile := flag.String("key", "server.key", "private key output file (written with mode 0600)")
+	publicKeyFile := flag.String("pub", "public.key", "public key output file for clients, empty to skip")
+	keyType := flag.String("type", csocks.CertKeyECDSA, "key type: ecdsa or ed25519")
+	hosts := flag.String("hosts", "", "comma separated DNS names / IP addresses for the certificate (default localhost)")
+	validity := flag.Duration("validity", 10*365*24*time.Hour, "certificate validity")
+	authKeyFile := flag.String("auth-key", "", "generate a client auth private key to this file instead of a certificate")
+	user := flag.String("user", "", "user name for -auth-key")
+	flag.Parse()
+
+	if *authKeyFile != "" {
+		line, err := csocks.WriteAuthKey(*authKeyFile, *user)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "csocks-keygen:", err)
+			os.Exit(1)
+		}
+
+		// 私钥路径输出到 stderr，stdout 只有 authorized key 一行，便于直接追加到文件。
+		fmt.Fprintf(os.Stderr, "private key: %s\n", *authKeyFile)
+		fmt.Println(line)
+		return
+	}
+
+	opts := csocks.CertOptions{
+		KeyType:  *keyType,
+		Validity: csocks.Duration(*validity),
+	}
+
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			opts.Hosts = append(opts.Hosts, host)
+		}
+	}
+
+	if err := csocks.WriteCertificate(*certFile, *keyFile, opts); err != nil {
+		fmt.Fprintln(os.Stderr, "csocks-keygen:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("certificate: %s\nprivate key: %s\n", *certFile, *keyFile)
+
+	if *publicKeyFile == "" {
+		return
+	}
+
+	if err := csocks.WritePublicKey(*certFile, *publicKeyFile); err != nil {
+		fmt.Fprintln(os.Stderr, "csocks-keygen:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("public key:  %s\n", *publicKeyFile)
+}
@@ -0,0 +1,528 @@
+package csocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigVersion 是当前支持的配置文件格式版本。
+const ConfigVersion = 1
+
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultIdleTimeout = 60 * time.Second
+	defaultTunnelPath  = "/assets/update"
+
+	defaultUpgradeToken           = "websocket"
+	defaultHeaderSessionID        = "X-Session-Id"
+	defaultHeaderRequestTime      = "X-Request-Time"
+	defaultHeaderRequestSignature = "X-Request-Signature"
+	defaultHeaderKeyID            = "X-Key-Id"
+
+	defaultMaxH2Streams                   = 64
+	defaultH2IdleTimeout                  = 30 * time.Second
+	defaultH2MaxUploadBufferPerConnection = 1 << 20
+	defaultH2MaxUploadBufferPerStream     = 256 << 10
+)
+
+// Duration 是配置文件中的时长，写法同 time.ParseDuration，例如 "10s"、"1m30s"。
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected a value like \"10s\" or \"1m30s\"", string(b))
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalYAML 在错误信息中带上行号。
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if err := d.UnmarshalText([]byte(node.Value)); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+func (c *ListenConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return defaultTimeout
+}
+
+func (c *ListenConfig) idleTimeout() time.Duration {
+	if c.IdleTimeout > 0 {
+		return time.Duration(c.IdleTimeout)
+	}
+	return defaultIdleTimeout
+}
+
+func (c *ListenConfig) drainTimeout() time.Duration {
+	return time.Duration(c.DrainTimeout)
+}
+
+func (c *ListenConfig) tunnelPath() string {
+	if c.TunnelPath != "" {
+		return c.TunnelPath
+	}
+	return defaultTunnelPath
+}
+
+// acceptsTunnelPath 表示服务端是否接受 path 上的隧道请求：TunnelPath 或 TunnelPaths 之一。
+func (c *ListenConfig) acceptsTunnelPath(path string) bool {
+	return path == c.tunnelPath() || slices.Contains(c.TunnelPaths, path)
+}
+
+func (c *ListenConfig) upgradeToken() string {
+	if c.UpgradeToken != "" {
+		return c.UpgradeToken
+	}
+	return defaultUpgradeToken
+}
+
+// tunnelHeaders 返回认证头名称，未设置的使用默认值。
+func (c *ListenConfig) tunnelHeaders() TunnelHeaders {
+	h := c.TunnelHeaders
+
+	set := func(p *string, v string) {
+		if *p == "" {
+			*p = v
+		}
+	}
+
+	set(&h.SessionID, defaultHeaderSessionID)
+	set(&h.RequestTime, defaultHeaderRequestTime)
+	set(&h.Signature, defaultHeaderRequestSignature)
+	set(&h.KeyID, defaultHeaderKeyID)
+
+	return h
+}
+
+func (c *ListenConfig) maxH2Streams() int {
+	if c.MaxH2Streams > 0 {
+		return c.MaxH2Streams
+	}
+	return defaultMaxH2Streams
+}
+
+func (c *ListenConfig) h2IdleTimeout() time.Duration {
+	if c.H2IdleTimeout > 0 {
+		return time.Duration(c.H2IdleTimeout)
+	}
+	return defaultH2IdleTimeout
+}
+
+func (c *ListenConfig) h2MaxUploadBufferPerConnection() int32 {
+	if c.H2MaxUploadBufferPerConnection > 0 {
+		return c.H2MaxUploadBufferPerConnection
+	}
+	return defaultH2MaxUploadBufferPerConnection
+}
+
+func (c *ListenConfig) h2MaxUploadBufferPerStream() int32 {
+	if c.H2MaxUploadBufferPerStream > 0 {
+		return c.H2MaxUploadBufferPerStream
+	}
+	return defaultH2MaxUploadBufferPerStream
+}
+
+// isForward 表示配置的是 forward（客户端）模式，否则是服务端模式。
+func (c *ListenConfig) isForward() bool {
+	return c.ServerAddress != "" || len(c.Servers) > 0
+}
+
+// Validate 检查配置是否完整、各字段取值是否合法，返回的错误包含所有问题，每条以字段名开头。
+func (c *ListenConfig) Validate() error {
+	return c.validate(true)
+}
+
+// validate 同 Validate；listen 为 false 时不要求 ListenPort（Dialer 不监听）。
+func (c *ListenConfig) validate(listen bool) error {
+	var errs []error
+
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Version != 0 && c.Version != ConfigVersion {
+		fail("version", "unsupported version %d, expected %d", c.Version, ConfigVersion)
+	}
+
+	if listen && strings.TrimSpace(c.ListenPort) == "" {
+		fail("listen_port", "is required")
+	}
+
+	switch {
+	case c.isForward():
+		if c.ServerCertFile != "" {
+			fail("server_cert_file", "cannot be combined with server_address / servers")
+		}
+
+		for i, server := range upstreamServers(c) {
+			field := "server_address"
+			if len(c.Servers) > 0 {
+				field = fmt.Sprintf("servers[%d]", i)
+			}
+
+			if strings.TrimSpace(server.Address) == "" {
+				fail(field+".address", "is required")
+			}
+
+			if strings.TrimSpace(server.PublicKeyFile) == "" {
+				if len(c.Servers) > 0 {
+					fail(field+".public_key_file", "is required")
+				} else {
+					fail("public_key_file", "is required in client mode")
+				}
+			}
+
+			if _, err := parseForwardProtocol(server.Protocol); err != nil {
+				fail(field+".protocol", "%s", err.Error())
+			}
+
+			if server.AuthKeyFile != "" {
+				if _, err := loadAuthKey(server.AuthKeyFile); err != nil {
+					fail(field+".auth_key_file", "%s", err.Error())
+				}
+			}
+
+			if c.Secret == "" && server.Secret == "" && c.AuthKeyFile == "" && server.AuthKeyFile == "" && c.ClientCertFile == "" {
+				fail(field+".secret", "is required unless auth_key_file or client_cert_file is set")
+			}
+		}
+
+		if c.AuthKeyFile != "" {
+			if _, err := loadAuthKey(c.AuthKeyFile); err != nil {
+				fail("auth_key_file", "%s", err.Error())
+			}
+		}
+
+		if _, err := parseServerStrategy(c.ServerStrategy); err != nil {
+			fail("server_strategy", "%s", err.Error())
+		}
+
+		if _, err := parseForwardProtocol(c.ForwardProtocol); err != nil {
+			fail("forward_protocol", "%s", err.Error())
+		}
+
+		if _, err := loadClientCertificate(c); err != nil {
+			errs = append(errs, err)
+		}
+
+		for i, u := range c.LocalUsers {
+			if u.Username == "" {
+				fail(fmt.Sprintf("local_users[%d].username", i), "is required")
+			}
+		}
+
+		if _, err := loadRouteTable(c, nil); err != nil {
+			errs = append(errs, err)
+		}
+
+	case c.ServerCertFile != "":
+		if c.ServerKeyFile == "" {
+			fail("server_key_file", "is required in server mode")
+		}
+
+		if c.GenerateCert {
+			if err := c.CertOptions.validate(); err != nil {
+				fail("cert_options", "%s", err.Error())
+			}
+		}
+
+		if _, err := newTunnelUserTable(c.Users); err != nil {
+			errs = append(errs, err)
+		}
+
+		if c.Secret == "" && len(c.Users) == 0 && c.AuthorizedKeysFile == "" && c.ClientCAFile == "" {
+			fail("secret", "is required when no users, authorized_keys_file or client_ca_file are configured")
+		}
+
+		// 早期版本的默认密钥，所有人都知道。
+		if c.Secret == legacyDefaultSecret {
+			fail("secret", "%q is the old default and must not be used", legacyDefaultSecret)
+		}
+
+		if _, err := loadAuthorizedKeys(c.AuthorizedKeysFile); err != nil {
+			errs = append(errs, err)
+		}
+
+		if _, err := newClientCertAuth(c); err != nil {
+			errs = append(errs, err)
+		}
+
+		if c.ReplayCacheSize < 0 {
+			fail("replay_cache_size", "must not be negative")
+		}
+
+		if _, err := compileBanConfig(c.Ban); err != nil {
+			fail("ban", "%s", err.Error())
+		}
+
+		if _, err := newAccessPolicy(c, nil); err != nil {
+			errs = append(errs, err)
+		}
+
+		if c.FallbackURL != "" && (c.FallbackDir != "" || c.FallbackFS != nil) {
+			fail("fallback_dir", "cannot be used together with fallback_url")
+		} else if _, err := newFallbackHandler(c, nil); err != nil {
+			errs = append(errs, err)
+		}
+
+	default:
+		fail("server_address", "either server_address / servers (client mode) or server_cert_file (server mode) is required")
+	}
+
+	if c.AdminListen != "" && c.AdminToken == "" {
+		fail("admin_token", "is required when admin_listen is set")
+	}
+
+	if c.Timeout < 0 {
+		fail("timeout", "must not be negative")
+	}
+
+	if c.IdleTimeout < 0 {
+		fail("idle_timeout", "must not be negative")
+	}
+
+	if c.DrainTimeout < 0 {
+		fail("drain_timeout", "must not be negative")
+	}
+
+	if c.TunnelPath != "" && !strings.HasPrefix(c.TunnelPath, "/") {
+		fail("tunnel_path", "must start with \"/\"")
+	}
+
+	for i, p := range c.TunnelPaths {
+		if !strings.HasPrefix(p, "/") {
+			fail(fmt.Sprintf("tunnel_paths[%d]", i), "must start with \"/\"")
+		}
+	}
+
+	if c.UpgradeToken != "" && !httpguts.ValidHeaderFieldName(c.UpgradeToken) {
+		fail("upgrade_token", "%q is not a valid HTTP token", c.UpgradeToken)
+	}
+
+	headers := c.tunnelHeaders()
+	seenHeaders := make(map[string]string)
+
+	for _, h := range []struct{ field, name string }{
+		{"tunnel_headers.session_id", headers.SessionID},
+		{"tunnel_headers.request_time", headers.RequestTime},
+		{"tunnel_headers.signature", headers.Signature},
+		{"tunnel_headers.key_id", headers.KeyID},
+	} {
+		if !httpguts.ValidHeaderFieldName(h.name) {
+			fail(h.field, "%q is not a valid header name", h.name)
+			continue
+		}
+
+		key := http.CanonicalHeaderKey(h.name)
+		if other, ok := seenHeaders[key]; ok {
+			fail(h.field, "%q is already used by %s", h.name, other)
+			continue
+		}
+		seenHeaders[key] = h.field
+	}
+
+	if c.MaxH2Streams < 0 {
+		fail("max_h2_streams", "must not be negative")
+	}
+
+	if c.H2IdleTimeout < 0 {
+		fail("h2_idle_timeout", "must not be negative")
+	}
+
+	if c.H2MaxUploadBufferPerConnection < 0 {
+		fail("h2_max_upload_buffer_per_connection", "must not be negative")
+	}
+
+	if c.H2MaxUploadBufferPerStream < 0 {
+		fail("h2_max_upload_buffer_per_stream", "must not be negative")
+	}
+
+	if c.h2MaxUploadBufferPerStream() > c.h2MaxUploadBufferPerConnection() {
+		fail("h2_max_upload_buffer_per_stream", "must not exceed h2_max_upload_buffer_per_connection")
+	}
+
+	return errors.Join(errs...)
+}
+
+// LoadConfigFile 读取配置文件，返回填充了默认值并通过 Validate 的 ListenConfig。
+// 格式按扩展名判断（.json、.yaml / .yml、.toml）；文件中的相对路径相对于配置文件所在目录。
+func LoadConfigFile(path string) (*ListenConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+
+	listenConfig, err := ParseConfig(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	listenConfig.ConfigFile = path
+	listenConfig.resolvePaths(filepath.Dir(path))
+
+	if err := listenConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return listenConfig, nil
+}
+
+// ParseConfig 按 format（json、yaml / yml、toml）解析配置内容并填充默认值。
+// 未知字段会报错，version 必须存在且等于 ConfigVersion。ParseConfig 不调用 Validate。
+func ParseConfig(data []byte, format string) (*ListenConfig, error) {
+	listenConfig := NewListenConfig()
+	listenConfig.Version = 0
+
+	var err error
+
+	switch strings.ToLower(format) {
+	case "json":
+		err = decodeJSONConfig(data, listenConfig)
+	case "yaml", "yml":
+		err = decodeYAMLConfig(data, listenConfig)
+	case "toml":
+		err = decodeTOMLConfig(data, listenConfig)
+	default:
+		return nil, fmt.Errorf("unknown config format %q (supported: json, yaml, toml)", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch listenConfig.Version {
+	case ConfigVersion:
+	case 0:
+		return nil, fmt.Errorf("version: is required, expected %d", ConfigVersion)
+	default:
+		return nil, fmt.Errorf("version: unsupported version %d, expected %d", listenConfig.Version, ConfigVersion)
+	}
+
+	return listenConfig, nil
+}
+
+func decodeJSONConfig(data []byte, listenConfig *ListenConfig) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(listenConfig); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, col := lineColumn(data, syntaxErr.Offset)
+			return fmt.Errorf("line %d, column %d: %w", line, col, err)
+		}
+
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			line, col := lineColumn(data, typeErr.Offset)
+			return fmt.Errorf("line %d, column %d: %s: expected %s, got %s",
+				line, col, typeErr.Field, typeErr.Type.String(), typeErr.Value)
+		}
+
+		return err
+	}
+
+	if dec.More() {
+		return errors.New("unexpected data after the top-level object")
+	}
+
+	return nil
+}
+
+func decodeYAMLConfig(data []byte, listenConfig *ListenConfig) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(listenConfig); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+func decodeTOMLConfig(data []byte, listenConfig *ListenConfig) error {
+	md, err := toml.NewDecoder(bytes.NewReader(data)).Decode(listenConfig)
+	if err != nil {
+		return err
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return fmt.Errorf("unknown fields: %s", strings.Join(keys, ", "))
+	}
+
+	return nil
+}
+
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+
+	return line, col
+}
+
+// resolvePaths 把配置中的相对文件路径改为相对于 dir。"inline:" 开头的公钥是内容而不是路径，保持不变。
+func (c *ListenConfig) resolvePaths(dir string) {
+	resolve := func(p *string) {
+		if *p != "" && !filepath.IsAbs(*p) && !strings.HasPrefix(*p, "inline:") {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+
+	resolve(&c.ServerCertFile)
+	resolve(&c.ServerKeyFile)
+	resolve(&c.PublicKeyFile)
+
+	resolve(&c.NonceStoreFile)
+	resolve(&c.ClientCAFile)
+	resolve(&c.ClientCRLFile)
+	resolve(&c.ClientCertFile)
+	resolve(&c.ClientKeyFile)
+	resolve(&c.AuthorizedKeysFile)
+	resolve(&c.AuthKeyFile)
+
+	resolve(&c.FallbackDir)
+
+	for i := range c.RouteRuleFiles {
+		resolve(&c.RouteRuleFiles[i])
+	}
+
+	for i := range c.Servers {
+		resolve(&c.Servers[i].PublicKeyFile)
+		resolve(&c.Servers[i].AuthKeyFile)
+	}
+}
@@ -0,0 +1,220 @@
+package csocks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// 相对路径相对于配置文件所在目录，绝对路径与 "inline:" 公钥保持不变。
+func TestLoadConfigFilePaths(t *testing.T) {
+	const inline = "inline:-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEA\n-----END PUBLIC KEY-----"
+
+	abs := filepath.Join(t.TempDir(), "abs.key")
+
+	tests := []struct {
+		name  string
+		value string
+		want  func(dir string) string
+	}{
+		{name: "relative", value: "keys/p.key", want: func(dir string) string { return filepath.Join(dir, "keys", "p.key") }},
+		{name: "absolute", value: abs, want: func(string) string { return abs }},
+		{name: "inline", value: inline, want: func(string) string { return inline }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, "client.json", `{
+				"version": 1,
+				"listen_port": "127.0.0.1:1080",
+				"secret": "s",
+				"servers": [
+					{"address": "a.example.com:443", "public_key_file": `+jsonString(tt.value)+`},
+					{"address": "b.example.com:443", "public_key_file": `+jsonString(tt.value)+`}
+				]
+			}`)
+
+			listenConfig, err := LoadConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.want(filepath.Dir(path))
+			for i, server := range listenConfig.Servers {
+				if server.PublicKeyFile != want {
+					t.Fatalf("servers[%d].public_key_file = %q, want %q", i, server.PublicKeyFile, want)
+				}
+			}
+
+			path = writeTestConfig(t, "client.yaml", "version: 1\nlisten_port: \"1080\"\nserver_address: example.com:443\nsecret: s\npublic_key_file: "+jsonString(tt.value)+"\n")
+
+			listenConfig, err = LoadConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := tt.want(filepath.Dir(path)); listenConfig.PublicKeyFile != want {
+				t.Fatalf("public_key_file = %q, want %q", listenConfig.PublicKeyFile, want)
+			}
+		})
+	}
+}
+
+func jsonString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// 三种格式的同一份配置得到相同的结果，省略的字段使用默认值。
+func TestLoadConfigFileFormats(t *testing.T) {
+	files := map[string]string{
+		"client.json": `{"version": 1, "listen_port": "127.0.0.1:1080", "server_address": "example.com:443",
+			"public_key_file": "p.key", "secret": "s", "timeout": "5s", "tunnel_path": "/t"}`,
+		"client.yaml": "version: 1\nlisten_port: 127.0.0.1:1080\nserver_address: example.com:443\n" +
+			"public_key_file: p.key\nsecret: s\ntimeout: 5s\ntunnel_path: /t\n",
+		"client.toml": "version = 1\nlisten_port = \"127.0.0.1:1080\"\nserver_address = \"example.com:443\"\n" +
+			"public_key_file = \"p.key\"\nsecret = \"s\"\ntimeout = \"5s\"\ntunnel_path = \"/t\"\n",
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, name, content)
+
+			c, err := LoadConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.ListenPort != "127.0.0.1:1080" || c.ServerAddress != "example.com:443" || c.Secret != "s" {
+				t.Fatalf("config = %+v", c)
+			}
+
+			if c.timeout() != 5*time.Second || c.tunnelPath() != "/t" {
+				t.Fatalf("timeout = %v, tunnel_path = %q", c.timeout(), c.tunnelPath())
+			}
+
+			if c.PublicKeyFile != filepath.Join(filepath.Dir(path), "p.key") || c.ConfigFile != path {
+				t.Fatalf("public_key_file = %q, config_file = %q", c.PublicKeyFile, c.ConfigFile)
+			}
+
+			if c.IdleTimeout != NewListenConfig().IdleTimeout {
+				t.Fatalf("idle_timeout = %v, want the default", c.IdleTimeout)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    string
+	}{
+		{name: "unknown format", format: "ini", content: "", want: "unknown config format"},
+		{name: "missing version", format: "json", content: `{"listen_port": "1080"}`, want: "version: is required"},
+		{name: "unsupported version", format: "yaml", content: "version: 2\n", want: "unsupported version 2"},
+		{name: "unknown json field", format: "json", content: `{"version": 1, "listen_prot": "1080"}`, want: "listen_prot"},
+		{name: "unknown yaml field", format: "yaml", content: "version: 1\nlisten_prot: \"1080\"\n", want: "listen_prot"},
+		{name: "unknown toml field", format: "toml", content: "version = 1\nlisten_prot = \"1080\"\n", want: "unknown fields: listen_prot"},
+		{name: "bad duration", format: "yaml", content: "version: 1\ntimeout: soon\n", want: "invalid duration"},
+		{name: "bad json", format: "json", content: `{"version": 1,`, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tt.content), tt.format)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("ParseConfig error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	client := func(f func(c *ListenConfig)) *ListenConfig {
+		c := NewListenConfig()
+		c.ServerAddress = "example.com:443"
+		c.PublicKeyFile = "p.key"
+		c.Secret = "s"
+		if f != nil {
+			f(c)
+		}
+		return c
+	}
+
+	server := func(f func(c *ListenConfig)) *ListenConfig {
+		c := NewListenConfig()
+		c.ServerCertFile = "cert.pem"
+		c.ServerKeyFile = "key.pem"
+		c.Secret = "s"
+		if f != nil {
+			f(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		cfg  *ListenConfig
+		want string
+	}{
+		{name: "valid client", cfg: client(nil)},
+		{name: "valid server", cfg: server(nil)},
+		{name: "no mode", cfg: NewListenConfig(), want: "server_address: either"},
+		{name: "missing listen_port", cfg: client(func(c *ListenConfig) { c.ListenPort = " " }), want: "listen_port: is required"},
+		{name: "both modes", cfg: client(func(c *ListenConfig) { c.ServerCertFile = "cert.pem" }), want: "server_cert_file: cannot be combined"},
+		{name: "client without public key", cfg: client(func(c *ListenConfig) { c.PublicKeyFile = "" }), want: "public_key_file: is required"},
+		{name: "client without secret", cfg: client(func(c *ListenConfig) { c.Secret = "" }), want: "server_address.secret: is required"},
+		{name: "bad strategy", cfg: client(func(c *ListenConfig) { c.ServerStrategy = "random" }), want: "server_strategy"},
+		{name: "bad protocol", cfg: client(func(c *ListenConfig) { c.ForwardProtocol = "quic" }), want: "forward_protocol"},
+		{
+			name: "server entry without address",
+			cfg:  client(func(c *ListenConfig) { c.Servers = []UpstreamServer{{PublicKeyFile: "p.key"}} }),
+			want: "servers[0].address: is required",
+		},
+		{name: "server without key", cfg: server(func(c *ListenConfig) { c.ServerKeyFile = "" }), want: "server_key_file: is required"},
+		{name: "server without secret", cfg: server(func(c *ListenConfig) { c.Secret = "" }), want: "secret: is required"},
+		{name: "legacy secret", cfg: server(func(c *ListenConfig) { c.Secret = legacyDefaultSecret }), want: "old default"},
+		{name: "admin without token", cfg: server(func(c *ListenConfig) { c.AdminListen = "127.0.0.1:9000" }), want: "admin_token: is required"},
+		{name: "negative timeout", cfg: server(func(c *ListenConfig) { c.Timeout = Duration(-time.Second) }), want: "timeout: must not be negative"},
+		{name: "relative tunnel path", cfg: server(func(c *ListenConfig) { c.TunnelPath = "t" }), want: "tunnel_path: must start with"},
+		{name: "bad upgrade token", cfg: server(func(c *ListenConfig) { c.UpgradeToken = "a b" }), want: "upgrade_token"},
+		{name: "unsupported version", cfg: server(func(c *ListenConfig) { c.Version = 2 }), want: "version: unsupported"},
+		{
+			name: "several errors",
+			cfg:  server(func(c *ListenConfig) { c.ServerKeyFile = ""; c.TunnelPath = "t" }),
+			want: "server_key_file: is required in server mode\ntunnel_path: must start with",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Validate error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
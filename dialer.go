@@ -0,0 +1,324 @@
+package csocks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dialer 通过隧道建立到目标的 TCP 连接，不需要本地监听端口。
+// 连接复用 forward 端的服务端池：协议探测、公钥固定、h2 stream 上限与故障切换都与 Client 相同。
+type Dialer struct {
+	ctx  context.Context
+	pool func() *upstreamPool
+
+	closeOnce sync.Once
+	close     func()
+}
+
+// NewDialer 按客户端模式的配置创建 Dialer，校验配置、检查服务端是否可用并开始健康检查。
+// ListenPort、LocalUsers 与分流规则不会使用。quiet 与 sink 同 Server / Client 的 Quiet 与 LogSink，
+// sink 可以为 nil。不再使用时调用 Close。
+func NewDialer(listenConfig *ListenConfig, quiet bool, sink LogSink) (*Dialer, error) {
+	if !listenConfig.isForward() {
+		return nil, errors.New("server_address: is required for Dialer")
+	}
+
+	if err := listenConfig.validate(false); err != nil {
+		return nil, err
+	}
+
+	inst := newInstance(quiet, sink)
+
+	pool, err := newUpstreamPool(listenConfig, inst)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := pool.bootstrap(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	poolCtx, poolCancel := context.WithCancel(ctx)
+	pool.cancel = poolCancel
+
+	go pool.healthCheck(poolCtx)
+
+	return &Dialer{
+		ctx:  ctx,
+		pool: func() *upstreamPool { return pool },
+		close: func() {
+			cancel()
+			pool.stop()
+		},
+	}, nil
+}
+
+// Dialer 返回使用这个 Client 服务端池的 Dialer，热加载后自动使用新的服务端池。
+// Client 未启动时返回 nil；Client 停止后 Dialer 不再可用。
+func (c *Client) Dialer() *Dialer {
+	c.node.mu.Lock()
+	svc := c.node.svc
+	c.node.mu.Unlock()
+
+	server, ok := svc.(*forwardServer)
+	if !ok {
+		return nil
+	}
+
+	return &Dialer{
+		ctx:  server.ctx,
+		pool: server.pool.Load,
+	}
+}
+
+// DialContext 通过隧道连接 address（host:port），network 只支持 tcp、tcp4、tcp6。
+// ctx 只约束建立连接的过程，连接建立后不受 ctx 影响。
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	conn, err := d.dial(ctx, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: dialerAddr(address), Err: err}
+	}
+
+	return conn, nil
+}
+
+// Dial 同 DialContext，使用 context.Background()。
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// Transport 返回所有请求都经过隧道的 http.Transport（实现 http.RoundTripper），
+// 可以直接用作 http.Client 的 Transport。
+func (d *Dialer) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:           d.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Close 停止 NewDialer 创建的服务端池并关闭已建立的连接；对 Client.Dialer 返回的 Dialer 无效果。
+func (d *Dialer) Close() error {
+	if d.close != nil {
+		d.closeOnce.Do(d.close)
+	}
+	return nil
+}
+
+func (d *Dialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, errors.New("dialer closed")
+	}
+
+	req, err := appendSocks5HostPort([]byte{0x05, socks5CmdConnect, 0x00}, address)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := d.pool()
+
+	local, remote := newDuplexPipe()
+
+	go handleForwardTunnel(d.ctx, remote, pool, address)
+
+	deadline := time.Now().Add(2 * pool.listenConfig.timeout())
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = local.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = local.SetDeadline(time.Now())
+	})
+
+	err = socks5Connect(local, req)
+
+	if !stop() || ctx.Err() != nil {
+		_ = local.Close()
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		_ = local.Close()
+		return nil, err
+	}
+
+	_ = local.SetDeadline(time.Time{})
+
+	return &dialerConn{duplexPipe: local, remote: dialerAddr(address)}, nil
+}
+
+// socks5Connect 在隧道 stream 上完成 SOCKS5 协商并发送 CONNECT 请求。
+func socks5Connect(conn net.Conn, req []byte) error {
+	if _, err := conn.Write(append(append([]byte{}, socks5NoAuthGreeting...), req...)); err != nil {
+		return err
+	}
+
+	var resp [6]byte
+
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, io.ErrClosedPipe) {
+			return errors.New("tunnel unavailable")
+		}
+		return err
+	}
+
+	if resp[0] != 0x05 || resp[1] != 0x00 {
+		return errors.New("socks5 auth rejected by server")
+	}
+
+	if resp[3] != 0x00 {
+		return fmt.Errorf("connect rejected by server: %s", socks5ReplyText(resp[3]))
+	}
+
+	_, err := readSocks5Address(conn, resp[5])
+	return err
+}
+
+// appendSocks5HostPort 把 host:port 编码为 SOCKS5 地址，非 IP 的 host 按域名发送，由服务端解析。
+func appendSocks5HostPort(b []byte, address string) ([]byte, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return appendSocks5Addr(b, ip, int(port)), nil
+	}
+
+	if host == "" || len(host) > 255 {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+
+	b = append(b, 0x03, byte(len(host)))
+	b = append(b, host...)
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func socks5ReplyText(rep byte) string {
+	switch rep {
+	case 0x01:
+		return "general failure"
+	case 0x02:
+		return "not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("reply 0x%02x", rep)
+	}
+}
+
+// dialerAddr 是拨号时的目标地址，未经本地解析。
+type dialerAddr string
+
+func (a dialerAddr) Network() string {
+	return "tcp"
+}
+
+func (a dialerAddr) String() string {
+	return string(a)
+}
+
+// dialerConn 的 RemoteAddr 返回拨号时的目标地址。
+type dialerConn struct {
+	*duplexPipe
+	remote net.Addr
+}
+
+func (c *dialerConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// duplexPipe 是由两个 net.Pipe 组成的内存连接，两个方向分别关闭：CloseWrite 之后对端读到 io.EOF，
+// 自己仍然可以继续读。单个 net.Pipe 不支持半关闭，会让先关闭写方向的调用方（HTTP CONNECT 客户端、
+// 成对的 io.Copy）提前读到 EOF。
+type duplexPipe struct {
+	r, w net.Conn
+}
+
+func newDuplexPipe() (*duplexPipe, *duplexPipe) {
+	r1, w1 := net.Pipe()
+	r2, w2 := net.Pipe()
+
+	return &duplexPipe{r: r1, w: w2}, &duplexPipe{r: r2, w: w1}
+}
+
+func (p *duplexPipe) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func (p *duplexPipe) Write(b []byte) (int, error) {
+	return p.w.Write(b)
+}
+
+func (p *duplexPipe) CloseWrite() error {
+	return p.w.Close()
+}
+
+func (p *duplexPipe) Close() error {
+	_ = p.w.Close()
+	return p.r.Close()
+}
+
+func (p *duplexPipe) LocalAddr() net.Addr {
+	return p.r.LocalAddr()
+}
+
+func (p *duplexPipe) RemoteAddr() net.Addr {
+	return p.r.RemoteAddr()
+}
+
+// SetDeadline 在一个方向已经关闭时仍然设置另一个方向：net.Pipe 的一端关闭后，两端设置截止时间都会失败。
+func (p *duplexPipe) SetDeadline(t time.Time) error {
+	errR := p.r.SetReadDeadline(t)
+	errW := p.w.SetWriteDeadline(t)
+
+	if errR != nil && errW != nil {
+		return errR
+	}
+	return nil
+}
+
+func (p *duplexPipe) SetReadDeadline(t time.Time) error {
+	return p.r.SetReadDeadline(t)
+}
+
+func (p *duplexPipe) SetWriteDeadline(t time.Time) error {
+	return p.w.SetWriteDeadline(t)
+}
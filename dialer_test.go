@@ -0,0 +1,80 @@
+package csocks
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDialerValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ListenConfig
+		want string
+	}{
+		{
+			name: "not client mode",
+			cfg:  ListenConfig{},
+			want: "server_address",
+		},
+		{
+			name: "missing public key",
+			cfg:  ListenConfig{ServerAddress: "127.0.0.1:1", Secret: "s"},
+			want: "public_key_file",
+		},
+		{
+			name: "missing secret",
+			cfg:  ListenConfig{ServerAddress: "127.0.0.1:1", PublicKeyFile: "p.key"},
+			want: "server_address.secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDialer(&tt.cfg, true, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("NewDialer error = %v, want it to mention %q", err, tt.want)
+			}
+			if strings.Contains(err.Error(), "listen_port") {
+				t.Fatalf("NewDialer must not require listen_port: %v", err)
+			}
+		})
+	}
+}
+
+// 一端 CloseWrite 之后，对端读到 io.EOF，但反方向仍然可以继续传输。
+func TestDuplexPipeCloseWrite(t *testing.T) {
+	a, b := newDuplexPipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		_, _ = a.Write([]byte("request"))
+		_ = a.CloseWrite()
+	}()
+
+	got, err := io.ReadAll(b)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+
+	// 读方向关闭后，写方向仍然可以设置截止时间（mutualCopyIO 每次读写都会重设）。
+	if err := b.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("SetDeadline after peer CloseWrite: %v", err)
+	}
+
+	go func() {
+		_, _ = b.Write([]byte("response"))
+		_ = b.Close()
+	}()
+
+	got, err = io.ReadAll(a)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("ReadAll after CloseWrite = %q, %v", got, err)
+	}
+
+	if _, err := a.Write([]byte("x")); err == nil {
+		t.Fatal("Write after CloseWrite succeeded")
+	}
+}
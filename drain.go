@@ -0,0 +1,88 @@
+package csocks
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const drainProgressInterval = 5 * time.Second
+
+// connTracker 记录正在处理的连接，退出时用于 drain。
+type connTracker struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+}
+
+func (t *connTracker) add() {
+	t.wg.Add(1)
+	t.active.Add(1)
+}
+
+func (t *connTracker) done() {
+	t.active.Add(-1)
+	t.wg.Done()
+}
+
+// drain 等待所有连接结束，force 结束时调用 closeAll 强制关闭剩余连接，并等待它们退出。
+func (t *connTracker) drain(logger *customLogger, force context.Context, closeAll func()) {
+	finished := make(chan struct{})
+
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	if t.active.Load() == 0 {
+		<-finished
+		return
+	}
+
+	select {
+	case <-finished:
+		return
+	case <-force.Done():
+		closeAll()
+		<-finished
+		return
+	default:
+	}
+
+	logger.Printf("[*] draining [%d] connection(s)\n", t.active.Load())
+
+	ticker := time.NewTicker(drainProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-finished:
+			logger.Printf("[*] drain complete\n")
+			return
+
+		case <-ticker.C:
+			logger.Printf("[*] draining, [%d] connection(s) left\n", t.active.Load())
+
+		case <-force.Done():
+			logger.Printf("[*] drain deadline reached, closing [%d] connection(s)\n", t.active.Load())
+			closeAll()
+			<-finished
+			return
+		}
+	}
+}
+
+// drainContext 返回在 ctx 结束 timeout 之后结束的 ctx，作为 drain 的截止时间；timeout 为 0 时立即结束。
+func drainContext(ctx context.Context, timeout time.Duration) context.Context {
+	if timeout <= 0 {
+		return ctx
+	}
+
+	force, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	context.AfterFunc(ctx, func() {
+		time.AfterFunc(timeout, cancel)
+	})
+
+	return force
+}
@@ -0,0 +1,222 @@
+package csocks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// newFallbackHandler 构建处理非隧道请求的 handler：FallbackURL 使用反向代理，FallbackDir / FallbackFS 使用静态站点；
+// 都未配置时返回 nil（使用内置页面）。
+func newFallbackHandler(listenConfig *ListenConfig, inst *instance) (http.Handler, error) {
+	switch {
+	case listenConfig.FallbackURL != "":
+		return newFallbackProxy(listenConfig, inst)
+
+	case listenConfig.FallbackDir != "" || listenConfig.FallbackFS != nil:
+		site, err := newStaticSite(listenConfig.FallbackDir, listenConfig.FallbackFS)
+		if err != nil {
+			return nil, fmt.Errorf("fallback_dir: %w", err)
+		}
+		return site, nil
+	}
+
+	return nil, nil
+}
+
+// newFallbackProxy 按 FallbackURL 构建反向代理。
+func newFallbackProxy(listenConfig *ListenConfig, inst *instance) (http.Handler, error) {
+	target, transport, err := parseFallbackURL(listenConfig.FallbackURL, listenConfig.timeout())
+	if err != nil {
+		return nil, fmt.Errorf("fallback_url: %w", err)
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+
+			// 保留原始 Host，后端可以按域名提供站点。
+			r.Out.Host = r.In.Host
+		},
+		Transport: transport,
+		ErrorLog:  log.New(io.Discard, "", 0),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			inst.logger.PrintfX("[x] fallback request [%s] failed: [%s]\n", r.URL.Path, err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// parseFallbackURL 支持 http(s)://host[:port][/path] 与 unix:/path/to/app.sock。
+func parseFallbackURL(raw string, timeout time.Duration) (*url.URL, *http.Transport, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return nil, nil, fmt.Errorf("missing host in %q", raw)
+		}
+		return u, transport, nil
+
+	case "unix":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, nil, fmt.Errorf("missing socket path in %q", raw)
+		}
+
+		dialer := &net.Dialer{Timeout: timeout}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+
+		return &url.URL{Scheme: "http", Host: "localhost"}, transport, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported scheme %q, expected http, https or unix", u.Scheme)
+	}
+}
+
+// serveFallbackHTTP 处理不是隧道的 h2 请求。
+func serveFallbackHTTP(runtime *proxyRuntime, w http.ResponseWriter, r *http.Request) {
+	if runtime.fallback != nil {
+		runtime.fallback.ServeHTTP(w, r)
+		return
+	}
+	writeFallbackHTTPResponse(w, r)
+}
+
+// serveHTTP1Fallback 把 conn 上的 HTTP/1.1 请求交给回落 handler，支持 keep-alive 与 WebSocket 升级，
+// 直到连接关闭。ctx 结束时关闭连接；开始 drain 时关闭 keep-alive，当前请求完成后断开。
+func serveHTTP1Fallback(ctx context.Context, conn net.Conn, runtime *proxyRuntime, draining <-chan struct{}) {
+	ln := newSingleConnListener(conn)
+
+	var handlers sync.WaitGroup
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+			runtime.fallback.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: runtime.listenConfig.timeout(),
+		IdleTimeout:       runtime.listenConfig.idleTimeout(),
+		ErrorLog:          log.New(io.Discard, "", 0),
+
+		// 连接关闭或被 WebSocket 升级接管后不会再有请求，关闭 listener 使 Serve 返回。
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				_ = ln.Close()
+			}
+		},
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-draining:
+			server.SetKeepAlivesEnabled(false)
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	_ = server.Serve(ln)
+
+	// 升级后的连接在 handler 中继续转发。
+	handlers.Wait()
+}
+
+// replayConn 先读 reader，用于把已经读过的数据重新交给 http.Server。
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// recordingReader 在 stop 之前记录读到的原始数据。
+type recordingReader struct {
+	r       io.Reader
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if !r.stopped {
+		r.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// stop 停止记录，返回已记录的数据。
+func (r *recordingReader) stop() []byte {
+	r.stopped = true
+	return r.buf.Bytes()
+}
+
+// singleConnListener 只返回一个连接，Close 之前后续的 Accept 都会阻塞。
+type singleConnListener struct {
+	conns     chan net.Conn
+	addr      net.Addr
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		conns:  make(chan net.Conn, 1),
+		addr:   conn.LocalAddr(),
+		closed: make(chan struct{}),
+	}
+	l.conns <- conn
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
+}
@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -24,115 +25,207 @@ import (
 
 type forwardProtocol byte
 
+var errTooManyH2Streams = errors.New("too many active h2 streams")
+
 const (
 	forwardProtocolUnknown forwardProtocol = iota
 	forwardProtocolH2
 	forwardProtocolHTTP1
+	forwardProtocolWebSocket
+	forwardProtocolH3
 )
 
+// ForwardProtocol 的可选值。
+const (
+	ForwardProtocolAuto      = "auto"
+	ForwardProtocolH3        = "h3"
+	ForwardProtocolH2        = "h2"
+	ForwardProtocolHTTP1     = "http1"
+	ForwardProtocolWebSocket = "websocket"
+)
+
+// parseForwardProtocol 返回按顺序探测的协议；auto（默认）依次尝试 HTTP/3、h2、HTTP/1.1 Upgrade 与 WebSocket。
+func parseForwardProtocol(s string) ([]forwardProtocol, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", ForwardProtocolAuto:
+		return []forwardProtocol{forwardProtocolH3, forwardProtocolH2, forwardProtocolHTTP1, forwardProtocolWebSocket}, nil
+	case ForwardProtocolH3:
+		return []forwardProtocol{forwardProtocolH3}, nil
+	case ForwardProtocolH2:
+		return []forwardProtocol{forwardProtocolH2}, nil
+	case ForwardProtocolHTTP1:
+		return []forwardProtocol{forwardProtocolHTTP1}, nil
+	case ForwardProtocolWebSocket:
+		return []forwardProtocol{forwardProtocolWebSocket}, nil
+	default:
+		return nil, fmt.Errorf("unknown forward protocol %q", s)
+	}
+}
+
 type forwardRuntime struct {
+	// listenConfig 是这个服务端自己的配置副本（地址、公钥、密钥）。
+	listenConfig *ListenConfig
+	inst         *instance
+
 	mu       sync.Mutex
 	protocol forwardProtocol
 
 	h2Client *http.Client
+	h3Client *http.Client
 	h1TLSCfg *tls.Config
 
 	streamSem chan struct{}
+
+	activeStreams atomic.Int64
+	totalStreams  atomic.Uint64
+	failedStreams atomic.Uint64
+
+	failures  atomic.Uint32
+	downUntil atomic.Int64
+	latency   atomic.Int64
 }
 
 type uploadCountingWriter struct {
-	w io.Writer
+	w       io.Writer
+	stats   *tunnelStats
+	metrics *streamMetrics
 }
 
 func (w uploadCountingWriter) Write(p []byte) (int, error) {
 	n, err := w.w.Write(p)
 	if n > 0 {
-		recordBytesUp(uint64(n))
+		w.stats.addBytesUp(uint64(n))
+		w.metrics.addBytesUp(n)
 	}
 	return n, err
 }
 
 type downloadCountingWriter struct {
-	w io.Writer
+	w       io.Writer
+	stats   *tunnelStats
+	metrics *streamMetrics
 }
 
 func (w downloadCountingWriter) Write(p []byte) (int, error) {
 	n, err := w.w.Write(p)
 	if n > 0 {
-		recordBytesDown(uint64(n))
+		w.stats.addBytesDown(uint64(n))
+		w.metrics.addBytesDown(n)
 	}
 	return n, err
 }
 
-func forward(ctx context.Context, listenConfig *ListenConfig) error {
-	knownPubKey, err := loadKnownPublicKey(listenConfig.PublicKeyFile)
-	if err != nil {
-		return err
-	}
+// forwardServer 持有 forward 端当前生效的配置、服务端池与分流表，热加载时整体替换。
+// 已建立的连接继续使用旧的服务端池，新连接使用新的。
+type forwardServer struct {
+	ctx  context.Context
+	inst *instance
 
-	sessionCache := tls.NewLRUClientSessionCache(128)
+	listenConfig atomic.Pointer[ListenConfig]
+	pool         atomic.Pointer[upstreamPool]
+	router       *forwardRouter
 
-	h2TLSCfg := newForwardTLSClientConfig(
-		knownPubKey,
-		sessionCache,
-		listenConfig.ServerAddress,
-		[]string{protoH2, protoHTTP1},
-	)
+	conns connTracker
+}
 
-	h1TLSCfg := newForwardTLSClientConfig(
-		knownPubKey,
-		sessionCache,
-		listenConfig.ServerAddress,
-		[]string{protoHTTP1},
-	)
+// newForwardServer 构建服务端池与分流表，并在启动前检查服务端是否可用。
+// 服务端池的健康检查在 ctx 结束时停止。
+func newForwardServer(ctx context.Context, listenConfig *ListenConfig, inst *instance) (*forwardServer, error) {
+	router, err := newForwardRouter(listenConfig, inst)
+	if err != nil {
+		return nil, err
+	}
 
-	h2Client, err := newH2Client(h2TLSCfg)
+	pool, err := newUpstreamPool(listenConfig, inst)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	runtime := &forwardRuntime{
-		protocol:  forwardProtocolUnknown,
-		h2Client:  h2Client,
-		h1TLSCfg:  h1TLSCfg,
-		streamSem: make(chan struct{}, maxClientH2Streams),
+	if err := pool.bootstrap(ctx); err != nil {
+		return nil, err
 	}
 
-	protocol, err := bootstrapStartupProtocol(ctx, listenConfig, runtime)
-	if err != nil {
-		if ctx.Err() != nil {
-			return nil
-		}
-		return err
+	server := &forwardServer{
+		ctx:    ctx,
+		inst:   inst,
+		router: router,
 	}
 
-	runtime.protocol = protocol
+	server.listenConfig.Store(listenConfig)
+	server.startPool(pool)
+
+	return server, nil
+}
+
+func (s *forwardServer) env() *instance {
+	return s.inst
+}
 
-	// bootstrap 只是启动前检查；检查成功后关闭 idle，后续真正使用代理时再连接服务器。
-	closeH2IdleConnections(h2Client)
+func (s *forwardServer) config() *ListenConfig {
+	return s.listenConfig.Load()
+}
 
-	ln, err := listen(listenConfig.ListenPort)
+// reload 先构建新的服务端池与分流表，全部成功后再替换，失败时保留旧状态。
+func (s *forwardServer) reload(listenConfig *ListenConfig) error {
+	pool, err := newUpstreamPool(listenConfig, s.inst)
 	if err != nil {
 		return err
 	}
 
+	if err := s.router.reload(listenConfig); err != nil {
+		return err
+	}
+
+	s.listenConfig.Store(listenConfig)
+	s.startPool(pool)
+
+	return nil
+}
+
+func (s *forwardServer) startPool(pool *upstreamPool) {
+	poolCtx, cancel := context.WithCancel(s.ctx)
+	pool.cancel = cancel
+
+	go pool.healthCheck(poolCtx)
+
+	old := s.pool.Swap(pool)
+	s.inst.stats.upstream.Store(pool)
+
+	if old != nil {
+		old.stop()
+	}
+}
+
+// serve 接受本地连接直到 ctx 结束，然后等待已有连接处理结束，force 结束时强制关闭剩余连接。
+func (s *forwardServer) serve(ctx context.Context, ln net.Listener, force context.Context) error {
+	logger := s.inst.logger
+
+	// 连接使用独立的 ctx，ctx 结束时不会立即关闭，drain 超时后由 closeAll 关闭。
+	connCtx, closeAll := context.WithCancel(context.WithoutCancel(ctx))
+
+	defer func() {
+		s.conns.drain(logger, force, closeAll)
+		closeAll()
+
+		current := s.pool.Load()
+		current.stop()
+		s.inst.stats.upstream.CompareAndSwap(current, nil)
+	}()
+
 	go func() {
 		<-ctx.Done()
 		_ = ln.Close()
-		closeH2IdleConnections(h2Client)
 	}()
 
-	switch protocol {
-	case forwardProtocolH2:
-		logger.Printf("[*] selected forward protocol: HTTP/2 streaming tunnel\n")
-	case forwardProtocolHTTP1:
-		logger.Printf("[*] selected forward protocol: HTTP/1.1 upgrade fallback\n")
-	}
+	go s.router.watch(ctx)
+
+	pool := s.pool.Load()
 
-	logger.Printf("[*] listen on: [%s %s] server on: [%s]\n",
+	logger.Printf("[*] listen on: [%s %s] server on: [%s] strategy: [%s]\n",
 		ln.Addr().Network(),
 		ln.Addr().String(),
-		listenConfig.ServerAddress,
+		pool.addresses(),
+		pool.strategy,
 	)
 
 	for {
@@ -151,66 +244,271 @@ func forward(ctx context.Context, listenConfig *ListenConfig) error {
 			conn0.LocalAddr().String(),
 		)
 
-		go handleForwardLazy(ctx, listenConfig, conn0, runtime)
+		s.conns.add()
+
+		go func() {
+			defer s.conns.done()
+			handleForwardLazy(connCtx, s.config(), conn0, s.pool.Load(), s.router)
+		}()
 	}
 }
 
-func bootstrapStartupProtocol(
+func handleForwardLazy(
 	ctx context.Context,
 	listenConfig *ListenConfig,
-	runtime *forwardRuntime,
-) (forwardProtocol, error) {
-	protocol, err := detectForwardProtocol(
-		ctx,
-		listenConfig,
-		runtime.h2Client,
-		runtime.h1TLSCfg,
-	)
+	conn0 net.Conn,
+	pool *upstreamPool,
+	router *forwardRouter,
+) {
+	logger := pool.inst.logger
+
+	reader := bufio.NewReaderSize(conn0, localReaderSize)
+
+	_ = conn0.SetReadDeadline(time.Now().Add(listenConfig.timeout()))
+	first, err := reader.Peek(1)
+	_ = conn0.SetReadDeadline(time.Time{})
+
 	if err != nil {
-		if ctx.Err() != nil {
-			return forwardProtocolUnknown, ctx.Err()
-		}
-		return forwardProtocolUnknown, fmt.Errorf("server bootstrap check failed: %w", err)
+		_ = conn0.Close()
+		return
 	}
 
-	return protocol, nil
+	if first[0] != 0x05 {
+		handleForwardLocalHTTP(ctx, listenConfig, conn0, reader, pool, router)
+		return
+	}
+
+	_ = conn0.SetReadDeadline(time.Now().Add(listenConfig.timeout()))
+	req, err := readLocalSocks5Request(conn0, reader, listenConfig.LocalUsers)
+	_ = conn0.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		logger.PrintfX("[x] local socks5 negotiation failed from [%s]: [%s]\n",
+			conn0.RemoteAddr().String(),
+			err.Error(),
+		)
+		_ = conn0.Close()
+		return
+	}
+
+	switch req.Command {
+	case socks5CmdConnect:
+		switch router.decide(ctx, req.Address) {
+		case routeActionDirect:
+			logger.PrintfX("[*] route [direct] target=[%s]\n", req.Address)
+			handleDirectSocks5(ctx, router.directPolicy(), conn0, req.Address)
+			return
+
+		case routeActionBlock:
+			logger.PrintfX("[*] route [block] target=[%s]\n", req.Address)
+			writeSocks5Reply(conn0, 0x02)
+			_ = conn0.Close()
+			return
+		}
+
+		handleForwardTunnel(ctx, newSocks5ReplayConn(conn0, reader, req), pool, req.Address)
+
+	case socks5CmdBind:
+		switch router.decide(ctx, req.Address) {
+		case routeActionDirect:
+			logger.PrintfX("[*] route [direct] bind=[%s]\n", req.Address)
+			handleDirectSocks5Bind(ctx, router.directPolicy(), conn0, req.Address)
+			return
+
+		case routeActionBlock:
+			logger.PrintfX("[*] route [block] bind=[%s]\n", req.Address)
+			writeSocks5Reply(conn0, 0x02)
+			_ = conn0.Close()
+			return
+		}
+
+		handleForwardTunnel(ctx, newSocks5ReplayConn(conn0, reader, req), pool, req.Address)
+
+	case socks5CmdUDPAssociate:
+		handleForwardUDPAssociate(ctx, conn0, pool, router)
+
+	default:
+		writeSocks5Reply(conn0, 0x07)
+		_ = conn0.Close()
+	}
 }
 
-func handleForwardLazy(
+// handleForwardLocalHTTP 处理本地 HTTP 代理请求。需要认证或分流时先在本地解析请求头，
+// 否则与原来一样直接透传给服务端。
+func handleForwardLocalHTTP(
 	ctx context.Context,
 	listenConfig *ListenConfig,
 	conn0 net.Conn,
-	runtime *forwardRuntime,
+	reader *bufio.Reader,
+	pool *upstreamPool,
+	router *forwardRouter,
+) {
+	logger := pool.inst.logger
+
+	tunnelConn := &sniffedConn{Conn: conn0, reader: reader}
+
+	needAuth := len(listenConfig.LocalUsers) > 0
+	if !needAuth && !router.enabled() {
+		handleForwardTunnel(ctx, tunnelConn, pool, "")
+		return
+	}
+
+	_ = conn0.SetReadDeadline(time.Now().Add(listenConfig.timeout()))
+	req, err := peekLocalHTTPRequest(reader)
+	_ = conn0.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		logger.PrintfX("[x] local http request read failed from [%s]: [%s]\n",
+			conn0.RemoteAddr().String(),
+			err.Error(),
+		)
+		_ = conn0.Close()
+		return
+	}
+
+	if needAuth {
+		if err := authLocalHTTPRequest(req, listenConfig.LocalUsers); err != nil {
+			logger.PrintfX("[x] local http auth failed from [%s]: [%s]\n",
+				conn0.RemoteAddr().String(),
+				err.Error(),
+			)
+			writeHTTPProxyAuthRequired(conn0)
+			_ = conn0.Close()
+			return
+		}
+	}
+
+	target := httpProxyTarget(req)
+
+	switch router.decide(ctx, target) {
+	case routeActionDirect:
+		logger.PrintfX("[*] route [direct] target=[%s]\n", target)
+		handleNegotiationRequest(ctx, router.directPolicy(), &negotiationRequest{
+			Conn:   conn0,
+			Method: methodHttp,
+			Reader: reader,
+
+			protocol: metricsProtocolDirect,
+			route:    routeActionDirect,
+		})
+		return
+
+	case routeActionBlock:
+		logger.PrintfX("[*] route [block] target=[%s]\n", target)
+		writeHTTPProxyError(conn0, http.StatusForbidden)
+		_ = conn0.Close()
+		return
+	}
+
+	handleForwardTunnel(ctx, tunnelConn, pool, target)
+}
+
+// handleForwardTunnel 从服务端池中选择一个服务端，把 conn0 通过隧道转发过去。
+// target 只用于会话表，未知时为空。
+func handleForwardTunnel(
+	ctx context.Context,
+	conn0 net.Conn,
+	pool *upstreamPool,
+	target string,
 ) {
-	protocol, err := runtime.ensureProtocol(ctx, listenConfig)
+	logger := pool.inst.logger
+
+	var (
+		runtime  *forwardRuntime
+		protocol forwardProtocol
+		err      error
+	)
+
+	// 探测失败时还没有读取客户端数据，可以换下一个服务端重试；失败的服务端已进入退避，不会再被选中。
+	for range pool.servers {
+		runtime = pool.pick()
+
+		protocol, err = runtime.ensureProtocol(ctx)
+		if err == nil {
+			break
+		}
+
+		logger.PrintfX("[x] server [%s] protocol detect failed: [%s]\n",
+			runtime.listenConfig.ServerAddress,
+			err.Error(),
+		)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
 	if err != nil {
-		logger.PrintfX("[x] protocol detect failed: [%s]\n", err.Error())
+		if ctx.Err() == nil {
+			pool.inst.metrics.dialFailure(metricsRoleClient, pool.listenConfig.KeyID, err)
+		}
 		_ = writeLocalProxyError(conn0)
 		return
 	}
 
+	listenConfig := runtime.listenConfig
+
+	metricsProtocol := metricsProtocolHTTP1
 	switch protocol {
 	case forwardProtocolH2:
-		if err := handleForwardH2Limited(ctx, listenConfig, conn0, runtime); err != nil {
-			logger.PrintfX("[x] h2 stream failed: [%s]\n", err.Error())
-			runtime.resetProtocolIfCurrent(forwardProtocolH2)
-		}
+		metricsProtocol = metricsProtocolH2
+	case forwardProtocolH3:
+		metricsProtocol = metricsProtocolH3
+	case forwardProtocolWebSocket:
+		metricsProtocol = metricsProtocolWebSocket
+	}
+
+	streamCtx, metrics := runtime.inst.beginStream(ctx,
+		metricsRoleClient,
+		metricsProtocol,
+		listenConfig.KeyID,
+		conn0.RemoteAddr().String(),
+		target,
+	)
+
+	runtime.streamStart()
+
+	switch protocol {
+	case forwardProtocolH2:
+		err = handleForwardH2Limited(streamCtx, listenConfig, conn0, runtime, metrics, false)
+
+	case forwardProtocolH3:
+		err = handleForwardH2Limited(streamCtx, listenConfig, conn0, runtime, metrics, true)
 
 	case forwardProtocolHTTP1:
-		if err := handleForwardHTTP1(ctx, listenConfig, conn0, runtime.h1TLSCfg); err != nil {
-			logger.PrintfX("[x] http1 tunnel failed: [%s]\n", err.Error())
-			runtime.resetProtocolIfCurrent(forwardProtocolHTTP1)
-		}
+		err = handleForwardHTTP1(streamCtx, listenConfig, conn0, runtime, metrics, false)
+
+	case forwardProtocolWebSocket:
+		err = handleForwardHTTP1(streamCtx, listenConfig, conn0, runtime, metrics, true)
 
 	default:
 		_ = writeLocalProxyError(conn0)
 	}
+
+	metrics.end()
+
+	// 会话被关闭（管理接口或退出）导致的错误不算服务端故障。
+	if err != nil && streamCtx.Err() != nil {
+		err = context.Canceled
+	}
+
+	if err != nil && err != context.Canceled {
+		switch protocol {
+		case forwardProtocolH2:
+			logger.PrintfX("[x] server [%s] h2 stream failed: [%s]\n", listenConfig.ServerAddress, err.Error())
+		case forwardProtocolH3:
+			logger.PrintfX("[x] server [%s] h3 stream failed: [%s]\n", listenConfig.ServerAddress, err.Error())
+		case forwardProtocolHTTP1:
+			logger.PrintfX("[x] server [%s] http1 tunnel failed: [%s]\n", listenConfig.ServerAddress, err.Error())
+		case forwardProtocolWebSocket:
+			logger.PrintfX("[x] server [%s] websocket tunnel failed: [%s]\n", listenConfig.ServerAddress, err.Error())
+		}
+	}
+
+	runtime.streamEnd(protocol, err)
 }
 
-func (r *forwardRuntime) ensureProtocol(
-	ctx context.Context,
-	listenConfig *ListenConfig,
-) (forwardProtocol, error) {
+func (r *forwardRuntime) ensureProtocol(ctx context.Context) (forwardProtocol, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -218,7 +516,7 @@ func (r *forwardRuntime) ensureProtocol(
 		return r.protocol, nil
 	}
 
-	protocol, err := detectForwardProtocol(ctx, listenConfig, r.h2Client, r.h1TLSCfg)
+	protocol, err := r.probe(ctx)
 	if err != nil {
 		return forwardProtocolUnknown, err
 	}
@@ -226,10 +524,14 @@ func (r *forwardRuntime) ensureProtocol(
 	r.protocol = protocol
 
 	switch protocol {
+	case forwardProtocolH3:
+		r.inst.logger.Printf("[*] server [%s] selected forward protocol: HTTP/3 streaming tunnel\n", r.listenConfig.ServerAddress)
 	case forwardProtocolH2:
-		logger.Printf("[*] selected forward protocol: HTTP/2 streaming tunnel\n")
+		r.inst.logger.Printf("[*] server [%s] selected forward protocol: HTTP/2 streaming tunnel\n", r.listenConfig.ServerAddress)
 	case forwardProtocolHTTP1:
-		logger.Printf("[*] selected forward protocol: HTTP/1.1 upgrade fallback\n")
+		r.inst.logger.Printf("[*] server [%s] selected forward protocol: HTTP/1.1 upgrade fallback\n", r.listenConfig.ServerAddress)
+	case forwardProtocolWebSocket:
+		r.inst.logger.Printf("[*] server [%s] selected forward protocol: WebSocket\n", r.listenConfig.ServerAddress)
 	}
 
 	return protocol, nil
@@ -241,27 +543,107 @@ func (r *forwardRuntime) resetProtocolIfCurrent(protocol forwardProtocol) {
 
 	if r.protocol == protocol {
 		r.protocol = forwardProtocolUnknown
-		closeH2IdleConnections(r.h2Client)
+		closeIdleClientConnections(r.h2Client)
+		closeIdleClientConnections(r.h3Client)
 	}
 }
 
-func detectForwardProtocol(
-	ctx context.Context,
-	listenConfig *ListenConfig,
-	h2Client *http.Client,
-	h1TLSCfg *tls.Config,
-) (forwardProtocol, error) {
-	if err := probeH2TunnelSession(ctx, listenConfig, h2Client); err == nil {
-		return forwardProtocolH2, nil
-	} else {
-		logger.PrintfX("[x] h2 probe failed: [%s]\n", err.Error())
+// detectProtocol 按 ForwardProtocol 探测，返回第一个可用的协议。auto 模式下 HTTP/3 与其余协议同时探测，
+// 服务端没有开启 enable_h3 或 UDP 被丢弃时不必等待 QUIC 握手超时。
+func (r *forwardRuntime) detectProtocol(ctx context.Context) (forwardProtocol, error) {
+	protocols, err := parseForwardProtocol(r.listenConfig.ForwardProtocol)
+	if err != nil {
+		return forwardProtocolUnknown, err
 	}
 
-	if err := probeHTTP1TunnelSession(ctx, listenConfig, h1TLSCfg); err == nil {
-		return forwardProtocolHTTP1, nil
-	} else {
-		return forwardProtocolUnknown, fmt.Errorf("server probe failed: %w", err)
+	if len(protocols) == 1 || protocols[0] != forwardProtocolH3 {
+		return r.probeProtocols(ctx, protocols)
+	}
+
+	// 返回时取消仍在进行的探测。
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type probeResult struct {
+		protocol forwardProtocol
+		err      error
+	}
+
+	h3Done := make(chan error, 1)
+	go func() {
+		h3Done <- r.probeProtocol(ctx, forwardProtocolH3)
+	}()
+
+	start := time.Now()
+
+	restDone := make(chan probeResult, 1)
+	go func() {
+		protocol, err := r.probeProtocols(ctx, protocols[1:])
+		restDone <- probeResult{protocol, err}
+	}()
+
+	select {
+	case err := <-h3Done:
+		if err == nil {
+			return forwardProtocolH3, nil
+		}
+		r.inst.logger.PrintfX("[x] %s probe failed: [%s]\n", forwardProtocolH3, err.Error())
+
+		res := <-restDone
+		return res.protocol, res.err
+	case res := <-restDone:
+		if res.err == nil {
+			// QUIC 握手的往返比 TCP 与 TLS 少，HTTP/3 可用时在同样长的时间内也应当完成。
+			select {
+			case err := <-h3Done:
+				if err == nil {
+					return forwardProtocolH3, nil
+				}
+			case <-time.After(time.Since(start)):
+			}
+
+			return res.protocol, nil
+		}
+
+		if err := <-h3Done; err != nil {
+			r.inst.logger.PrintfX("[x] %s probe failed: [%s]\n", forwardProtocolH3, err.Error())
+			return forwardProtocolUnknown, res.err
+		}
+
+		return forwardProtocolH3, nil
+	}
+}
+
+// probeProtocols 依次探测 protocols，返回第一个可用的协议。
+func (r *forwardRuntime) probeProtocols(ctx context.Context, protocols []forwardProtocol) (forwardProtocol, error) {
+	var err error
+
+	for i, protocol := range protocols {
+		if err = r.probeProtocol(ctx, protocol); err == nil {
+			return protocol, nil
+		}
+
+		if i < len(protocols)-1 {
+			r.inst.logger.PrintfX("[x] %s probe failed: [%s]\n", protocol, err.Error())
+		}
+	}
+
+	return forwardProtocolUnknown, fmt.Errorf("server probe failed: %w", err)
+}
+
+func (r *forwardRuntime) probeProtocol(ctx context.Context, protocol forwardProtocol) error {
+	switch protocol {
+	case forwardProtocolH3:
+		return probeH2TunnelSession(ctx, r.listenConfig, r.h3Client, true)
+	case forwardProtocolH2:
+		return probeH2TunnelSession(ctx, r.listenConfig, r.h2Client, false)
+	case forwardProtocolHTTP1:
+		return probeHTTP1TunnelSession(ctx, r.listenConfig, r.h1TLSCfg, false)
+	case forwardProtocolWebSocket:
+		return probeHTTP1TunnelSession(ctx, r.listenConfig, r.h1TLSCfg, true)
 	}
+
+	return fmt.Errorf("unknown forward protocol %s", protocol)
 }
 
 func loadKnownPublicKey(publicKeyFile string) ([]byte, error) {
@@ -282,13 +664,15 @@ func loadKnownPublicKey(publicKeyFile string) ([]byte, error) {
 	return block.Bytes, nil
 }
 
+// newForwardTLSClientConfig 固定服务端公钥；clientCert 非 nil 时用于 mTLS。
 func newForwardTLSClientConfig(
 	knownPubKey []byte,
+	clientCert *tls.Certificate,
 	sessionCache tls.ClientSessionCache,
 	serverAddress string,
 	nextProtos []string,
 ) *tls.Config {
-	return &tls.Config{
+	cfg := &tls.Config{
 		MinVersion: tls.VersionTLS12,
 		MaxVersion: tls.VersionTLS13,
 
@@ -318,6 +702,12 @@ func newForwardTLSClientConfig(
 			return nil
 		},
 	}
+
+	if clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	return cfg
 }
 
 func newH2Client(tlsCfg *tls.Config) (*http.Client, error) {
@@ -345,25 +735,30 @@ func newH2Client(tlsCfg *tls.Config) (*http.Client, error) {
 	}, nil
 }
 
-func closeH2IdleConnections(client *http.Client) {
-	if client == nil || client.Transport == nil {
+func closeIdleClientConnections(client *http.Client) {
+	if client == nil {
 		return
 	}
 
-	if tr, ok := client.Transport.(*http.Transport); ok {
-		tr.CloseIdleConnections()
-	}
+	client.CloseIdleConnections()
 }
 
+// probeH2TunnelSession 探测 h2 隧道，h3 为 true 时探测 HTTP/3。
 func probeH2TunnelSession(
 	ctx context.Context,
 	listenConfig *ListenConfig,
 	client *http.Client,
+	h3 bool,
 ) error {
-	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	probeCtx, cancel := context.WithTimeout(ctx, listenConfig.timeout())
 	defer cancel()
 
-	req, err := newH2TunnelRequest(probeCtx, listenConfig, strings.NewReader(""))
+	proto, protoMajor := protoH2, 2
+	if h3 {
+		proto, protoMajor = protoH3, 3
+	}
+
+	req, err := newH2TunnelRequest(probeCtx, listenConfig, strings.NewReader(""), proto)
 	if err != nil {
 		return err
 	}
@@ -375,12 +770,12 @@ func probeH2TunnelSession(
 	}
 	defer resp.Body.Close()
 
-	if resp.ProtoMajor != 2 {
-		return fmt.Errorf("server did not negotiate h2: %s", resp.Proto)
+	if resp.ProtoMajor != protoMajor {
+		return fmt.Errorf("server did not negotiate %s: %s", proto, resp.Proto)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("h2 tunnel rejected: %s", resp.Status)
+		return fmt.Errorf("%s tunnel rejected: %s", proto, resp.Status)
 	}
 
 	_, _ = io.Copy(io.Discard, resp.Body)
@@ -393,6 +788,8 @@ func handleForwardH2Limited(
 	listenConfig *ListenConfig,
 	conn0 net.Conn,
 	runtime *forwardRuntime,
+	metrics *streamMetrics,
+	h3 bool,
 ) error {
 	select {
 	case runtime.streamSem <- struct{}{}:
@@ -403,96 +800,115 @@ func handleForwardH2Limited(
 		return ctx.Err()
 
 	default:
-		recordStreamFail()
+		runtime.inst.stats.total.streamFail()
 		_ = writeLocalProxyError(conn0)
-		return errors.New("too many active h2 streams")
+		return errTooManyH2Streams
 	}
 
-	return handleForwardH2(ctx, listenConfig, conn0, runtime.h2Client)
+	return handleForwardH2(ctx, listenConfig, conn0, runtime, metrics, h3)
 }
 
+// handleForwardH2 把 conn0 作为一个 h2 stream 转发，h3 为 true 时使用 HTTP/3。
 func handleForwardH2(
 	ctx context.Context,
 	listenConfig *ListenConfig,
 	conn0 net.Conn,
-	client *http.Client,
+	runtime *forwardRuntime,
+	metrics *streamMetrics,
+	h3 bool,
 ) error {
 	defer conn0.Close()
 
-	recordStreamStart()
-	defer recordStreamEnd()
+	client, proto, protoMajor := runtime.h2Client, protoH2, 2
+	if h3 {
+		client, proto, protoMajor = runtime.h3Client, protoH3, 3
+	}
+
+	stats := &runtime.inst.stats.total
+
+	stats.streamStart()
+	defer stats.streamEnd()
 
 	streamCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	pr, pw := io.Pipe()
 
-	req, err := newH2TunnelRequest(streamCtx, listenConfig, pr)
+	req, err := newH2TunnelRequest(streamCtx, listenConfig, pr, proto)
 	if err != nil {
-		recordStreamFail()
+		stats.streamFail()
 		_ = pw.CloseWithError(err)
 		_ = writeLocalProxyError(conn0)
 		return err
 	}
 
-	local := newDeadlineConn(conn0, 60*time.Second)
+	local := newDeadlineConn(conn0, listenConfig.idleTimeout())
 
 	uploadDone := make(chan struct{})
 
 	go func() {
 		defer close(uploadDone)
 
-		_, copyErr := io.Copy(uploadCountingWriter{w: pw}, local)
+		_, copyErr := io.Copy(uploadCountingWriter{w: pw, stats: stats, metrics: metrics}, local)
 		_ = pw.CloseWithError(copyErr)
 	}()
 
 	resp, err := client.Do(req)
 	if err != nil {
-		recordStreamFail()
+		stats.streamFail()
 		cancel()
 		_ = pr.CloseWithError(err)
 		_ = pw.CloseWithError(err)
 		_ = conn0.Close()
 		<-uploadDone
-		return err
+		return transportError{err}
 	}
 
 	defer resp.Body.Close()
 
-	if resp.ProtoMajor != 2 {
-		recordStreamFail()
+	if resp.ProtoMajor != protoMajor {
+		stats.streamFail()
 		cancel()
 		_ = conn0.Close()
 		<-uploadDone
-		return fmt.Errorf("unexpected response protocol: %s", resp.Proto)
+		return transportError{fmt.Errorf("unexpected response protocol: %s", resp.Proto)}
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		recordStreamFail()
+		stats.streamFail()
 		cancel()
 		_ = conn0.Close()
 		<-uploadDone
-		return fmt.Errorf("h2 tunnel rejected: %s", resp.Status)
+		return transportError{fmt.Errorf("%s tunnel rejected: %s", proto, resp.Status)}
 	}
 
-	_, _ = io.Copy(downloadCountingWriter{w: local}, resp.Body)
+	// 响应体开始传输后取消请求 ctx 不一定能打断读取，这里主动关闭。
+	stop := context.AfterFunc(streamCtx, func() {
+		_ = resp.Body.Close()
+		_ = conn0.Close()
+	})
+	defer stop()
+
+	_, _ = io.Copy(downloadCountingWriter{w: local, stats: stats, metrics: metrics}, resp.Body)
 
 	cancel()
 	_ = conn0.Close()
 	<-uploadDone
 
-	logger.PrintfX("[-] client [%s] disconnected\n", conn0.RemoteAddr().String())
+	runtime.inst.logger.PrintfX("[-] client [%s] disconnected\n", conn0.RemoteAddr().String())
 
 	return nil
 }
 
+// newH2TunnelRequest 构建 h2 / HTTP/3 隧道请求，proto 包含在签名中。
 func newH2TunnelRequest(
 	ctx context.Context,
 	listenConfig *ListenConfig,
 	body io.Reader,
+	proto string,
 ) (*http.Request, error) {
 	host := hostHeaderFromAddress(listenConfig.ServerAddress)
-	url := "https://" + host + tunnelPath
+	url := "https://" + host + listenConfig.tunnelPath()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
 	if err != nil {
@@ -506,37 +922,44 @@ func newH2TunnelRequest(
 
 	ts := time.Now().Unix()
 
-	signature := makeTunnelAuthSignatureV2(
-		listenConfig.Secret,
-		http.MethodPost,
-		tunnelPath,
-		host,
-		nonce,
-		ts,
-		protoH2,
-	)
+	signature, keyID := listenConfig.signTunnelRequest(http.MethodPost, host, nonce, ts, proto)
 
 	req.Host = host
 	req.ContentLength = -1
 
+	headers := listenConfig.tunnelHeaders()
+
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set(headerSessionID, nonce)
-	req.Header.Set(headerRequestTime, strconv.FormatInt(ts, 10))
-	req.Header.Set(headerRequestSignature, signature)
+	req.Header.Set(headers.SessionID, nonce)
+	req.Header.Set(headers.RequestTime, strconv.FormatInt(ts, 10))
+	req.Header.Set(headers.Signature, signature)
+
+	if keyID != "" {
+		req.Header.Set(headers.KeyID, keyID)
+	}
 
 	return req, nil
 }
 
+// handleForwardHTTP1 通过 HTTP/1.1 Upgrade 建立隧道，websocket 为 true 时使用 WebSocket 帧。
 func handleForwardHTTP1(
 	ctx context.Context,
 	listenConfig *ListenConfig,
 	conn0 net.Conn,
-	tlsCfg *tls.Config,
+	runtime *forwardRuntime,
+	metrics *streamMetrics,
+	websocket bool,
 ) error {
 	defer conn0.Close()
 
+	logger := runtime.inst.logger
+	stats := &runtime.inst.stats.total
+
+	stats.streamStart()
+	defer stats.streamEnd()
+
 	done := make(chan struct{})
 
 	go func() {
@@ -549,14 +972,15 @@ func handleForwardHTTP1(
 
 	defer close(done)
 
-	conn1, err := dialTLSConn(ctx, listenConfig.ServerAddress, tlsCfg)
+	conn1, err := dialTLSConn(ctx, listenConfig, runtime.h1TLSCfg)
 	if err != nil {
 		logger.Printf("[x] connect [%s] error [%s]\n",
 			listenConfig.ServerAddress,
 			err.Error(),
 		)
+		stats.streamFail()
 		_ = writeLocalProxyError(conn0)
-		return err
+		return transportError{err}
 	}
 
 	defer conn1.Close()
@@ -569,36 +993,35 @@ func handleForwardHTTP1(
 		}
 	}()
 
-	if err := writeTunnelUpgradeRequest(conn1, listenConfig); err != nil {
-		logger.Printf("[x] tunnel upgrade request failed: [%s]\n", err.Error())
-		return err
+	tunnel, err := openHTTP1Tunnel(conn1, listenConfig, websocket)
+	if err != nil {
+		logger.PrintfX("[x] tunnel upgrade failed: [%s]\n", err.Error())
+		stats.streamFail()
+		return transportError{err}
 	}
 
-	if err := readTunnelUpgradeResponse(conn1); err != nil {
-		logger.PrintfX("[x] tunnel upgrade response error: [%s]\n", err.Error())
-		return err
-	}
+	defer tunnel.Close()
 
-	mutualCopyIO(ctx, conn0, conn1)
+	mutualCopyIO(ctx, conn0, newStatsConn(tunnel, stats, metrics), listenConfig.idleTimeout())
 
 	logger.PrintfX("[-] client [%s] disconnected\n", conn0.RemoteAddr().String())
 
 	return nil
 }
 
-func dialTLSConn(ctx context.Context, address string, tlsCfg *tls.Config) (*tls.Conn, error) {
+func dialTLSConn(ctx context.Context, listenConfig *ListenConfig, tlsCfg *tls.Config) (*tls.Conn, error) {
 	dialer := &net.Dialer{
-		Timeout: time.Duration(timeout) * time.Second,
+		Timeout: listenConfig.timeout(),
 	}
 
-	rawConn, err := dialer.DialContext(ctx, "tcp", address)
+	rawConn, err := dialer.DialContext(ctx, "tcp", listenConfig.ServerAddress)
 	if err != nil {
 		return nil, err
 	}
 
 	conn := tls.Client(rawConn, tlsCfg)
 
-	if err := conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
+	if err := conn.SetDeadline(time.Now().Add(listenConfig.timeout())); err != nil {
 		_ = rawConn.Close()
 		return nil, err
 	}
@@ -620,24 +1043,24 @@ func probeHTTP1TunnelSession(
 	ctx context.Context,
 	listenConfig *ListenConfig,
 	tlsCfg *tls.Config,
+	websocket bool,
 ) error {
-	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	probeCtx, cancel := context.WithTimeout(ctx, listenConfig.timeout())
 	defer cancel()
 
-	conn1, err := dialTLSConn(probeCtx, listenConfig.ServerAddress, tlsCfg)
+	conn1, err := dialTLSConn(probeCtx, listenConfig, tlsCfg)
 	if err != nil {
 		return err
 	}
 
 	defer conn1.Close()
 
-	if err := writeTunnelUpgradeRequest(conn1, listenConfig); err != nil {
+	tunnel, err := openHTTP1Tunnel(conn1, listenConfig, websocket)
+	if err != nil {
 		return err
 	}
 
-	if err := readTunnelUpgradeResponse(conn1); err != nil {
-		return err
-	}
+	defer tunnel.Close()
 
 	primeTLSSessionTicket(conn1)
 
@@ -653,7 +1076,8 @@ func primeTLSSessionTicket(conn net.Conn) {
 	_ = conn.SetReadDeadline(time.Time{})
 }
 
-func writeTunnelUpgradeRequest(conn net.Conn, listenConfig *ListenConfig) error {
+// writeTunnelUpgradeRequest 发送 HTTP/1.1 隧道的 Upgrade 请求；websocketKey 非空时按 WebSocket 握手发送。
+func writeTunnelUpgradeRequest(conn net.Conn, listenConfig *ListenConfig, websocketKey string) error {
 	nonce, err := randomNonce()
 	if err != nil {
 		return err
@@ -661,16 +1085,16 @@ func writeTunnelUpgradeRequest(conn net.Conn, listenConfig *ListenConfig) error
 
 	ts := time.Now().Unix()
 	host := hostHeaderFromAddress(listenConfig.ServerAddress)
+	headers := listenConfig.tunnelHeaders()
 
-	signature := makeTunnelAuthSignatureV2(
-		listenConfig.Secret,
-		http.MethodGet,
-		tunnelPath,
-		host,
-		nonce,
-		ts,
-		protoHTTP1,
-	)
+	proto, upgrade, websocketLines := protoHTTP1, listenConfig.upgradeToken(), ""
+	if websocketKey != "" {
+		proto, upgrade = protoWebSocket, protoWebSocket
+		websocketLines = "Sec-WebSocket-Key: " + websocketKey + "\r\n" +
+			"Sec-WebSocket-Version: 13\r\n"
+	}
+
+	signature, keyID := listenConfig.signTunnelRequest(http.MethodGet, host, nonce, ts, proto)
 
 	req := fmt.Sprintf(
 		"GET %s HTTP/1.1\r\n"+
@@ -682,20 +1106,24 @@ func writeTunnelUpgradeRequest(conn net.Conn, listenConfig *ListenConfig) error
 			"Pragma: no-cache\r\n"+
 			"Connection: Upgrade\r\n"+
 			"Upgrade: %s\r\n"+
+			"%s"+
 			"%s: %s\r\n"+
 			"%s: %d\r\n"+
 			"%s: %s\r\n"+
+			"%s"+
 			"Content-Length: 0\r\n"+
 			"\r\n",
-		tunnelPath,
+		listenConfig.tunnelPath(),
 		host,
-		tunnelUpgradeToken,
-		headerSessionID,
+		upgrade,
+		websocketLines,
+		headers.SessionID,
 		nonce,
-		headerRequestTime,
+		headers.RequestTime,
 		ts,
-		headerRequestSignature,
+		headers.Signature,
 		signature,
+		keyIDHeaderLine(headers.KeyID, keyID),
 	)
 
 	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
@@ -705,7 +1133,15 @@ func writeTunnelUpgradeRequest(conn net.Conn, listenConfig *ListenConfig) error
 	return err
 }
 
-func readTunnelUpgradeResponse(conn net.Conn) error {
+func keyIDHeaderLine(name, keyID string) string {
+	if keyID == "" {
+		return ""
+	}
+	return name + ": " + keyID + "\r\n"
+}
+
+// readTunnelUpgradeResponse 读取并检查 101 响应，返回读取时使用的缓冲。
+func readTunnelUpgradeResponse(conn net.Conn, upgradeToken, websocketKey string) (*bufio.Reader, error) {
 	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
 
@@ -713,24 +1149,57 @@ func readTunnelUpgradeResponse(conn net.Conn) error {
 
 	resp, err := http.ReadResponse(br, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusSwitchingProtocols {
-		return errors.New("tunnel upgrade rejected")
+		return nil, errors.New("tunnel upgrade rejected")
 	}
 
 	if !headerContainsToken(resp.Header.Get("Connection"), "Upgrade") {
-		return errors.New("invalid upgrade response")
+		return nil, errors.New("invalid upgrade response")
 	}
 
-	if !bytes.EqualFold([]byte(resp.Header.Get("Upgrade")), []byte(tunnelUpgradeToken)) {
-		return errors.New("invalid upgrade token")
+	if !bytes.EqualFold([]byte(resp.Header.Get("Upgrade")), []byte(upgradeToken)) {
+		return nil, errors.New("invalid upgrade token")
 	}
 
-	return nil
+	if websocketKey != "" && resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(websocketKey) {
+		return nil, errors.New("invalid websocket accept")
+	}
+
+	return br, nil
+}
+
+// openHTTP1Tunnel 在 conn1 上完成 Upgrade，返回承载隧道数据的连接：
+// websocket 为 true 时是 WebSocket 帧连接，否则就是 conn1。
+func openHTTP1Tunnel(conn1 net.Conn, listenConfig *ListenConfig, websocket bool) (net.Conn, error) {
+	upgrade, key := listenConfig.upgradeToken(), ""
+
+	if websocket {
+		var err error
+		if key, err = newWebSocketKey(); err != nil {
+			return nil, err
+		}
+		upgrade = protoWebSocket
+	}
+
+	if err := writeTunnelUpgradeRequest(conn1, listenConfig, key); err != nil {
+		return nil, fmt.Errorf("upgrade request: %w", err)
+	}
+
+	reader, err := readTunnelUpgradeResponse(conn1, upgrade, key)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade response: %w", err)
+	}
+
+	if !websocket {
+		return conn1, nil
+	}
+
+	return newWebSocketConn(conn1, reader, true), nil
 }
 
 func randomNonce() (string, error) {
@@ -2,6 +2,17 @@ module github.com/refgd/csocks-core
 
 go 1.25.0
 
-require golang.org/x/net v0.53.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/quic-go/quic-go v0.61.0
+	golang.org/x/net v0.56.0
+	golang.org/x/sys v0.47.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require golang.org/x/text v0.36.0 // indirect
+require (
+	github.com/kr/text v0.2.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
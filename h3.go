@@ -0,0 +1,83 @@
+package csocks
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// 有活跃 stream 时定期发送 PING，避免 QUIC 空闲超时与 NAT 映射过期。
+	h3KeepAlivePeriod = 15 * time.Second
+)
+
+// newH3Client 与 newH2Client 相同：一个 host 一个 QUIC 连接，通过多 stream 承载并发。
+func newH3Client(tlsCfg *tls.Config, listenConfig *ListenConfig) *http.Client {
+	tr := &http3.Transport{
+		TLSClientConfig: tlsCfg,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: listenConfig.timeout(),
+			KeepAlivePeriod:      h3KeepAlivePeriod,
+		},
+
+		// 每个连接使用单独的 UDP socket，连接关闭时随之关闭；服务端池热加载替换后不会遗留 socket。
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+		},
+	}
+
+	return &http.Client{
+		Transport: tr,
+		Timeout:   0,
+	}
+}
+
+// serveH3 在 addr 的 UDP 端口提供 HTTP/3 隧道，请求与 h2 一样由 handleH2Request 处理。
+// ctx 结束时发送 GOAWAY，不再接受新请求；整个 HTTP/3 服务按一个连接参与 drain，connCtx 结束时关闭所有 QUIC 连接。
+func (s *proxyServer) serveH3(ctx, connCtx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	listenConfig := s.config()
+
+	h3Server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(s.tlsCfg),
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: listenConfig.timeout(),
+			MaxIncomingStreams:   int64(listenConfig.maxH2Streams()),
+		},
+
+		// 没有请求的连接空闲后关闭，与 h2 一致。
+		IdleTimeout: listenConfig.h2IdleTimeout(),
+
+		// 每个请求单独认证，使用当前生效的用户表与 ACL。
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleH2Request(connCtx, s.runtime.Load(), w, r)
+		}),
+	}
+
+	s.inst.logger.Printf("[*] http3 listen on: [%s]", pc.LocalAddr().String())
+
+	go func() {
+		_ = h3Server.Serve(pc)
+	}()
+
+	s.conns.add()
+
+	go func() {
+		defer s.conns.done()
+
+		<-ctx.Done()
+		_ = h3Server.Shutdown(connCtx)
+		_ = pc.Close()
+	}()
+
+	return nil
+}
@@ -3,6 +3,7 @@ package csocks
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,9 +12,11 @@ import (
 	"time"
 )
 
-func handleHttpRequest(ctx context.Context, negotiationRequest *negotiationRequest) {
+func handleHttpRequest(ctx context.Context, policy *accessPolicy, negotiationRequest *negotiationRequest) {
 	defer negotiationRequest.Conn.Close()
 
+	logger := policy.inst.logger
+
 	reader := negotiationRequest.Reader
 	if reader == nil {
 		reader = bufio.NewReader(negotiationRequest.Conn)
@@ -28,7 +31,8 @@ func handleHttpRequest(ctx context.Context, negotiationRequest *negotiationReque
 	}
 	defer req.Body.Close()
 
-	logger.PrintfX("[http] method=%s host=%s url=%s requestURI=%s\n",
+	logger.PrintfX("[http] user=%s method=%s host=%s url=%s requestURI=%s\n",
+		negotiationRequest.User,
 		req.Method,
 		req.Host,
 		req.URL.String(),
@@ -36,19 +40,26 @@ func handleHttpRequest(ctx context.Context, negotiationRequest *negotiationReque
 	)
 
 	if req.Method == http.MethodConnect {
-		handleHttpConnectDirect(ctx, negotiationRequest.Conn, reader, req)
+		handleHttpConnectDirect(ctx, policy, negotiationRequest, reader, req)
 		return
 	}
 
-	handleHttpForwardDirect(ctx, negotiationRequest.Conn, req)
+	handleHttpForwardDirect(ctx, policy, negotiationRequest, req)
 }
 
 func handleHttpConnectDirect(
 	ctx context.Context,
-	clientConn net.Conn,
+	policy *accessPolicy,
+	negotiationRequest *negotiationRequest,
 	reader *bufio.Reader,
 	req *http.Request,
 ) {
+	clientConn := negotiationRequest.Conn
+	user := negotiationRequest.User
+
+	logger := policy.inst.logger
+	stats := policy.inst.stats.userTunnelStats(negotiationRequest.statsUser())
+
 	host := strings.TrimSpace(req.Host)
 	if host == "" && req.URL != nil {
 		host = strings.TrimSpace(req.URL.Host)
@@ -59,17 +70,22 @@ func handleHttpConnectDirect(
 		return
 	}
 
-	dialer := &net.Dialer{
-		Timeout: time.Duration(timeout) * time.Second,
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
 	}
 
-	remoteConn, err := dialer.DialContext(ctx, "tcp", host)
+	negotiationRequest.metrics.setTarget(host)
+
+	remoteConn, err := dialTarget(ctx, policy, user, "tcp", host)
 	if err != nil {
-		logger.PrintfX("[x] CONNECT dial failed host=%s err=%s\n", host, err.Error())
-		writeHTTPProxyError(clientConn, http.StatusServiceUnavailable)
+		logger.PrintfX("[x] CONNECT dial failed host=%s user=%s err=%s\n", host, user, err.Error())
+		stats.streamFail()
+		writeHTTPProxyError(clientConn, httpStatusForDialError(err))
 		return
 	}
 
+	remoteConn = newStatsConn(remoteConn, stats, negotiationRequest.metrics)
+
 	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
 		logger.PrintfX("[x] CONNECT write 200 failed host=%s err=%s\n", host, err.Error())
 		_ = remoteConn.Close()
@@ -90,18 +106,25 @@ func handleHttpConnectDirect(
 		}
 	}
 
-	logger.PrintfX("[+] CONNECT established host=%s\n", host)
+	logger.PrintfX("[+] CONNECT established host=%s user=%s\n", host, user)
 
-	mutualCopyIO(ctx, clientConn, remoteConn)
+	mutualCopyIO(ctx, clientConn, remoteConn, policy.idleTimeout)
 
-	logger.PrintfX("[-] CONNECT closed host=%s\n", host)
+	logger.PrintfX("[-] CONNECT closed host=%s user=%s\n", host, user)
 }
 
 func handleHttpForwardDirect(
 	ctx context.Context,
-	clientConn net.Conn,
+	policy *accessPolicy,
+	negotiationRequest *negotiationRequest,
 	req *http.Request,
 ) {
+	clientConn := negotiationRequest.Conn
+	user := negotiationRequest.User
+
+	logger := policy.inst.logger
+	stats := policy.inst.stats.userTunnelStats(negotiationRequest.statsUser())
+
 	outReq := req.Clone(ctx)
 	outReq.RequestURI = ""
 
@@ -125,14 +148,27 @@ func handleHttpForwardDirect(
 
 	cleanProxyHeaders(outReq.Header)
 
-	resp, err := http.DefaultTransport.RoundTrip(outReq)
+	negotiationRequest.metrics.setTarget(outReq.URL.Host)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialTarget(ctx, policy, user, network, address)
+		},
+		DisableKeepAlives:     true,
+		TLSHandshakeTimeout:   policy.timeout,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+
+	resp, err := transport.RoundTrip(outReq)
 	if err != nil {
-		logger.PrintfX("[x] HTTP roundtrip failed host=%s url=%s err=%s\n",
+		logger.PrintfX("[x] HTTP roundtrip failed host=%s url=%s user=%s err=%s\n",
 			outReq.Host,
 			outReq.URL.String(),
+			user,
 			err.Error(),
 		)
-		writeHTTPProxyError(clientConn, http.StatusServiceUnavailable)
+		stats.streamFail()
+		writeHTTPProxyError(clientConn, httpStatusForDialError(err))
 		return
 	}
 
@@ -143,7 +179,12 @@ func handleHttpForwardDirect(
 	resp.Close = true
 	resp.Header.Set("Connection", "close")
 
-	if err := resp.Write(clientConn); err != nil {
+	if outReq.ContentLength > 0 {
+		stats.addBytesUp(uint64(outReq.ContentLength))
+		negotiationRequest.metrics.addBytesUp(int(outReq.ContentLength))
+	}
+
+	if err := resp.Write(downloadStatsWriter{w: clientConn, stats: stats, metrics: negotiationRequest.metrics}); err != nil {
 		logger.PrintfX("[x] HTTP response write failed err=%s\n", err.Error())
 		return
 	}
@@ -176,6 +217,31 @@ func writeHTTPProxyError(conn net.Conn, code int) {
 	)
 }
 
+func httpStatusForDialError(err error) int {
+	if errors.Is(err, errAccessDenied) {
+		return http.StatusForbidden
+	}
+	return http.StatusServiceUnavailable
+}
+
+func writeHTTPProxyAuthRequired(conn net.Conn) {
+	body := http.StatusText(http.StatusProxyAuthRequired) + "\n"
+
+	_, _ = fmt.Fprintf(
+		conn,
+		"HTTP/1.1 407 %s\r\n"+
+			"Proxy-Authenticate: Basic realm=\"csocks\"\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Connection: close\r\n"+
+			"\r\n"+
+			"%s",
+		http.StatusText(http.StatusProxyAuthRequired),
+		len(body),
+		body,
+	)
+}
+
 func cleanProxyHeaders(h http.Header) {
 	h.Del("Proxy-Connection")
 	h.Del("Connection")
@@ -187,3 +253,18 @@ func cleanProxyHeaders(h http.Header) {
 	h.Del("Transfer-Encoding")
 	h.Del("Upgrade")
 }
+
+type downloadStatsWriter struct {
+	w       io.Writer
+	stats   *tunnelStats
+	metrics *streamMetrics
+}
+
+func (w downloadStatsWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.stats.addBytesDown(uint64(n))
+		w.metrics.addBytesDown(n)
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+package csocks
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// instance 是一个 Server / Client 独占的运行期环境：日志、流量统计、指标、防重放缓存与封禁表。
+// StartServer 启动的实例只共享包级的日志回调（SetLogSink），GetTunnelStats 等函数汇总正在运行的这些实例。
+type instance struct {
+	logger  *customLogger
+	stats   *instanceStats
+	metrics *metrics
+	replay  *nonceReplayCache
+
+	sessions sessionRegistry
+	bans     banList
+}
+
+type instanceStats struct {
+	total    tunnelStats
+	users    sync.Map
+	upstream atomic.Pointer[upstreamPool]
+}
+
+func newInstance(quiet bool, sink LogSink) *instance {
+	ls := &logSink{}
+	ls.set(sink)
+
+	m := newMetrics()
+
+	return &instance{
+		logger:  newCustomLogger(quiet, ls),
+		stats:   &instanceStats{},
+		metrics: m,
+		replay:  newNonceReplayCache(m),
+	}
+}
+
+func newDefaultInstance(quiet bool) *instance {
+	m := newMetrics()
+
+	return &instance{
+		logger:  newCustomLogger(quiet, defaultLogSink),
+		stats:   &instanceStats{},
+		metrics: m,
+		replay:  newNonceReplayCache(m),
+	}
+}
+
+// defaultInstances 返回 StartServer 启动、仍在运行的实例。
+func defaultInstances() []*instance {
+	var out []*instance
+
+	reloaders.Range(func(_, v any) bool {
+		out = append(out, v.(reloader).env())
+		return true
+	})
+
+	return out
+}
+
+// userTunnelStats 返回 user 的统计，不存在时创建。
+func (s *instanceStats) userTunnelStats(user string) *tunnelStats {
+	if user == "" {
+		user = legacyTunnelUser
+	}
+
+	if v, ok := s.users.Load(user); ok {
+		return v.(*tunnelStats)
+	}
+
+	v, _ := s.users.LoadOrStore(user, &tunnelStats{})
+	return v.(*tunnelStats)
+}
+
+func (s *instanceStats) userSnapshots() map[string]TunnelStatsSnapshot {
+	out := make(map[string]TunnelStatsSnapshot)
+
+	s.users.Range(func(k, v any) bool {
+		out[k.(string)] = v.(*tunnelStats).snapshot()
+		return true
+	})
+
+	return out
+}
+
+// reset 清零总体与各用户的累计统计。Prometheus 指标是单调计数器，不受影响。
+func (s *instanceStats) reset() {
+	s.total.reset()
+
+	s.users.Range(func(_, v any) bool {
+		v.(*tunnelStats).reset()
+		return true
+	})
+}
+
+func (s *instanceStats) upstreamSnapshots() []UpstreamStatsSnapshot {
+	pool := s.upstream.Load()
+	if pool == nil {
+		return nil
+	}
+	return pool.snapshot()
+}
@@ -0,0 +1,73 @@
+package csocks
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testReloader struct {
+	inst *instance
+	cfg  *ListenConfig
+}
+
+func (r *testReloader) env() *instance                 { return r.inst }
+func (r *testReloader) config() *ListenConfig          { return r.cfg }
+func (r *testReloader) reload(cfg *ListenConfig) error { return nil }
+
+// 两个 StartServer 实例的统计互不影响，包级函数返回运行中实例的合计，实例停止后不再计入。
+func TestDefaultInstancesStats(t *testing.T) {
+	a, b := newDefaultInstance(true), newDefaultInstance(true)
+	if a.stats == b.stats || a.metrics == b.metrics || a.replay == b.replay {
+		t.Fatal("StartServer instances share state")
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	registerReloader(ctxA, &ListenConfig{ListenPort: "test-a", NoSignalReload: true}, &testReloader{inst: a})
+	registerReloader(ctxB, &ListenConfig{ListenPort: "test-b", NoSignalReload: true}, &testReloader{inst: b})
+
+	a.stats.total.streamStart()
+	a.stats.userTunnelStats("alice").streamStart()
+	b.stats.total.streamStart()
+	b.stats.userTunnelStats("alice").streamStart()
+	b.stats.userTunnelStats("bob").streamStart()
+
+	if got := a.stats.total.snapshot().TotalStreams; got != 1 {
+		t.Fatalf("instance total = %d, want 1", got)
+	}
+
+	if got := GetTunnelStats().TotalStreams; got != 2 {
+		t.Fatalf("GetTunnelStats().TotalStreams = %d, want 2", got)
+	}
+
+	users := GetUserTunnelStats()
+	if users["alice"].TotalStreams != 2 || users["bob"].TotalStreams != 1 {
+		t.Fatalf("GetUserTunnelStats() = %+v", users)
+	}
+
+	if _, err := a.replay.SeenOrAdd("n1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := b.replay.SeenOrAdd("n1", time.Minute); seen {
+		t.Fatal("nonce seen by one instance is rejected by another")
+	}
+
+	// 实例在 ctx 结束后由 context.AfterFunc 异步注销。
+	cancelB()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := reloaders.Load("test-b"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stopped instance is still registered")
+		}
+	}
+
+	if got := GetTunnelStats().TotalStreams; got != 1 {
+		t.Fatalf("GetTunnelStats().TotalStreams after stop = %d, want 1", got)
+	}
+}
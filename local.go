@@ -0,0 +1,263 @@
+package csocks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// localSocks5Request 是本地监听端完成 SOCKS5 协商后读到的请求。
+// raw 保存原始请求字节（VER CMD RSV ATYP ADDR PORT），转发给服务端时原样重放。
+type localSocks5Request struct {
+	Command byte
+	Address string
+	raw     []byte
+}
+
+// socks5NoAuthGreeting 是代替客户端发送给服务端的方法协商，本地已完成认证。
+var socks5NoAuthGreeting = []byte{0x05, 0x01, 0x00}
+
+// readLocalSocks5Request 在本地完成 SOCKS5 方法协商并读取请求。
+// UDP ASSOCIATE 需要在本地建立 UDP 中继，所以 forward 端不能再把握手字节直接透传给服务端。
+// users 非空时要求用户名/密码认证，认证失败不会打开任何到服务端的 stream。
+func readLocalSocks5Request(conn net.Conn, reader *bufio.Reader, users []LocalUser) (*localSocks5Request, error) {
+	var hdr [2]byte
+
+	if _, err := io.ReadFull(reader, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[0] != 0x05 {
+		return nil, errors.New("invalid socks5 version")
+	}
+
+	nMethods := int(hdr[1])
+	if nMethods <= 0 {
+		return nil, errors.New("invalid socks5 nmethods")
+	}
+
+	methods := make([]byte, nMethods)
+
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(0x00)
+	if len(users) > 0 {
+		method = 0x02
+	}
+
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = conn.Write([]byte{0x05, 0xFF})
+		return nil, errors.New("no acceptable auth method")
+	}
+
+	if _, err := conn.Write([]byte{0x05, method}); err != nil {
+		return nil, err
+	}
+
+	if method == 0x02 {
+		if err := authLocalSocks5User(conn, reader, users); err != nil {
+			return nil, err
+		}
+	}
+
+	var raw bytes.Buffer
+	tee := io.TeeReader(reader, &raw)
+
+	var reqHdr [4]byte
+
+	if _, err := io.ReadFull(tee, reqHdr[:]); err != nil {
+		return nil, err
+	}
+
+	if reqHdr[0] != 0x05 {
+		return nil, errors.New("invalid socks5 request version")
+	}
+
+	address, err := readSocks5Address(tee, reqHdr[3])
+	if err != nil {
+		if errors.Is(err, errSocks5AddressType) {
+			writeSocks5Reply(conn, 0x08)
+		}
+		return nil, err
+	}
+
+	return &localSocks5Request{
+		Command: reqHdr[1],
+		Address: address,
+		raw:     raw.Bytes(),
+	}, nil
+}
+
+// socks5ReplayConn 把本地已经消费掉的协商重放给隧道：
+// 读取时先返回 prefix，写回本地时丢弃服务端的方法选择应答（skip 字节）。
+type socks5ReplayConn struct {
+	net.Conn
+	reader *bufio.Reader
+	prefix []byte
+	skip   int
+}
+
+func newSocks5ReplayConn(conn net.Conn, reader *bufio.Reader, req *localSocks5Request) *socks5ReplayConn {
+	prefix := make([]byte, 0, len(socks5NoAuthGreeting)+len(req.raw))
+	prefix = append(prefix, socks5NoAuthGreeting...)
+	prefix = append(prefix, req.raw...)
+
+	return &socks5ReplayConn{
+		Conn:   conn,
+		reader: reader,
+		prefix: prefix,
+		skip:   2,
+	}
+}
+
+func (c *socks5ReplayConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+
+	if c.reader != nil && c.reader.Buffered() > 0 {
+		return c.reader.Read(p)
+	}
+
+	return c.Conn.Read(p)
+}
+
+func (c *socks5ReplayConn) Write(p []byte) (int, error) {
+	total := len(p)
+
+	if c.skip > 0 {
+		n := min(c.skip, len(p))
+		c.skip -= n
+		p = p[n:]
+
+		if len(p) == 0 {
+			return total, nil
+		}
+	}
+
+	n, err := c.Conn.Write(p)
+	return n + total - len(p), err
+}
+
+func (c *socks5ReplayConn) CloseWrite() error {
+	tryCloseWrite(c.Conn)
+	return nil
+}
+
+// authLocalSocks5User 完成 RFC 1929 用户名/密码子协商。
+func authLocalSocks5User(conn net.Conn, reader *bufio.Reader, users []LocalUser) error {
+	var ver [1]byte
+
+	if _, err := io.ReadFull(reader, ver[:]); err != nil {
+		return err
+	}
+
+	if ver[0] != 0x01 {
+		return errors.New("invalid socks5 auth version")
+	}
+
+	username, err := readSocks5AuthField(reader)
+	if err != nil {
+		return err
+	}
+
+	password, err := readSocks5AuthField(reader)
+	if err != nil {
+		return err
+	}
+
+	if !localUserAllowed(users, username, password) {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return errors.New("socks5 auth failed for user " + username)
+	}
+
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+func readSocks5AuthField(reader *bufio.Reader) (string, error) {
+	l, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	field := make([]byte, int(l))
+
+	if _, err := io.ReadFull(reader, field); err != nil {
+		return "", err
+	}
+
+	return string(field), nil
+}
+
+// peekLocalHTTPRequest 解析本地 HTTP 代理请求头用于认证与分流。
+// 只 Peek 请求头，不消费任何字节，之后请求仍可原样透传给服务端。
+func peekLocalHTTPRequest(reader *bufio.Reader) (*http.Request, error) {
+	header, err := peekHTTPHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+}
+
+// authLocalHTTPRequest 检查 HTTP 代理请求的 Proxy-Authorization。
+func authLocalHTTPRequest(req *http.Request, users []LocalUser) error {
+	username, password, ok := parseProxyBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok || !localUserAllowed(users, username, password) {
+		return errors.New("http proxy auth failed for user " + username)
+	}
+
+	return nil
+}
+
+func parseProxyBasicAuth(v string) (string, string, bool) {
+	if v == "" {
+		return "", "", false
+	}
+
+	// 复用 net/http 的 Basic 解析。
+	req := http.Request{Header: http.Header{"Authorization": []string{v}}}
+	return req.BasicAuth()
+}
+
+// peekHTTPHeader 返回 reader 中完整的 HTTP 请求头（含结尾空行），不消费数据。
+func peekHTTPHeader(reader *bufio.Reader) ([]byte, error) {
+	n := 1
+
+	for {
+		buf, err := reader.Peek(n)
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			return buf[:i+4], nil
+		}
+
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, errors.New("http header too large")
+			}
+			return nil, err
+		}
+
+		n = reader.Buffered() + 1
+	}
+}
+
+func localUserAllowed(users []LocalUser, username, password string) bool {
+	allowed := 0
+
+	for _, u := range users {
+		userOK := subtle.ConstantTimeCompare([]byte(u.Username), []byte(username))
+		passOK := subtle.ConstantTimeCompare([]byte(u.Password), []byte(password))
+		allowed |= userOK & passOK
+	}
+
+	return allowed == 1
+}
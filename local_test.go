@@ -0,0 +1,236 @@
+package csocks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// recordConn 记录写给本地客户端的应答。
+type recordConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func socks5AuthRequest(username, password string) []byte {
+	b := []byte{0x01, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	return append(b, password...)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadLocalSocks5Request(t *testing.T) {
+	users := []LocalUser{{Username: "alice", Password: "secret"}}
+	connect := []byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		users   []LocalUser
+		address string
+		written []byte
+		wantErr bool
+	}{
+		{
+			name:    "no auth",
+			input:   concatBytes([]byte{0x05, 0x01, 0x00}, connect),
+			address: "127.0.0.1:80",
+			written: []byte{0x05, 0x00},
+		},
+		{
+			name:    "password auth",
+			input:   concatBytes([]byte{0x05, 0x02, 0x00, 0x02}, socks5AuthRequest("alice", "secret"), connect),
+			users:   users,
+			address: "127.0.0.1:80",
+			written: []byte{0x05, 0x02, 0x01, 0x00},
+		},
+		{
+			name:    "wrong password",
+			input:   concatBytes([]byte{0x05, 0x01, 0x02}, socks5AuthRequest("alice", "guess"), connect),
+			users:   users,
+			written: []byte{0x05, 0x02, 0x01, 0x01},
+			wantErr: true,
+		},
+		{
+			name:    "no auth offered when users are set",
+			input:   concatBytes([]byte{0x05, 0x01, 0x00}, connect),
+			users:   users,
+			written: []byte{0x05, 0xff},
+			wantErr: true,
+		},
+		{
+			name:    "only password offered without users",
+			input:   concatBytes([]byte{0x05, 0x01, 0x02}, connect),
+			written: []byte{0x05, 0xff},
+			wantErr: true,
+		},
+		{name: "socks4", input: []byte{0x04, 0x01, 0x00, 0x50, 127, 0, 0, 1, 0x00}, wantErr: true},
+		{name: "zero methods", input: []byte{0x05, 0x00}, wantErr: true},
+		{name: "truncated greeting", input: []byte{0x05}, wantErr: true},
+		{name: "truncated methods", input: []byte{0x05, 0x03, 0x00}, wantErr: true},
+		{
+			name:    "bad request version",
+			input:   concatBytes([]byte{0x05, 0x01, 0x00}, []byte{0x04, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50}),
+			written: []byte{0x05, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported address type",
+			input:   concatBytes([]byte{0x05, 0x01, 0x00}, []byte{0x05, 0x01, 0x00, 0x02, 127, 0, 0, 1, 0x00, 0x50}),
+			written: []byte{0x05, 0x00, 0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "truncated request",
+			input:   concatBytes([]byte{0x05, 0x01, 0x00}, connect[:6]),
+			written: []byte{0x05, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "truncated auth",
+			input:   []byte{0x05, 0x01, 0x02, 0x01, 0x05, 'a', 'l'},
+			users:   users,
+			written: []byte{0x05, 0x02},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordConn{}
+
+			req, err := readLocalSocks5Request(conn, bufio.NewReader(bytes.NewReader(tt.input)), tt.users)
+
+			if !bytes.Equal(conn.out.Bytes(), tt.written) {
+				t.Fatalf("written = % x, want % x", conn.out.Bytes(), tt.written)
+			}
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readLocalSocks5Request = %+v; want an error", req)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.Command != 0x01 || req.Address != tt.address || !bytes.Equal(req.raw, connect) {
+				t.Fatalf("request = %+v, want CONNECT %s with raw % x", req, tt.address, connect)
+			}
+		})
+	}
+}
+
+func TestAuthLocalSocks5User(t *testing.T) {
+	long := strings.Repeat("x", 255)
+	users := []LocalUser{{Username: "alice", Password: "secret"}, {Username: long, Password: long}}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		written []byte
+		wantErr bool
+	}{
+		{name: "valid", input: socks5AuthRequest("alice", "secret"), written: []byte{0x01, 0x00}},
+		{name: "max length fields", input: socks5AuthRequest(long, long), written: []byte{0x01, 0x00}},
+		{name: "wrong password", input: socks5AuthRequest("alice", "secreT"), written: []byte{0x01, 0x01}, wantErr: true},
+		{name: "unknown user", input: socks5AuthRequest("bob", "secret"), written: []byte{0x01, 0x01}, wantErr: true},
+		{name: "password of another user", input: socks5AuthRequest("alice", long), written: []byte{0x01, 0x01}, wantErr: true},
+		{name: "empty fields", input: socks5AuthRequest("", ""), written: []byte{0x01, 0x01}, wantErr: true},
+		{name: "bad version", input: append([]byte{0x05}, socks5AuthRequest("alice", "secret")[1:]...), wantErr: true},
+		{name: "empty", input: nil, wantErr: true},
+		{name: "missing username length", input: []byte{0x01}, wantErr: true},
+		{name: "truncated username", input: []byte{0x01, 0x05, 'a', 'l'}, wantErr: true},
+		{name: "missing password", input: []byte{0x01, 0x05, 'a', 'l', 'i', 'c', 'e'}, wantErr: true},
+		{name: "truncated password", input: concatBytes([]byte{0x01, 0x05}, []byte("alice"), []byte{0x06, 's'}), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordConn{}
+
+			err := authLocalSocks5User(conn, bufio.NewReader(bytes.NewReader(tt.input)), users)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("authLocalSocks5User error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !bytes.Equal(conn.out.Bytes(), tt.written) {
+				t.Fatalf("written = % x, want % x", conn.out.Bytes(), tt.written)
+			}
+		})
+	}
+}
+
+func TestPeekHTTPHeader(t *testing.T) {
+	const header = "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+
+	tests := []struct {
+		name    string
+		input   string
+		size    int
+		slow    bool
+		want    string
+		wantErr error
+	}{
+		{name: "header only", input: header, want: header},
+		{name: "header and body", input: header + "\x16\x03\x01payload", want: header},
+		{name: "one byte at a time", input: header + "body", slow: true, want: header},
+		{name: "empty", input: "", wantErr: io.EOF},
+		{name: "truncated", input: header[:len(header)-2], wantErr: io.EOF},
+		{name: "bare newlines", input: "GET / HTTP/1.1\n\n", wantErr: io.EOF},
+		{name: "too large", input: header[:20] + strings.Repeat("a", 64) + "\r\n\r\n", size: 32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = strings.NewReader(tt.input)
+			if tt.slow {
+				r = iotest.OneByteReader(r)
+			}
+
+			size := tt.size
+			if size == 0 {
+				size = 4096
+			}
+			reader := bufio.NewReaderSize(r, size)
+
+			got, err := peekHTTPHeader(reader)
+
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("peekHTTPHeader = %q; want an error", got)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("peekHTTPHeader error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("peekHTTPHeader = %q, %v; want %q", got, err, tt.want)
+			}
+
+			// 请求头只被 Peek，之后仍可以从 reader 原样读到全部数据。
+			rest, err := io.ReadAll(reader)
+			if err != nil || string(rest) != tt.input {
+				t.Fatalf("data after peek = %q, %v; want %q", rest, err, tt.input)
+			}
+		})
+	}
+}
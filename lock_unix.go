@@ -0,0 +1,22 @@
+//go:build !windows
+
+package csocks
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile 对 f 加排他锁，阻塞直到拿到锁。
+func lockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -9,36 +9,38 @@ import (
 type customLogger struct {
 	*log.Logger
 	quiet bool
+	sink  *logSink
 }
 
-func newCustomLogger() *customLogger {
+func newCustomLogger(quiet bool, sink *logSink) *customLogger {
 	return &customLogger{
 		Logger: log.New(os.Stdout, "[csocks] ", log.LstdFlags),
-		quiet:  false,
+		quiet:  quiet,
+		sink:   sink,
 	}
 }
 
 func (cl *customLogger) Println(v ...interface{}) {
 	cl.Logger.Println(v...)
-	emitToSink(stringsTrimRightNewline(fmt.Sprintln(v...)))
+	cl.sink.emit(stringsTrimRightNewline(fmt.Sprintln(v...)))
 }
 
 func (cl *customLogger) Printf(format string, v ...interface{}) {
 	cl.Logger.Printf(format, v...)
-	emitToSink(fmt.Sprintf(format, v...))
+	cl.sink.emit(fmt.Sprintf(format, v...))
 }
 
 func (cl *customLogger) PrintlnX(v ...interface{}) {
 	if !cl.quiet {
 		cl.Logger.Println(v...)
-		emitToSink(stringsTrimRightNewline(fmt.Sprintln(v...)))
+		cl.sink.emit(stringsTrimRightNewline(fmt.Sprintln(v...)))
 	}
 }
 
 func (cl *customLogger) PrintfX(format string, v ...interface{}) {
 	if !cl.quiet {
 		cl.Logger.Printf(format, v...)
-		emitToSink(fmt.Sprintf(format, v...))
+		cl.sink.emit(fmt.Sprintf(format, v...))
 	}
 }
 
@@ -6,25 +6,42 @@ type LogSink interface {
 	OnLog(line string)
 }
 
-var (
-	sinkMu   sync.RWMutex
-	sink     LogSink
-	sinkOnce sync.Once
-	sinkCh   chan string
-)
+// logSink 把日志异步交给 LogSink，每个 Server / Client 各有一个，StartServer 使用包级的 defaultLogSink。
+type logSink struct {
+	mu   sync.RWMutex
+	sink LogSink
+	once sync.Once
+	ch   chan string
+}
+
+var defaultLogSink = &logSink{}
 
+// SetLogSink 设置 StartServer 启动的实例使用的日志回调。
 func SetLogSink(s LogSink) {
-	sinkMu.Lock()
-	sink = s
-	sinkMu.Unlock()
+	defaultLogSink.set(s)
+}
+
+func (d *logSink) set(s LogSink) {
+	d.mu.Lock()
+	d.sink = s
+	d.mu.Unlock()
+
+	if s == nil {
+		return
+	}
+
+	d.once.Do(func() {
+		ch := make(chan string, 512) // 缓冲可按需调大/调小
+
+		d.mu.Lock()
+		d.ch = ch
+		d.mu.Unlock()
 
-	sinkOnce.Do(func() {
-		sinkCh = make(chan string, 512) // 缓冲可按需调大/调小
 		go func() {
-			for line := range sinkCh {
-				sinkMu.RLock()
-				cur := sink
-				sinkMu.RUnlock()
+			for line := range ch {
+				d.mu.RLock()
+				cur := d.sink
+				d.mu.RUnlock()
 				if cur != nil {
 					func() {
 						defer func() { _ = recover() }()
@@ -36,16 +53,17 @@ func SetLogSink(s LogSink) {
 	})
 }
 
-func emitToSink(line string) {
-	sinkMu.RLock()
-	hasSink := sink != nil
-	sinkMu.RUnlock()
-	if !hasSink || sinkCh == nil {
+func (d *logSink) emit(line string) {
+	d.mu.RLock()
+	hasSink := d.sink != nil
+	ch := d.ch
+	d.mu.RUnlock()
+	if !hasSink || ch == nil {
 		return
 	}
 
 	select {
-	case sinkCh <- line:
+	case ch <- line:
 	default:
 		// drop：避免日志风暴阻塞业务
 	}
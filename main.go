@@ -2,54 +2,238 @@ package csocks
 
 import (
 	"context"
-	"errors"
-)
-
-var (
-	logger *customLogger
+	"crypto/ed25519"
+	"io/fs"
 )
 
+// ListenConfig 的字段可以直接在代码中设置，也可以通过 LoadConfigFile 从 JSON / YAML / TOML 文件加载。
 type ListenConfig struct {
-	ListenPort     string
-	ServerAddress  string
-	ServerCertFile string
-	ServerKeyFile  string
-	Secret         string
-	WithHttp       bool
-	PublicKeyFile  string
+	// Version 是配置文件格式版本，从文件加载时必须等于 ConfigVersion。
+	Version int `json:"version" yaml:"version" toml:"version"`
+
+	// ConfigFile 记录加载配置的文件路径，由 LoadConfigFile 设置。
+	ConfigFile string `json:"-" yaml:"-" toml:"-"`
+
+	ListenPort     string `json:"listen_port" yaml:"listen_port" toml:"listen_port"`
+	ServerAddress  string `json:"server_address" yaml:"server_address" toml:"server_address"`
+	ServerCertFile string `json:"server_cert_file" yaml:"server_cert_file" toml:"server_cert_file"`
+	ServerKeyFile  string `json:"server_key_file" yaml:"server_key_file" toml:"server_key_file"`
+	// Secret 是 HMAC 共享密钥，没有默认值。服务端只有设置了 Secret 才接受不带 KeyID 的请求（用户名 default）；
+	// 只使用 Users / 公钥 / 客户端证书时留空即可关闭这条路径。
+	Secret        string `json:"secret" yaml:"secret" toml:"secret"`
+	WithHttp      bool   `json:"with_http" yaml:"with_http" toml:"with_http"`
+	PublicKeyFile string `json:"public_key_file" yaml:"public_key_file" toml:"public_key_file"`
+
+	// GenerateCert 为 true 时，服务端启动（或热加载）时 ServerCertFile 与 ServerKeyFile 都不存在，
+	// 就按 CertOptions 生成私钥与自签名证书；之后和已有证书一样把公钥写到 PublicKeyFile。
+	GenerateCert bool        `json:"generate_cert" yaml:"generate_cert" toml:"generate_cert"`
+	CertOptions  CertOptions `json:"cert_options" yaml:"cert_options" toml:"cert_options"`
+
+	// ClientCAFile 非空时服务端启用 mTLS：客户端出示由这些 CA 签发的证书即通过认证，不需要 HMAC 签名，
+	// 用户名按 ClientCertIdentity 取证书的 Subject CommonName（cn，默认）或公钥 SHA-256 的十六进制（spki）。
+	// 没有证书或证书已吊销的连接仍可以用 HMAC 签名认证（只在显式设置了 Secret 或 Users 时），
+	// 也就是说吊销证书不会阻止同一客户端用 HMAC 密钥接入；RequireClientCert 为 true 时只接受证书。
+	// ClientCRLFile（PEM 或 DER）与 ClientDenySPKI（公钥 SHA-256 的十六进制）用于吊销证书。
+	ClientCAFile       string   `json:"client_ca_file" yaml:"client_ca_file" toml:"client_ca_file"`
+	ClientCertIdentity string   `json:"client_cert_identity" yaml:"client_cert_identity" toml:"client_cert_identity"`
+	RequireClientCert  bool     `json:"require_client_cert" yaml:"require_client_cert" toml:"require_client_cert"`
+	ClientCRLFile      string   `json:"client_crl_file" yaml:"client_crl_file" toml:"client_crl_file"`
+	ClientDenySPKI     []string `json:"client_deny_spki" yaml:"client_deny_spki" toml:"client_deny_spki"`
+
+	// ClientCertFile / ClientKeyFile 是 forward 端向服务端出示的客户端证书（mTLS）。
+	ClientCertFile string `json:"client_cert_file" yaml:"client_cert_file" toml:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file" yaml:"client_key_file" toml:"client_key_file"`
+
+	// AuthorizedKeysFile 是服务端的 Ed25519 公钥表，每行 "ed25519 <base64 公钥> <用户名>"，热加载时重新读取。
+	// 客户端用 AuthKeyFile 中的私钥签名，服务端只保存公钥。用户名在 Users 中时遵守它的禁用与过期设置。
+	// AuthKeyFile 是 forward 端的 Ed25519 私钥（PKCS#8 PEM），设置后代替 Secret / KeyID 签名隧道请求。
+	// 密钥由 GenerateAuthKey / WriteAuthKey 或 csocks-keygen -auth-key 生成。
+	AuthorizedKeysFile string `json:"authorized_keys_file" yaml:"authorized_keys_file" toml:"authorized_keys_file"`
+	AuthKeyFile        string `json:"auth_key_file" yaml:"auth_key_file" toml:"auth_key_file"`
+
+	// LocalUsers 非空时，forward 端本地监听要求 SOCKS5 用户名/密码认证（RFC 1929）
+	// 或 HTTP Proxy-Authorization: Basic。
+	LocalUsers []LocalUser `json:"local_users" yaml:"local_users" toml:"local_users"`
+
+	// Users 是服务端的多用户密钥表，客户端通过 KeyID 选择用哪个用户的密钥签名。
+	// 不带 KeyID 的客户端只有在服务端显式设置了 Secret 时才被接受，用户名记为 default。
+	Users []TunnelUser `json:"users" yaml:"users" toml:"users"`
+	KeyID string       `json:"key_id" yaml:"key_id" toml:"key_id"`
+
+	// ACL 在服务端拨号前按顺序匹配；没有规则命中时使用 ACLDefault（allow / deny，默认 allow）。
+	// 私有、回环、链路本地等地址默认拒绝，除非设置 AllowPrivateTargets，或命中的 allow 规则的 CIDRs 包含该地址
+	// （只按用户、端口或域名命中的 allow 规则不放行私有地址）。
+	ACL                 []ACLRule `json:"acl" yaml:"acl" toml:"acl"`
+	ACLDefault          string    `json:"acl_default" yaml:"acl_default" toml:"acl_default"`
+	AllowPrivateTargets bool      `json:"allow_private_targets" yaml:"allow_private_targets" toml:"allow_private_targets"`
+
+	// FallbackURL 非空时，服务端把不是隧道的 HTTP/1.1 与 h2 请求（包括 WebSocket 升级）反向代理到该地址，
+	// 例如 "http://127.0.0.1:8080" 或 "unix:/run/site.sock"；为空时返回内置页面。
+	FallbackURL string `json:"fallback_url" yaml:"fallback_url" toml:"fallback_url"`
+
+	// FallbackDir 非空时，服务端把不是隧道的请求当作普通网站，用该目录提供静态文件（index.html、404.html）。
+	// 嵌入使用时也可以设置 FallbackFS（例如 embed.FS），优先于 FallbackDir。不能与 FallbackURL 同时使用。
+	FallbackDir string `json:"fallback_dir" yaml:"fallback_dir" toml:"fallback_dir"`
+	FallbackFS  fs.FS  `json:"-" yaml:"-" toml:"-"`
+
+	// RouteRules 与 RouteRuleFiles 决定 forward 端每个连接走隧道（tunnel）、直连（direct）
+	// 还是拒绝（block）。先匹配 RouteRules，再按顺序匹配各规则文件；未命中时使用 RouteDefault。
+	// BIND 按 DST.ADDR 分流，UDP ASSOCIATE 按每个数据报的目标地址分流。
+	// 规则文件修改后会自动重新加载。
+	RouteRules     []RouteRule `json:"route_rules" yaml:"route_rules" toml:"route_rules"`
+	RouteRuleFiles []string    `json:"route_rule_files" yaml:"route_rule_files" toml:"route_rule_files"`
+	RouteDefault   string      `json:"route_default" yaml:"route_default" toml:"route_default"`
+
+	// Servers 配置多个上游服务端，为空时使用 ServerAddress / PublicKeyFile。
+	// ServerStrategy 决定如何选择：failover（默认，按顺序使用第一个健康的）、round-robin、
+	// least-active（活跃 stream 最少）或 lowest-latency（探测延迟最低）。
+	Servers        []UpstreamServer `json:"servers" yaml:"servers" toml:"servers"`
+	ServerStrategy string           `json:"server_strategy" yaml:"server_strategy" toml:"server_strategy"`
+
+	// ForwardProtocol 是客户端到服务端使用的隧道协议：auto（默认，同时探测 HTTP/3 与 h2，再依次尝试 HTTP/1.1 Upgrade、WebSocket）、
+	// h3、h2、http1 或 websocket。websocket 使用标准的 RFC 6455 握手与帧，可以经过 CDN 与反向代理。
+	ForwardProtocol string `json:"forward_protocol" yaml:"forward_protocol" toml:"forward_protocol"`
+
+	// EnableH3 为 true 时服务端同时在 ListenPort 的 UDP 端口提供 HTTP/3（QUIC）隧道，热加载不会改变它。
+	EnableH3 bool `json:"enable_h3" yaml:"enable_h3" toml:"enable_h3"`
+
+	// MetricsListen 非空时在该地址的 /metrics 以 Prometheus 文本格式输出指标，例如 "127.0.0.1:9100"。
+	// 热加载不会改变它。
+	MetricsListen string `json:"metrics_listen" yaml:"metrics_listen" toml:"metrics_listen"`
+
+	// AdminListen 非空时在该地址提供管理接口（HTTP/JSON）：查看与关闭活跃连接、查看与清零统计、查看与解封被封禁的 IP。
+	// 请求必须带 Authorization: Bearer <AdminToken>。热加载不会改变它们。
+	AdminListen string `json:"admin_listen" yaml:"admin_listen" toml:"admin_listen"`
+	AdminToken  string `json:"admin_token" yaml:"admin_token" toml:"admin_token"`
+
+	// DrainTimeout 是停止时等待活跃连接结束的最长时间：停止接受新连接，服务端 h2 连接发送 GOAWAY，
+	// 超时后关闭剩余连接。为 0 时 StartServer 在 ctx 结束后立即关闭所有连接。
+	DrainTimeout Duration `json:"drain_timeout" yaml:"drain_timeout" toml:"drain_timeout"`
+
+	// NoSignalReload 为 true 时不监听 SIGHUP，只能通过 Reload 热加载。
+	// Server / Client 只有设置了 SignalReload 才监听。
+	NoSignalReload bool `json:"no_signal_reload" yaml:"no_signal_reload" toml:"no_signal_reload"`
+
+	// 以下为调优参数，零值表示使用默认值。
+
+	// Timeout 是握手、拨号与探测的超时，默认 10s。
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+
+	// IdleTimeout 是转发连接双向都没有数据时的关闭时间，默认 60s。
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+
+	// TunnelPath 是隧道请求使用的 URL 路径，两端必须一致，默认 /assets/update。
+	// TunnelPaths 是服务端另外接受的路径，用于把客户端逐步迁移到新的 TunnelPath。路径包含在签名中。
+	TunnelPath  string   `json:"tunnel_path" yaml:"tunnel_path" toml:"tunnel_path"`
+	TunnelPaths []string `json:"tunnel_paths" yaml:"tunnel_paths" toml:"tunnel_paths"`
+
+	// UpgradeToken 是 HTTP/1.1 隧道请求的 Upgrade 头，两端必须一致，默认 websocket。
+	UpgradeToken string `json:"upgrade_token" yaml:"upgrade_token" toml:"upgrade_token"`
+
+	// TunnelHeaders 是隧道认证使用的请求头名称，两端必须一致，未设置的使用默认值。
+	TunnelHeaders TunnelHeaders `json:"tunnel_headers" yaml:"tunnel_headers" toml:"tunnel_headers"`
+
+	// ReplayCacheSize 是服务端防重放缓存最多记录的 nonce 数，默认 1048576。缓存满且没有过期记录可以淘汰时，
+	// 新的隧道请求会被拒绝（而不是忘记仍有效的 nonce）。
+	ReplayCacheSize int `json:"replay_cache_size" yaml:"replay_cache_size" toml:"replay_cache_size"`
+
+	// NonceStoreFile 非空时服务端把已使用的 nonce 同时记录到这个文件，重启后仍能拒绝有效期内的重放；
+	// 同一台机器上的多个服务端可以共用一个文件，每次检查都在文件锁下读入对方的记录。
+	// 嵌入使用时也可以设置 NonceStore（例如基于 Redis 的实现），优先于 NonceStoreFile，由调用方负责关闭。
+	// 两者都不能热加载更换。
+	NonceStoreFile string     `json:"nonce_store_file" yaml:"nonce_store_file" toml:"nonce_store_file"`
+	NonceStore     NonceStore `json:"-" yaml:"-" toml:"-"`
+
+	// Ban 是服务端按来源 IP 的失败计数与临时封禁，见 BanConfig。
+	Ban BanConfig `json:"ban" yaml:"ban" toml:"ban"`
+
+	// MaxH2Streams 是单个 h2 连接上的并发 stream 上限，服务端与 forward 端都使用，默认 64。
+	MaxH2Streams int `json:"max_h2_streams" yaml:"max_h2_streams" toml:"max_h2_streams"`
+
+	// 服务端 h2 连接参数：空闲关闭时间（默认 30s）、每连接与每 stream 的上传窗口（默认 1MiB / 256KiB）。
+	H2IdleTimeout                  Duration `json:"h2_idle_timeout" yaml:"h2_idle_timeout" toml:"h2_idle_timeout"`
+	H2MaxUploadBufferPerConnection int32    `json:"h2_max_upload_buffer_per_connection" yaml:"h2_max_upload_buffer_per_connection" toml:"h2_max_upload_buffer_per_connection"`
+	H2MaxUploadBufferPerStream     int32    `json:"h2_max_upload_buffer_per_stream" yaml:"h2_max_upload_buffer_per_stream" toml:"h2_max_upload_buffer_per_stream"`
+
+	// authKey 是 forward 端从 AuthKeyFile 读取的私钥，由 newUpstreamPool 设置在每个服务端的配置副本上。
+	authKey ed25519.PrivateKey
+}
+
+// TunnelHeaders 是隧道认证请求头的名称。
+type TunnelHeaders struct {
+	SessionID   string `json:"session_id" yaml:"session_id" toml:"session_id"`       // 默认 X-Session-Id
+	RequestTime string `json:"request_time" yaml:"request_time" toml:"request_time"` // 默认 X-Request-Time
+	Signature   string `json:"signature" yaml:"signature" toml:"signature"`          // 默认 X-Request-Signature
+	KeyID       string `json:"key_id" yaml:"key_id" toml:"key_id"`                   // 默认 X-Key-Id
+}
+
+type LocalUser struct {
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
 }
 
 func NewListenConfig() *ListenConfig {
 	return &ListenConfig{
+		Version:        ConfigVersion,
 		ListenPort:     "1080",
 		ServerAddress:  "",
 		ServerCertFile: "",
 		ServerKeyFile:  "",
-		Secret:         "anonymous",
 		WithHttp:       false,
 		PublicKeyFile:  "",
+		KeyID:          "",
+		ACLDefault:     "allow",
+		RouteDefault:   "tunnel",
+		ServerStrategy: ServerStrategyFailover,
+
+		Timeout:                        Duration(defaultTimeout),
+		IdleTimeout:                    Duration(defaultIdleTimeout),
+		TunnelPath:                     defaultTunnelPath,
+		UpgradeToken:                   defaultUpgradeToken,
+		MaxH2Streams:                   defaultMaxH2Streams,
+		H2IdleTimeout:                  Duration(defaultH2IdleTimeout),
+		H2MaxUploadBufferPerConnection: defaultH2MaxUploadBufferPerConnection,
+		H2MaxUploadBufferPerStream:     defaultH2MaxUploadBufferPerStream,
 	}
 }
 
+// StartServer 启动服务端或 forward 端并阻塞到 ctx 结束；设置了 DrainTimeout 时还会等待活跃连接结束。
+// 启动前先调用 Validate，配置不完整或有冲突时直接返回错误（早期版本会照常启动，见 README 的“升级说明”）。
+// 它使用包级的日志回调（SetLogSink），GetTunnelStats 等函数汇总正在运行的 StartServer 实例；
+// 需要分别查看每个实例的统计、或控制 SIGHUP 监听时使用 Server / Client。
 func StartServer(ctx context.Context, listenConfig *ListenConfig, quiet bool) error {
-	logger = newCustomLogger()
-	logger.quiet = quiet
+	inst := newDefaultInstance(quiet)
 
-	logger.Printf("[*] csocks version: [%s]\n", Version)
+	inst.logger.Printf("[*] csocks version: [%s]\n", Version)
 
-	if listenConfig.ServerAddress != "" {
-		err := forward(ctx, listenConfig)
-		if err != nil {
-			return err
-		}
-	} else if listenConfig.ServerCertFile != "" {
-		err := proxy(ctx, listenConfig)
-		if err != nil {
-			return err
+	if err := listenConfig.Validate(); err != nil {
+		return err
+	}
+
+	svc, err := newService(ctx, listenConfig, inst)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
 		}
-	} else {
-		return errors.New("miss config")
+		return err
+	}
+
+	ln, err := listen(listenConfig.ListenPort)
+	if err != nil {
+		return err
+	}
+
+	force := drainContext(ctx, listenConfig.drainTimeout())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := serveSideListeners(ctx, listenConfig, inst); err != nil {
+		_ = ln.Close()
+		return err
 	}
 
-	return nil
+	registerReloader(ctx, listenConfig, svc)
+
+	return svc.serve(ctx, ln, force)
 }
@@ -0,0 +1,447 @@
+package csocks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	metricsRoleServer = "server"
+	metricsRoleClient = "client"
+
+	metricsProtocolH2        = "h2"
+	metricsProtocolH3        = "h3"
+	metricsProtocolHTTP1     = "http1"
+	metricsProtocolWebSocket = "websocket"
+	metricsProtocolDirect    = "direct"
+)
+
+var (
+	streamDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800}
+	firstByteBuckets      = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// metrics 是一个实例的 Prometheus 指标，以文本格式从 MetricsListen 输出。
+type metrics struct {
+	streams            *metricFamily[atomic.Uint64]
+	activeStreams      *metricFamily[atomic.Int64]
+	authFailures       *metricFamily[atomic.Uint64]
+	replayRejections   *metricFamily[atomic.Uint64]
+	replayCacheEntries *metricFamily[atomic.Int64]
+	bans               *metricFamily[atomic.Uint64]
+	bannedSources      *metricFamily[atomic.Int64]
+	dialFailures       *metricFamily[atomic.Uint64]
+	bytes              *metricFamily[atomic.Uint64]
+	streamDuration     *metricFamily[histogram]
+	firstByte          *metricFamily[histogram]
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		streams: newMetricFamily[atomic.Uint64](
+			"csocks_streams_total", "Tunnel streams opened.", "counter",
+			nil, "role", "protocol", "user"),
+		activeStreams: newMetricFamily[atomic.Int64](
+			"csocks_streams_active", "Tunnel streams currently open.", "gauge",
+			nil, "role", "protocol"),
+		authFailures: newMetricFamily[atomic.Uint64](
+			"csocks_auth_failures_total", "Tunnel requests rejected by authentication.", "counter",
+			nil, "reason"),
+		replayRejections: newMetricFamily[atomic.Uint64](
+			"csocks_replay_rejections_total", "Tunnel requests rejected by the replay cache: nonce already used, or cache full.", "counter",
+			nil, "reason"),
+		replayCacheEntries: newMetricFamily[atomic.Int64](
+			"csocks_replay_cache_entries", "Nonces held by the replay cache, including expired ones not yet released.", "gauge",
+			nil),
+		bans: newMetricFamily[atomic.Uint64](
+			"csocks_bans_total", "Source IPs banned after repeated failures, by the reason of the last failure.", "counter",
+			nil, "reason"),
+		bannedSources: newMetricFamily[atomic.Int64](
+			"csocks_banned_sources", "Source IPs (IPv6 /64 prefixes) currently banned.", "gauge",
+			nil),
+		dialFailures: newMetricFamily[atomic.Uint64](
+			"csocks_dial_failures_total", "Failed dials to targets (server) or upstream servers (client).", "counter",
+			nil, "role", "class", "user"),
+		bytes: newMetricFamily[atomic.Uint64](
+			"csocks_bytes_total", "Bytes relayed through tunnel streams.", "counter",
+			nil, "role", "direction", "user"),
+		streamDuration: newMetricFamily[histogram](
+			"csocks_stream_duration_seconds", "Lifetime of tunnel streams.", "histogram",
+			streamDurationBuckets, "role", "protocol"),
+		firstByte: newMetricFamily[histogram](
+			"csocks_time_to_first_byte_seconds", "Time from stream start to the first byte received from the remote side.", "histogram",
+			firstByteBuckets, "role", "protocol"),
+	}
+
+	// 固定标签的计数器从 0 开始输出。
+	m.replayRejections.with("duplicate")
+	m.replayRejections.with("cache_full")
+	m.bannedSources.with()
+
+	return m
+}
+
+func (m *metrics) authFailure(reason string) {
+	m.authFailures.with(reason).Add(1)
+}
+
+func (m *metrics) replayRejected(reason string) {
+	m.replayRejections.with(reason).Add(1)
+}
+
+func (m *metrics) dialFailure(role, user string, err error) {
+	m.dialFailures.with(role, dialErrorClass(err), metricsUser(user)).Add(1)
+}
+
+// startStream 记录一个 stream 开始，返回的 streamMetrics 在 stream 结束时调用 end。
+func (m *metrics) startStream(role, protocol, user string) *streamMetrics {
+	user = metricsUser(user)
+
+	m.streams.with(role, protocol, user).Add(1)
+
+	s := &streamMetrics{
+		m:         m,
+		role:      role,
+		protocol:  protocol,
+		start:     time.Now(),
+		active:    m.activeStreams.with(role, protocol),
+		bytesUp:   m.bytes.with(role, "up", user),
+		bytesDown: m.bytes.with(role, "down", user),
+	}
+
+	s.active.Add(1)
+
+	return s
+}
+
+func metricsUser(user string) string {
+	if user == "" {
+		return legacyTunnelUser
+	}
+	return user
+}
+
+// dialErrorClass 把拨号错误归为少量固定的类别，避免标签基数过大。
+func dialErrorClass(err error) string {
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, errAccessDenied):
+		return "acl"
+	case errors.Is(err, errTooManyH2Streams):
+		return "stream_limit"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// streamMetrics 记录单个 stream 的字节数、首字节时间与持续时间。nil 时所有方法都不做任何事。
+type streamMetrics struct {
+	m        *metrics
+	role     string
+	protocol string
+	start    time.Time
+
+	active    *atomic.Int64
+	bytesUp   *atomic.Uint64
+	bytesDown *atomic.Uint64
+
+	gotFirstByte atomic.Bool
+	ended        atomic.Bool
+
+	// session 由 beginStream 设置，字节数同时计入会话表。
+	session  *session
+	sessions *sessionRegistry
+}
+
+func (s *streamMetrics) addBytesUp(n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+
+	s.bytesUp.Add(uint64(n))
+
+	if s.session != nil {
+		s.session.bytesUp.Add(uint64(n))
+	}
+}
+
+// addBytesDown 记录从远端收到的字节，第一次调用时记录首字节时间。
+func (s *streamMetrics) addBytesDown(n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+
+	s.bytesDown.Add(uint64(n))
+
+	if s.session != nil {
+		s.session.bytesDown.Add(uint64(n))
+	}
+
+	if s.gotFirstByte.CompareAndSwap(false, true) {
+		s.m.firstByte.with(s.role, s.protocol).observe(time.Since(s.start).Seconds())
+	}
+}
+
+func (s *streamMetrics) end() {
+	if s == nil || !s.ended.CompareAndSwap(false, true) {
+		return
+	}
+
+	s.active.Add(-1)
+	s.m.streamDuration.with(s.role, s.protocol).observe(time.Since(s.start).Seconds())
+
+	if s.session != nil {
+		s.sessions.remove(s.session)
+	}
+}
+
+// setTarget 在目标地址确定后（例如读到 HTTP 请求后）更新会话表。
+func (s *streamMetrics) setTarget(target string) {
+	if s != nil && s.session != nil {
+		s.session.setTarget(target)
+	}
+}
+
+// histogram 是累积分桶的直方图，buckets 为各桶上界（不含 +Inf）。
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+// metricFamily 是同名、同标签集的一组时间序列。
+type metricFamily[T any] struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*metricSeries[T]
+}
+
+type metricSeries[T any] struct {
+	values []string
+	value  T
+}
+
+func newMetricFamily[T any](name, help, typ string, buckets []float64, labels ...string) *metricFamily[T] {
+	return &metricFamily[T]{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries[T]),
+	}
+}
+
+// with 返回标签取值为 values 的时间序列，不存在时创建。
+func (f *metricFamily[T]) with(values ...string) *T {
+	key := strings.Join(values, "\xff")
+
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+
+	if ok {
+		return &s.value
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s, ok := f.series[key]; ok {
+		return &s.value
+	}
+
+	s = &metricSeries[T]{values: slices.Clone(values)}
+
+	if h, ok := any(&s.value).(*histogram); ok {
+		h.buckets = f.buckets
+		h.counts = make([]uint64, len(f.buckets))
+	}
+
+	f.series[key] = s
+
+	return &s.value
+}
+
+func (f *metricFamily[T]) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	series := make([]*metricSeries[T], len(keys))
+	for i, k := range keys {
+		series[i] = f.series[k]
+	}
+	f.mu.RUnlock()
+
+	for _, s := range series {
+		labels := formatMetricLabels(f.labels, s.values)
+
+		switch v := any(&s.value).(type) {
+		case *atomic.Uint64:
+			fmt.Fprintf(w, "%s%s %d\n", f.name, labels, v.Load())
+
+		case *atomic.Int64:
+			fmt.Fprintf(w, "%s%s %d\n", f.name, labels, v.Load())
+
+		case *histogram:
+			v.mu.Lock()
+			for i, le := range v.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.name,
+					formatMetricLabels(append(slices.Clone(f.labels), "le"), append(slices.Clone(s.values), formatMetricFloat(le))),
+					v.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name,
+				formatMetricLabels(append(slices.Clone(f.labels), "le"), append(slices.Clone(s.values), "+Inf")),
+				v.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatMetricFloat(v.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, v.count)
+			v.mu.Unlock()
+		}
+	}
+}
+
+func formatMetricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeMetricLabel(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricLabel(s string) string {
+	return metricLabelEscaper.Replace(s)
+}
+
+func formatMetricFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeTo 以 Prometheus 文本格式输出所有指标。
+func (m *metrics) writeTo(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	m.streams.writeTo(w)
+	m.activeStreams.writeTo(w)
+	m.authFailures.writeTo(w)
+	m.replayRejections.writeTo(w)
+	m.replayCacheEntries.writeTo(w)
+	m.bans.writeTo(w)
+	m.bannedSources.writeTo(w)
+	m.dialFailures.writeTo(w)
+	m.bytes.writeTo(w)
+	m.streamDuration.writeTo(w)
+	m.firstByte.writeTo(w)
+
+	return w.Flush()
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.writeTo(w)
+}
+
+// serveMetrics 在 MetricsListen 上提供 /metrics，直到 ctx 结束。
+func serveMetrics(ctx context.Context, listenConfig *ListenConfig, inst *instance) error {
+	if listenConfig.MetricsListen == "" {
+		return nil
+	}
+
+	ln, err := listen(listenConfig.MetricsListen)
+	if err != nil {
+		return fmt.Errorf("metrics_listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", inst.metrics)
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: listenConfig.timeout(),
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	inst.logger.Printf("[*] metrics listen on: [%s]\n", ln.Addr().String())
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package csocks
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ClientCertIdentity 的可选值。
+const (
+	ClientCertIdentityCN   = "cn"
+	ClientCertIdentitySPKI = "spki"
+)
+
+// clientCertAuth 是服务端的 mTLS 配置：签发客户端证书的 CA、证书到用户名的映射与吊销列表。
+type clientCertAuth struct {
+	roots    *x509.CertPool
+	identity string
+
+	// revoked 按签发者（原始 DER 编码的 Subject）记录 CRL 中吊销的序列号。
+	revoked map[string]map[string]struct{}
+	denied  map[string]struct{}
+}
+
+// newClientCertAuth 按 ClientCAFile 等构建 mTLS 配置；未设置 ClientCAFile 时返回 nil。
+func newClientCertAuth(listenConfig *ListenConfig) (*clientCertAuth, error) {
+	if listenConfig.ClientCAFile == "" {
+		switch {
+		case listenConfig.RequireClientCert:
+			return nil, errors.New("require_client_cert: client_ca_file is required")
+		case listenConfig.ClientCRLFile != "" || len(listenConfig.ClientDenySPKI) > 0:
+			return nil, errors.New("client_crl_file / client_deny_spki: client_ca_file is required")
+		}
+		return nil, nil
+	}
+
+	identity, err := parseClientCertIdentity(listenConfig.ClientCertIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("client_cert_identity: %w", err)
+	}
+
+	cas, err := loadCertificates(listenConfig.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("client_ca_file: %w", err)
+	}
+
+	auth := &clientCertAuth{
+		roots:    x509.NewCertPool(),
+		identity: identity,
+		revoked:  make(map[string]map[string]struct{}),
+		denied:   make(map[string]struct{}),
+	}
+
+	for _, ca := range cas {
+		auth.roots.AddCert(ca)
+	}
+
+	if listenConfig.ClientCRLFile != "" {
+		if err := auth.loadCRL(listenConfig.ClientCRLFile, cas); err != nil {
+			return nil, fmt.Errorf("client_crl_file: %w", err)
+		}
+	}
+
+	for i, spki := range listenConfig.ClientDenySPKI {
+		b, err := hex.DecodeString(strings.TrimSpace(spki))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("client_deny_spki[%d]: expected a hex encoded SHA-256", i)
+		}
+		auth.denied[hex.EncodeToString(b)] = struct{}{}
+	}
+
+	return auth, nil
+}
+
+func parseClientCertIdentity(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", ClientCertIdentityCN:
+		return ClientCertIdentityCN, nil
+	case ClientCertIdentitySPKI:
+		return ClientCertIdentitySPKI, nil
+	default:
+		return "", fmt.Errorf("unknown identity %q, expected %s or %s", s, ClientCertIdentityCN, ClientCertIdentitySPKI)
+	}
+}
+
+// loadCertificates 读取 PEM 文件中的所有证书。
+func loadCertificates(name string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	return certs, nil
+}
+
+// loadCRL 读取 PEM 或 DER 编码的 CRL，CRL 必须由 cas 中的某个 CA 签发。
+func (a *clientCertAuth) loadCRL(name string, cas []*x509.Certificate) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var ders [][]byte
+
+	if block, _ := pem.Decode(data); block == nil {
+		ders = append(ders, data)
+	} else {
+		for block != nil {
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+			block, data = pem.Decode(data)
+		}
+	}
+
+	if len(ders) == 0 {
+		return errors.New("no CRL found")
+	}
+
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return err
+		}
+
+		var issuer *x509.Certificate
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				issuer = ca
+				break
+			}
+		}
+
+		if issuer == nil {
+			return errors.New("CRL is not signed by any certificate in client_ca_file")
+		}
+
+		serials := a.revoked[string(issuer.RawSubject)]
+		if serials == nil {
+			serials = make(map[string]struct{})
+			a.revoked[string(issuer.RawSubject)] = serials
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// clientCertUser 返回已验证的客户端证书对应的用户名。没有证书、证书已吊销，
+// 或映射到的用户在 Users 中被禁用 / 已过期时返回 false。
+// 吊销在每个请求上检查，热加载更新 CRL 后已建立的连接也立即生效。
+func (r *proxyRuntime) clientCertUser(state *tls.ConnectionState) (string, bool) {
+	auth := r.clientAuth
+	if auth == nil || state == nil || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	spki := hex.EncodeToString(sum[:])
+
+	if _, ok := auth.denied[spki]; ok {
+		return "", false
+	}
+
+	for _, chain := range state.VerifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			if _, ok := auth.revoked[string(chain[i+1].RawSubject)][chain[i].SerialNumber.String()]; ok {
+				return "", false
+			}
+		}
+	}
+
+	name := spki
+	if auth.identity == ClientCertIdentityCN {
+		name = strings.TrimSpace(cert.Subject.CommonName)
+	}
+
+	if name == "" {
+		return "", false
+	}
+
+	if !r.userActive(name) {
+		return "", false
+	}
+
+	return name, true
+}
+
+// loadClientCertificate 读取 forward 端的客户端证书；未设置 ClientCertFile 时返回 nil。
+func loadClientCertificate(listenConfig *ListenConfig) (*tls.Certificate, error) {
+	if listenConfig.ClientCertFile == "" && listenConfig.ClientKeyFile == "" {
+		return nil, nil
+	}
+
+	if listenConfig.ClientCertFile == "" || listenConfig.ClientKeyFile == "" {
+		return nil, errors.New("client_cert_file and client_key_file must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(listenConfig.ClientCertFile, listenConfig.ClientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("client_cert_file: %w", err)
+	}
+
+	return &cert, nil
+}
@@ -0,0 +1,335 @@
+package csocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NonceStore 记录隧道请求中已使用的 nonce，用于防重放。默认使用进程内的缓存，
+// 可以通过 ListenConfig.NonceStoreFile 换成文件存储，或通过 ListenConfig.NonceStore 使用自己的实现。
+type NonceStore interface {
+	// SeenOrAdd 在 nonce 仍在有效期内已记录过时返回 true，否则记录它，ttl 之后过期。
+	// 返回错误时请求被拒绝。
+	SeenOrAdd(nonce string, ttl time.Duration) (bool, error)
+}
+
+const (
+	nonceStoreCompactInterval = time.Second
+
+	// 文件超过这个大小时，每个 replayWindow 最多重写一次，去掉过期的记录。
+	nonceStoreCompactSize = 1 << 20
+)
+
+var errNonceStoreClosed = errors.New("nonce store is closed")
+
+// fileNonceStore 在内存缓存之外把 nonce 记录到文件，服务端重启后重新加载仍在有效期内的记录，
+// 同一台机器上的多个服务端进程可以共用一个文件。
+//
+// 文件每行是 "<过期时间 Unix 秒> <nonce 的 SHA-256 前 16 字节>"，只追加。每次 SeenOrAdd 都持有 <path>.lock 上的文件锁，
+// 先读入其他进程追加的记录再检查，没有见过时立即追加，因此进程之间不存在重放的时间窗口。
+// 定期任务只负责压缩：写新文件再改名，其他进程发现文件被替换后从头重新读取。
+type fileNonceStore struct {
+	path   string
+	cache  *nonceReplayCache
+	logger *customLogger
+
+	// 文件锁只在进程之间互斥，进程内由 mu 保证同一时间只有一个调用者读写文件。
+	mu          sync.Mutex
+	closed      bool
+	lockFile    *os.File
+	file        *os.File
+	offset      int64
+	compactedAt time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newFileNonceStore 打开（或创建）path，并加载仍在有效期内的记录。
+func newFileNonceStore(path string, cache *nonceReplayCache, logger *customLogger) (*fileNonceStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	lockFile, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileNonceStore{
+		path:     path,
+		cache:    cache,
+		logger:   logger,
+		lockFile: lockFile,
+		done:     make(chan struct{}),
+	}
+
+	if err := s.locked(s.sync); err != nil {
+		// 文件中有效的记录比缓存能容纳的多：照常启动，剩余的记录在缓存有空间后读入，在此之前请求被拒绝。
+		if !errors.Is(err, errReplayCacheFull) {
+			_ = lockFile.Close()
+			return nil, err
+		}
+
+		logger.Printf("[x] nonce store [%s] has more records than the replay cache holds, requests are rejected until they expire\n", path)
+	}
+
+	return s, nil
+}
+
+func nonceStoreKey(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (s *fileNonceStore) SeenOrAdd(nonce string, ttl time.Duration) (bool, error) {
+	key := nonceStoreKey(nonce)
+
+	var seen bool
+
+	err := s.locked(func() error {
+		if err := s.sync(); err != nil {
+			return err
+		}
+
+		var err error
+		if seen, err = s.cache.SeenOrAdd(key, ttl); seen || err != nil {
+			return err
+		}
+
+		line := fmt.Appendf(nil, "%d %s\n", time.Now().Add(ttl).Unix()+1, key)
+
+		n, err := s.file.WriteAt(line, s.offset)
+		s.offset += int64(n)
+
+		return err
+	})
+
+	return seen, err
+}
+
+func (s *fileNonceStore) setSize(size int) {
+	s.cache.setSize(size)
+}
+
+// locked 在进程内的锁与文件锁下执行 fn。
+func (s *fileNonceStore) locked(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errNonceStoreClosed
+	}
+
+	if err := lockFile(s.lockFile); err != nil {
+		return err
+	}
+	defer unlockFile(s.lockFile)
+
+	return fn()
+}
+
+// run 定期检查是否需要压缩，直到 close。
+func (s *fileNonceStore) run(ctx context.Context) {
+	ticker := time.NewTicker(nonceStoreCompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.maybeCompact(); err != nil {
+				s.logger.Printf("[x] nonce store [%s] compact failed: [%s]\n", s.path, err.Error())
+			}
+		}
+	}
+}
+
+// close 停止定期压缩并关闭文件。记录已在 SeenOrAdd 中写出，没有需要刷新的内容。
+func (s *fileNonceStore) close() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.file != nil {
+			err = s.file.Close()
+		}
+		_ = s.lockFile.Close()
+		s.closed = true
+	})
+
+	return err
+}
+
+// maybeCompact 在文件超过 nonceStoreCompactSize、且距上次压缩已超过 replayWindow 时压缩文件。
+func (s *fileNonceStore) maybeCompact() error {
+	err := s.locked(func() error {
+		if err := s.sync(); err != nil {
+			return err
+		}
+
+		if s.offset > nonceStoreCompactSize && time.Since(s.compactedAt) >= replayWindow {
+			return s.compact()
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, errNonceStoreClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// sync 打开当前的文件（被其他进程压缩替换后重新打开），读入 offset 之后的记录。
+func (s *fileNonceStore) sync() error {
+	if s.file != nil {
+		cur, err := os.Stat(s.path)
+		opened, err2 := s.file.Stat()
+
+		if err != nil || err2 != nil || !os.SameFile(cur, opened) {
+			_ = s.file.Close()
+			s.file = nil
+		}
+	}
+
+	if s.file == nil {
+		f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		s.file = f
+		s.offset = 0
+	}
+
+	n, err := s.load(io.NewSectionReader(s.file, s.offset, 1<<62))
+	s.offset += n
+
+	return err
+}
+
+// load 把记录加入内存缓存，返回读到的完整行的字节数；末尾不完整的行与缓存已满时未加入的行留到下次读取。
+func (s *fileNonceStore) load(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	now := time.Now()
+
+	var n int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if expiresAt, key, ok := parseNonceRecord(line); ok {
+			if ttl := time.Unix(expiresAt, 0).Sub(now); ttl > 0 {
+				// 缓存已满时不能跳过这条记录，否则它的 nonce 可以被重放。
+				if _, err := s.cache.SeenOrAdd(key, ttl); err != nil {
+					return n, err
+				}
+			}
+		}
+
+		n += int64(len(line))
+	}
+}
+
+func parseNonceRecord(line []byte) (int64, string, bool) {
+	sep := bytes.IndexByte(line, ' ')
+	if sep < 0 {
+		return 0, "", false
+	}
+
+	expiresAt, err := strconv.ParseInt(string(line[:sep]), 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	key := string(bytes.TrimSpace(line[sep+1:]))
+	if len(key) != 32 {
+		return 0, "", false
+	}
+
+	return expiresAt, key, true
+}
+
+// compact 把仍在有效期内的记录写到新文件，替换原文件。
+func (s *fileNonceStore) compact() error {
+	s.compactedAt = time.Now()
+	now := s.compactedAt.Unix()
+
+	var buf bytes.Buffer
+
+	reader := bufio.NewReader(io.NewSectionReader(s.file, 0, s.offset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if expiresAt, _, ok := parseNonceRecord(line); ok && expiresAt > now {
+			buf.Write(line)
+		}
+	}
+
+	if err := writeFileAtomic(s.path, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	_ = s.file.Close()
+	s.file = f
+	s.offset = int64(buf.Len())
+
+	return nil
+}
+
+// newNonceStore 按配置选择 nonce 存储：NonceStore、NonceStoreFile，或实例的内存缓存。
+func newNonceStore(listenConfig *ListenConfig, inst *instance) (NonceStore, error) {
+	if listenConfig.NonceStore != nil {
+		return listenConfig.NonceStore, nil
+	}
+
+	if listenConfig.NonceStoreFile == "" {
+		return inst.replay, nil
+	}
+
+	// 文件存储使用自己的内存缓存：键是 nonce 的 SHA-256，与其他进程写入的记录一致。
+	store, err := newFileNonceStore(listenConfig.NonceStoreFile, newNonceReplayCache(inst.metrics), inst.logger)
+	if err != nil {
+		return nil, fmt.Errorf("nonce_store_file: %w", err)
+	}
+
+	return store, nil
+}
+
+var _ NonceStore = (*nonceReplayCache)(nil)
@@ -0,0 +1,109 @@
+package csocks
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileNonceStore(t *testing.T, path string) *fileNonceStore {
+	t.Helper()
+
+	inst := newInstance(true, nil)
+
+	s, err := newFileNonceStore(path, newNonceReplayCache(inst.metrics), inst.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.close() })
+
+	return s
+}
+
+// 两个共用一个文件的存储（相当于两个进程）之间，一个记录的 nonce 另一个立即可见。
+func TestFileNonceStoreShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonces")
+
+	a := newTestFileNonceStore(t, path)
+	b := newTestFileNonceStore(t, path)
+
+	if seen, err := a.SeenOrAdd("n1", time.Minute); seen || err != nil {
+		t.Fatalf("a.SeenOrAdd = %v, %v; want false, nil", seen, err)
+	}
+
+	if seen, err := b.SeenOrAdd("n1", time.Minute); !seen || err != nil {
+		t.Fatalf("b.SeenOrAdd = %v, %v; want true, nil", seen, err)
+	}
+
+	if seen, err := b.SeenOrAdd("n2", time.Minute); seen || err != nil {
+		t.Fatalf("b.SeenOrAdd = %v, %v; want false, nil", seen, err)
+	}
+
+	if seen, err := a.SeenOrAdd("n2", time.Minute); !seen || err != nil {
+		t.Fatalf("a.SeenOrAdd = %v, %v; want true, nil", seen, err)
+	}
+}
+
+func TestFileNonceStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonces")
+
+	a := newTestFileNonceStore(t, path)
+	if _, err := a.SeenOrAdd("n1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.SeenOrAdd("n2", time.Minute); err == nil {
+		t.Fatal("SeenOrAdd after close succeeded")
+	}
+
+	b := newTestFileNonceStore(t, path)
+	if seen, err := b.SeenOrAdd("n1", time.Minute); !seen || err != nil {
+		t.Fatalf("SeenOrAdd after reload = %v, %v; want true, nil", seen, err)
+	}
+}
+
+// 启动时缓存放不下文件中的全部记录：未读入的记录不能被丢弃，缓存有空间后仍能识别重放。
+func TestFileNonceStoreLoadCacheFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonces")
+
+	a := newTestFileNonceStore(t, path)
+
+	// 每个分片最多两条，写入的记录一定超过容量。
+	nonces := make([]string, 4*replayShards)
+	for i := range nonces {
+		nonces[i] = fmt.Sprintf("n%d", i)
+		if _, err := a.SeenOrAdd(nonces[i], time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inst := newInstance(true, nil)
+	cache := newNonceReplayCache(inst.metrics)
+	cache.setSize(1)
+
+	b, err := newFileNonceStore(path, cache, inst.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = b.close() })
+
+	// 缓存已满时请求被拒绝而不是放行。
+	for _, nonce := range nonces {
+		if seen, err := b.SeenOrAdd(nonce, time.Minute); !seen && !errors.Is(err, errReplayCacheFull) {
+			t.Fatalf("SeenOrAdd(%q) with a full cache = %v, %v", nonce, seen, err)
+		}
+	}
+
+	b.setSize(0)
+
+	for _, nonce := range nonces {
+		if seen, err := b.SeenOrAdd(nonce, time.Minute); !seen || err != nil {
+			t.Fatalf("SeenOrAdd(%q) after growing the cache = %v, %v; want true, nil", nonce, seen, err)
+		}
+	}
+}
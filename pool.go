@@ -0,0 +1,544 @@
+package csocks
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ServerStrategyFailover      = "failover"
+	ServerStrategyRoundRobin    = "round-robin"
+	ServerStrategyLeastActive   = "least-active"
+	ServerStrategyLowestLatency = "lowest-latency"
+
+	upstreamHealthInterval = 30 * time.Second
+	upstreamBackoffMin     = 5 * time.Second
+	upstreamBackoffMax     = 2 * time.Minute
+)
+
+// UpstreamServer 是服务端池中的一个服务端。Secret、KeyID、AuthKeyFile 为空时继承 ListenConfig 中的值。
+type UpstreamServer struct {
+	Address       string `json:"address" yaml:"address" toml:"address"`
+	PublicKeyFile string `json:"public_key_file" yaml:"public_key_file" toml:"public_key_file"`
+	Secret        string `json:"secret" yaml:"secret" toml:"secret"`
+	KeyID         string `json:"key_id" yaml:"key_id" toml:"key_id"`
+	AuthKeyFile   string `json:"auth_key_file" yaml:"auth_key_file" toml:"auth_key_file"`
+
+	// Protocol 覆盖这个服务端的 ForwardProtocol，例如只有经过 CDN 的服务端使用 websocket。
+	Protocol string `json:"protocol" yaml:"protocol" toml:"protocol"`
+}
+
+// UpstreamStatsSnapshot 是单个上游服务端的状态。
+type UpstreamStatsSnapshot struct {
+	Address  string `json:"address"`
+	Protocol string `json:"protocol"`
+	Healthy  bool   `json:"healthy"`
+
+	// Preferred 表示按当前策略下一次会优先选中这个服务端。
+	Preferred bool `json:"preferred"`
+
+	ActiveStreams       int64  `json:"active_streams"`
+	TotalStreams        uint64 `json:"total_streams"`
+	FailedStreams       uint64 `json:"failed_streams"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+
+	// Latency 是探测往返时间的滑动平均，未测量时为 0；JSON 中以纳秒表示。
+	Latency time.Duration `json:"latency"`
+}
+
+// upstreamPool 在多个服务端之间选择隧道出口，每个服务端有独立的 forwardRuntime。
+type upstreamPool struct {
+	listenConfig *ListenConfig
+	inst         *instance
+
+	servers  []*forwardRuntime
+	strategy string
+	next     atomic.Uint64
+
+	// cancel 停止这个池的健康检查，池被替换或 forward 退出时调用。
+	cancel context.CancelFunc
+}
+
+// upstreamServers 返回配置的服务端列表；未配置 Servers 时使用 ServerAddress / PublicKeyFile。
+func upstreamServers(listenConfig *ListenConfig) []UpstreamServer {
+	if len(listenConfig.Servers) > 0 {
+		return listenConfig.Servers
+	}
+
+	return []UpstreamServer{{
+		Address:       listenConfig.ServerAddress,
+		PublicKeyFile: listenConfig.PublicKeyFile,
+	}}
+}
+
+func parseServerStrategy(strategy string) (string, error) {
+	switch s := strings.ToLower(strings.TrimSpace(strategy)); s {
+	case "":
+		return ServerStrategyFailover, nil
+	case ServerStrategyFailover, ServerStrategyRoundRobin, ServerStrategyLeastActive, ServerStrategyLowestLatency:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown server strategy %q", strategy)
+	}
+}
+
+func newUpstreamPool(listenConfig *ListenConfig, inst *instance) (*upstreamPool, error) {
+	strategy, err := parseServerStrategy(listenConfig.ServerStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &upstreamPool{
+		listenConfig: listenConfig,
+		inst:         inst,
+		strategy:     strategy,
+	}
+
+	for i, server := range upstreamServers(listenConfig) {
+		if server.Address == "" {
+			return nil, fmt.Errorf("servers[%d]: empty address", i)
+		}
+
+		// 每个服务端持有一份独立的 ListenConfig，握手与签名只看自己的地址和密钥。
+		serverConfig := *listenConfig
+		serverConfig.ServerAddress = server.Address
+		serverConfig.PublicKeyFile = server.PublicKeyFile
+		if server.Secret != "" {
+			serverConfig.Secret = server.Secret
+		}
+		if server.KeyID != "" {
+			serverConfig.KeyID = server.KeyID
+		}
+		if server.AuthKeyFile != "" {
+			serverConfig.AuthKeyFile = server.AuthKeyFile
+		}
+		if server.Protocol != "" {
+			serverConfig.ForwardProtocol = server.Protocol
+		}
+
+		if serverConfig.AuthKeyFile != "" {
+			key, err := loadAuthKey(serverConfig.AuthKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("server [%s]: auth_key_file: %w", server.Address, err)
+			}
+			serverConfig.authKey = key
+		}
+
+		runtime, err := newForwardRuntime(&serverConfig, inst)
+		if err != nil {
+			return nil, fmt.Errorf("server [%s]: %w", server.Address, err)
+		}
+
+		pool.servers = append(pool.servers, runtime)
+	}
+
+	return pool, nil
+}
+
+func newForwardRuntime(listenConfig *ListenConfig, inst *instance) (*forwardRuntime, error) {
+	knownPubKey, err := loadKnownPublicKey(listenConfig.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCert, err := loadClientCertificate(listenConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionCache := tls.NewLRUClientSessionCache(128)
+
+	h2TLSCfg := newForwardTLSClientConfig(
+		knownPubKey,
+		clientCert,
+		sessionCache,
+		listenConfig.ServerAddress,
+		[]string{protoH2, protoHTTP1},
+	)
+
+	h1TLSCfg := newForwardTLSClientConfig(
+		knownPubKey,
+		clientCert,
+		sessionCache,
+		listenConfig.ServerAddress,
+		[]string{protoHTTP1},
+	)
+
+	h3TLSCfg := newForwardTLSClientConfig(
+		knownPubKey,
+		clientCert,
+		sessionCache,
+		listenConfig.ServerAddress,
+		[]string{protoH3},
+	)
+
+	h2Client, err := newH2Client(h2TLSCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &forwardRuntime{
+		listenConfig: listenConfig,
+		inst:         inst,
+		protocol:     forwardProtocolUnknown,
+		h2Client:     h2Client,
+		h3Client:     newH3Client(h3TLSCfg, listenConfig),
+		h1TLSCfg:     h1TLSCfg,
+		streamSem:    make(chan struct{}, listenConfig.maxH2Streams()),
+	}, nil
+}
+
+// bootstrap 并行检查所有服务端；只要有一个可用就启动，全部失败时返回第一个错误。
+func (p *upstreamPool) bootstrap(ctx context.Context) error {
+	errs := make([]error, len(p.servers))
+
+	var wg sync.WaitGroup
+
+	for i, runtime := range p.servers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			protocol, err := runtime.probe(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			runtime.mu.Lock()
+			runtime.protocol = protocol
+			runtime.mu.Unlock()
+
+			// bootstrap 只是启动前检查；检查成功后关闭 idle，后续真正使用代理时再连接服务器。
+			closeIdleClientConnections(runtime.h2Client)
+			closeIdleClientConnections(runtime.h3Client)
+
+			p.inst.logger.Printf("[*] server [%s] selected forward protocol: %s\n",
+				runtime.listenConfig.ServerAddress,
+				protocol.String(),
+			)
+		}()
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var firstErr error
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		p.inst.logger.Printf("[x] server [%s] bootstrap check failed: [%s]\n",
+			p.servers[i].listenConfig.ServerAddress,
+			err.Error(),
+		)
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("server bootstrap check failed: %w", firstErr)
+}
+
+// probe 探测服务端协议并记录延迟与健康状态。
+func (r *forwardRuntime) probe(ctx context.Context) (forwardProtocol, error) {
+	start := time.Now()
+
+	protocol, err := r.detectProtocol(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.markFailure()
+		}
+		return forwardProtocolUnknown, err
+	}
+
+	r.observeLatency(time.Since(start))
+	r.markSuccess()
+
+	return protocol, nil
+}
+
+// healthCheck 定期重新探测不健康的服务端；lowest-latency 策略下也刷新健康服务端的延迟。
+func (p *upstreamPool) healthCheck(ctx context.Context) {
+	if len(p.servers) < 2 {
+		return
+	}
+
+	ticker := time.NewTicker(upstreamHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, runtime := range p.servers {
+			if runtime.healthy() && p.strategy != ServerStrategyLowestLatency {
+				continue
+			}
+
+			wasHealthy := runtime.healthy()
+
+			protocol, err := runtime.probe(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				p.inst.logger.PrintfX("[x] server [%s] health check failed: [%s]\n",
+					runtime.listenConfig.ServerAddress,
+					err.Error(),
+				)
+				continue
+			}
+
+			runtime.mu.Lock()
+			if runtime.protocol == forwardProtocolUnknown {
+				runtime.protocol = protocol
+			}
+			runtime.mu.Unlock()
+
+			closeIdleClientConnections(runtime.h2Client)
+			closeIdleClientConnections(runtime.h3Client)
+
+			if !wasHealthy {
+				p.inst.logger.Printf("[*] server [%s] is healthy again\n", runtime.listenConfig.ServerAddress)
+			}
+		}
+	}
+}
+
+// pick 按策略选择服务端。不健康（退避期内）的服务端被跳过；全部不健康时仍在所有服务端中选择。
+func (p *upstreamPool) pick() *forwardRuntime {
+	if len(p.servers) == 1 {
+		return p.servers[0]
+	}
+
+	return p.choose(p.candidates(), true)
+}
+
+func (p *upstreamPool) candidates() []*forwardRuntime {
+	candidates := make([]*forwardRuntime, 0, len(p.servers))
+	for _, runtime := range p.servers {
+		if runtime.available() {
+			candidates = append(candidates, runtime)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return p.servers
+	}
+
+	return candidates
+}
+
+func (p *upstreamPool) choose(candidates []*forwardRuntime, advance bool) *forwardRuntime {
+	switch p.strategy {
+	case ServerStrategyRoundRobin:
+		n := p.next.Load()
+		if advance {
+			n = p.next.Add(1) - 1
+		}
+		return candidates[n%uint64(len(candidates))]
+
+	case ServerStrategyLeastActive:
+		best := candidates[0]
+		for _, runtime := range candidates[1:] {
+			if runtime.activeStreams.Load() < best.activeStreams.Load() {
+				best = runtime
+			}
+		}
+		return best
+
+	case ServerStrategyLowestLatency:
+		best := candidates[0]
+		for _, runtime := range candidates[1:] {
+			if runtime.latencyOrMax() < best.latencyOrMax() {
+				best = runtime
+			}
+		}
+		return best
+
+	default:
+		return candidates[0]
+	}
+}
+
+func (p *upstreamPool) addresses() string {
+	addrs := make([]string, 0, len(p.servers))
+	for _, runtime := range p.servers {
+		addrs = append(addrs, runtime.listenConfig.ServerAddress)
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// stop 停止健康检查并关闭空闲连接；正在使用的 stream 不受影响。
+func (p *upstreamPool) stop() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.closeIdleConnections()
+}
+
+func (p *upstreamPool) closeIdleConnections() {
+	for _, runtime := range p.servers {
+		closeIdleClientConnections(runtime.h2Client)
+		closeIdleClientConnections(runtime.h3Client)
+	}
+}
+
+func (p *upstreamPool) snapshot() []UpstreamStatsSnapshot {
+	preferred := p.choose(p.candidates(), false)
+
+	out := make([]UpstreamStatsSnapshot, 0, len(p.servers))
+
+	for _, runtime := range p.servers {
+		runtime.mu.Lock()
+		protocol := runtime.protocol
+		runtime.mu.Unlock()
+
+		out = append(out, UpstreamStatsSnapshot{
+			Address:             runtime.listenConfig.ServerAddress,
+			Protocol:            protocol.String(),
+			Healthy:             runtime.healthy(),
+			Preferred:           runtime == preferred,
+			ActiveStreams:       runtime.activeStreams.Load(),
+			TotalStreams:        runtime.totalStreams.Load(),
+			FailedStreams:       runtime.failedStreams.Load(),
+			ConsecutiveFailures: runtime.failures.Load(),
+			Latency:             time.Duration(runtime.latency.Load()),
+		})
+	}
+
+	return out
+}
+
+// GetUpstreamStats 返回 StartServer 启动、仍在运行的 forward 端各上游服务端的健康状态、延迟与选择情况。
+// 未运行 forward 时返回 nil。
+func GetUpstreamStats() []UpstreamStatsSnapshot {
+	var out []UpstreamStatsSnapshot
+	for _, inst := range defaultInstances() {
+		out = append(out, inst.stats.upstreamSnapshots()...)
+	}
+	return out
+}
+
+func (r *forwardRuntime) streamStart() {
+	r.activeStreams.Add(1)
+	r.totalStreams.Add(1)
+}
+
+// transportError 标记服务端本身的故障：拨号或 TLS 握手失败、隧道被拒绝、h2 / h3 stream 在响应头之前被重置。
+// 目标不可达、ACL 拒绝等发生在隧道建立之后，由服务端以 SOCKS5 / HTTP 应答返回，不属于这一类。
+type transportError struct {
+	err error
+}
+
+func (e transportError) Error() string { return e.err.Error() }
+
+func (e transportError) Unwrap() error { return e.err }
+
+// streamEnd 记录一个使用 protocol 的 stream 结束。
+func (r *forwardRuntime) streamEnd(protocol forwardProtocol, err error) {
+	r.activeStreams.Add(-1)
+
+	// 只有传输层故障才让服务端进入退避、重新探测协议并计入拨号失败；
+	// 本地并发上限、取消等错误不影响它的健康状态与已选的协议。
+	var te transportError
+	if errors.As(err, &te) {
+		r.failedStreams.Add(1)
+		r.markFailure()
+		r.resetProtocolIfCurrent(protocol)
+		r.inst.metrics.dialFailure(metricsRoleClient, r.listenConfig.KeyID, err)
+		return
+	}
+
+	if err == nil {
+		r.markSuccess()
+	}
+}
+
+// markFailure 记录一次失败，并按连续失败次数指数退避，退避期内 pick 不会选中它。
+func (r *forwardRuntime) markFailure() {
+	failures := r.failures.Add(1)
+
+	backoff := upstreamBackoffMin << min(failures-1, 10)
+	if backoff > upstreamBackoffMax {
+		backoff = upstreamBackoffMax
+	}
+
+	r.downUntil.Store(time.Now().Add(backoff).UnixNano())
+}
+
+func (r *forwardRuntime) markSuccess() {
+	r.failures.Store(0)
+	r.downUntil.Store(0)
+}
+
+func (r *forwardRuntime) healthy() bool {
+	return r.failures.Load() == 0
+}
+
+// available 表示可以被选中：健康，或者退避已过期（允许一次重试）。
+func (r *forwardRuntime) available() bool {
+	return r.healthy() || time.Now().UnixNano() >= r.downUntil.Load()
+}
+
+// observeLatency 以 EWMA（权重 1/4）平滑探测延迟。
+func (r *forwardRuntime) observeLatency(d time.Duration) {
+	for {
+		old := r.latency.Load()
+
+		v := int64(d)
+		if old != 0 {
+			v = old + (int64(d)-old)/4
+		}
+
+		if r.latency.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+func (r *forwardRuntime) latencyOrMax() int64 {
+	if v := r.latency.Load(); v > 0 {
+		return v
+	}
+	return math.MaxInt64
+}
+
+func (p forwardProtocol) String() string {
+	switch p {
+	case forwardProtocolH3:
+		return "h3"
+	case forwardProtocolH2:
+		return "h2"
+	case forwardProtocolHTTP1:
+		return "http/1.1"
+	case forwardProtocolWebSocket:
+		return "websocket"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,100 @@
+package csocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// 只有传输层故障让服务端进入退避，目标侧错误与本地错误不影响服务端的健康状态。
+func TestForwardRuntimeStreamEnd(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		healthy bool
+		failed  uint64
+	}{
+		{name: "success", err: nil, healthy: true},
+		{name: "dial failure", err: transportError{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, healthy: false, failed: 1},
+		{name: "tunnel rejected", err: transportError{errors.New("h2 tunnel rejected: 404 Not Found")}, healthy: false, failed: 1},
+		{name: "wrapped transport error", err: fmt.Errorf("stream: %w", transportError{errors.New("stream reset")}), healthy: false, failed: 1},
+		{name: "target refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, healthy: true},
+		{name: "too many streams", err: errTooManyH2Streams, healthy: true},
+		{name: "canceled", err: context.Canceled, healthy: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestForwardRuntime()
+
+			r.streamStart()
+			r.streamEnd(forwardProtocolH2, tt.err)
+
+			if r.healthy() != tt.healthy {
+				t.Fatalf("healthy = %v, want %v", r.healthy(), tt.healthy)
+			}
+
+			if got := r.failedStreams.Load(); got != tt.failed {
+				t.Fatalf("failedStreams = %d, want %d", got, tt.failed)
+			}
+
+			if got := r.activeStreams.Load(); got != 0 {
+				t.Fatalf("activeStreams = %d, want 0", got)
+			}
+
+			want := forwardProtocolH2
+			if tt.failed > 0 {
+				want = forwardProtocolUnknown
+			}
+			if r.protocol != want {
+				t.Fatalf("protocol = %v, want %v", r.protocol, want)
+			}
+		})
+	}
+}
+
+func newTestForwardRuntime() *forwardRuntime {
+	return &forwardRuntime{
+		listenConfig: &ListenConfig{},
+		inst:         newInstance(true, nil),
+		protocol:     forwardProtocolH2,
+	}
+}
+
+// 达到本地 stream 上限不是服务端的问题：已选的协议保留，下一个请求不需要重新探测。
+func TestForwardRuntimeStreamLimitKeepsProtocol(t *testing.T) {
+	r := newTestForwardRuntime()
+
+	for range 3 {
+		r.streamStart()
+		r.streamEnd(forwardProtocolH2, errTooManyH2Streams)
+	}
+
+	if r.protocol != forwardProtocolH2 {
+		t.Fatalf("protocol = %v after hitting the stream limit, want h2", r.protocol)
+	}
+
+	if got := r.inst.metrics.dialFailures.with(metricsRoleClient, dialErrorClass(errTooManyH2Streams), metricsUser("")).Load(); got != 0 {
+		t.Fatalf("dial failures = %d, want 0", got)
+	}
+}
+
+// 目标侧错误之后的成功 stream 仍然清除之前的退避。
+func TestForwardRuntimeRecovers(t *testing.T) {
+	r := newTestForwardRuntime()
+
+	r.streamStart()
+	r.streamEnd(forwardProtocolH2, transportError{errors.New("tls: handshake failure")})
+	if r.healthy() || r.available() {
+		t.Fatal("server is still selectable after a transport failure")
+	}
+
+	r.streamStart()
+	r.streamEnd(forwardProtocolH2, nil)
+	if !r.healthy() {
+		t.Fatal("server is not healthy after a successful stream")
+	}
+}
@@ -0,0 +1,102 @@
+package csocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// reloader 是一个正在运行、可以热加载配置的实例。
+type reloader interface {
+	env() *instance
+	config() *ListenConfig
+	reload(listenConfig *ListenConfig) error
+}
+
+var (
+	// reloaders 以 ListenPort 为键记录 StartServer 启动的实例。
+	reloaders sync.Map
+
+	reloadMu sync.Mutex
+)
+
+func registerReloader(ctx context.Context, listenConfig *ListenConfig, r reloader) {
+	key := listenConfig.ListenPort
+
+	reloaders.Store(key, r)
+
+	context.AfterFunc(ctx, func() {
+		reloaders.CompareAndDelete(key, r)
+	})
+
+	if !listenConfig.NoSignalReload {
+		go watchReloadSignal(ctx, r)
+	}
+}
+
+// Reload 把新配置应用到 StartServer 启动、监听在 listenConfig.ListenPort 上的运行中实例。
+// Server / Client 使用各自的 Reload 方法。
+//
+// 服务端重新读取证书与私钥、密钥 / 用户表和 ACL；forward 端重建服务端池（含公钥固定）、
+// 本地认证用户和分流规则。所有新状态构建成功后才会替换，失败时旧配置继续生效。
+// 已建立的连接不受影响，新的握手与 stream 使用新配置。ListenPort 与运行模式不能改变。
+func Reload(listenConfig *ListenConfig) error {
+	v, ok := reloaders.Load(listenConfig.ListenPort)
+	if !ok {
+		return fmt.Errorf("no running instance listening on [%s]", listenConfig.ListenPort)
+	}
+
+	return applyReload(v.(reloader), listenConfig)
+}
+
+func applyReload(r reloader, listenConfig *ListenConfig) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	current := r.config()
+
+	if err := listenConfig.Validate(); err != nil {
+		return err
+	}
+
+	if listenConfig.ListenPort != current.ListenPort {
+		return errors.New("listen_port: cannot be changed by reload")
+	}
+
+	if listenConfig.NonceStoreFile != current.NonceStoreFile || listenConfig.NonceStore != current.NonceStore {
+		return errors.New("nonce_store_file / NonceStore: cannot be changed by reload")
+	}
+
+	if listenConfig.isForward() != current.isForward() {
+		return errors.New("cannot switch between client and server mode by reload")
+	}
+
+	if err := r.reload(listenConfig); err != nil {
+		return err
+	}
+
+	r.env().logger.Printf("[*] configuration reloaded [%s]\n", listenConfig.ListenPort)
+
+	return nil
+}
+
+// reloadFromDisk 是 SIGHUP 的处理：配置来自文件时重新读取文件，
+// 否则沿用当前配置，只重新读取其中引用的证书、公钥和规则文件。
+func reloadFromDisk(r reloader) {
+	logger := r.env().logger
+	listenConfig := r.config()
+
+	if listenConfig.ConfigFile != "" {
+		loaded, err := LoadConfigFile(listenConfig.ConfigFile)
+		if err != nil {
+			logger.Printf("[x] reload failed: [%s]\n", err.Error())
+			return
+		}
+		listenConfig = loaded
+	}
+
+	if err := applyReload(r, listenConfig); err != nil {
+		logger.Printf("[x] reload failed: [%s]\n", err.Error())
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package csocks
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReloadSignal 在收到 SIGHUP 时热加载配置。
+func watchReloadSignal(ctx context.Context, r reloader) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			r.env().logger.Printf("[*] SIGHUP received, reloading\n")
+			reloadFromDisk(r)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package csocks
+
+import "context"
+
+// Windows 没有 SIGHUP，只能通过 Reload 热加载。
+func watchReloadSignal(ctx context.Context, r reloader) {}
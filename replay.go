@@ -0,0 +1,122 @@
+package csocks
+
+import (
+	"errors"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 请求时间允许前后偏差 authClockSkewSeconds，一个 nonce 最长在 2 倍的时间内有效。
+	replayWindow = 2 * authClockSkewSeconds * time.Second
+
+	replayShardBits = 6
+	replayShards    = 1 << replayShardBits
+
+	// 默认最多记录的 nonce 数（两代合计），约相当于持续每秒 2000 次认证。
+	defaultReplayCacheSize = 1 << 20
+)
+
+// errReplayCacheFull 表示缓存已满且没有可以淘汰的过期记录。此时拒绝请求而不是丢弃仍有效的记录，
+// 否则攻击者可以先填满缓存再重放。
+var errReplayCacheFull = errors.New("replay cache is full")
+
+// nonceReplayCache 记录有效期内已使用的 nonce。按 nonce 的哈希分片，各分片独立加锁；
+// 每个分片保留两代记录，当前一代记录满 replayWindow 或达到容量时整体替换上一代，
+// 不需要逐条扫描过期项。上一代还有未过期的记录时不替换，总内存不超过容量上限。
+type nonceReplayCache struct {
+	seed   maphash.Seed
+	shards [replayShards]replayShard
+
+	// limit 是每个分片每一代的容量。
+	limit atomic.Int64
+
+	// entries 是当前记录的 nonce 数，输出为指标。
+	entries *atomic.Int64
+}
+
+type replayShard struct {
+	mu sync.Mutex
+
+	// 键是 nonce 的哈希，值是过期时间（UnixNano）；max 是这一代中最晚的过期时间。
+	cur, prev       map[uint64]int64
+	curMax, prevMax int64
+	rotatedAt       int64
+}
+
+func newNonceReplayCache(m *metrics) *nonceReplayCache {
+	c := &nonceReplayCache{
+		seed:    maphash.MakeSeed(),
+		entries: m.replayCacheEntries.with(),
+	}
+
+	c.setSize(defaultReplayCacheSize)
+
+	now := time.Now().UnixNano()
+	for i := range c.shards {
+		c.shards[i].cur = make(map[uint64]int64)
+		c.shards[i].rotatedAt = now
+	}
+
+	return c
+}
+
+// setSize 设置最多记录的 nonce 数（两代合计）；缩小后已有的记录在替换时释放。
+func (c *nonceReplayCache) setSize(size int) {
+	if size <= 0 {
+		size = defaultReplayCacheSize
+	}
+	c.limit.Store(max(int64(size/2/replayShards), 1))
+}
+
+// SeenOrAdd 在 nonce 仍在有效期内已出现过时返回 true，否则记录它，ttl 之后过期。
+// ttl 超过 replayWindow 时按 replayWindow 处理。缓存已满时返回 errReplayCacheFull。
+func (c *nonceReplayCache) SeenOrAdd(nonce string, ttl time.Duration) (bool, error) {
+	key := maphash.String(c.seed, nonce)
+	s := &c.shards[key>>(64-replayShardBits)]
+
+	now := time.Now().UnixNano()
+	expiresAt := now + int64(min(ttl, replayWindow))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if exp, ok := s.cur[key]; ok && exp > now {
+		return true, nil
+	}
+
+	if exp, ok := s.prev[key]; ok && exp > now {
+		return true, nil
+	}
+
+	limit := int(c.limit.Load())
+
+	if now-s.rotatedAt >= int64(replayWindow) || len(s.cur) >= limit {
+		c.rotate(s, now)
+	}
+
+	if len(s.cur) >= limit {
+		return false, errReplayCacheFull
+	}
+
+	s.cur[key] = expiresAt
+	s.curMax = max(s.curMax, expiresAt)
+	c.entries.Add(1)
+
+	return false, nil
+}
+
+// rotate 在上一代已全部过期时丢弃它，当前一代成为上一代。
+func (c *nonceReplayCache) rotate(s *replayShard, now int64) {
+	if s.prevMax > now {
+		return
+	}
+
+	c.entries.Add(-int64(len(s.prev)))
+
+	s.prev, s.prevMax = s.cur, s.curMax
+	s.cur, s.curMax = make(map[uint64]int64, len(s.prev)), 0
+	s.rotatedAt = now
+}
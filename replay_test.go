@@ -0,0 +1,114 @@
+package csocks
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNonceReplayCacheSeenOrAdd(t *testing.T) {
+	c := newNonceReplayCache(newMetrics())
+
+	if seen, err := c.SeenOrAdd("a", time.Minute); seen || err != nil {
+		t.Fatalf("first SeenOrAdd = %v, %v; want false, nil", seen, err)
+	}
+
+	if seen, err := c.SeenOrAdd("a", time.Minute); !seen || err != nil {
+		t.Fatalf("second SeenOrAdd = %v, %v; want true, nil", seen, err)
+	}
+
+	if seen, err := c.SeenOrAdd("b", time.Minute); seen || err != nil {
+		t.Fatalf("other nonce SeenOrAdd = %v, %v; want false, nil", seen, err)
+	}
+}
+
+func TestNonceReplayCacheExpired(t *testing.T) {
+	c := newNonceReplayCache(newMetrics())
+
+	if _, err := c.SeenOrAdd("a", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	if seen, err := c.SeenOrAdd("a", time.Minute); seen || err != nil {
+		t.Fatalf("SeenOrAdd after expiry = %v, %v; want false, nil", seen, err)
+	}
+}
+
+func TestNonceReplayCacheFull(t *testing.T) {
+	c := newNonceReplayCache(newMetrics())
+	c.setSize(2 * replayShards)
+
+	// 每个分片每一代只能放 1 个，仍在有效期内时不能替换，很快就会满。
+	var full bool
+	for i := 0; i < 4*replayShards; i++ {
+		_, err := c.SeenOrAdd(strconv.Itoa(i), time.Minute)
+		if errors.Is(err, errReplayCacheFull) {
+			full = true
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !full {
+		t.Fatal("cache never reported full")
+	}
+}
+
+func BenchmarkNonceReplayCacheSeenOrAdd(b *testing.B) {
+	c := newNonceReplayCache(newMetrics())
+
+	var n atomic.Uint64
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nonce := strconv.FormatUint(n.Add(1), 36)
+			if _, err := c.SeenOrAdd(nonce, replayWindow); err != nil && !errors.Is(err, errReplayCacheFull) {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkNonceReplayCacheRotate 使用很短的 ttl 和很小的容量，几乎每次写入都会替换一代。
+func BenchmarkNonceReplayCacheRotate(b *testing.B) {
+	c := newNonceReplayCache(newMetrics())
+	c.setSize(2 * replayShards)
+
+	var n atomic.Uint64
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nonce := strconv.FormatUint(n.Add(1), 36)
+			if _, err := c.SeenOrAdd(nonce, time.Nanosecond); err != nil && !errors.Is(err, errReplayCacheFull) {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkNonceReplayCacheFull 测量缓存已满时拒绝请求的开销。
+func BenchmarkNonceReplayCacheFull(b *testing.B) {
+	c := newNonceReplayCache(newMetrics())
+	c.setSize(2 * replayShards)
+
+	for i := 0; i < 4*replayShards; i++ {
+		_, _ = c.SeenOrAdd("fill-"+strconv.Itoa(i), time.Minute)
+	}
+
+	var n atomic.Uint64
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = c.SeenOrAdd(strconv.FormatUint(n.Add(1), 36), time.Minute)
+		}
+	})
+}
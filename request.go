@@ -2,33 +2,49 @@ package csocks
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
 )
 
-var replayMap = newNonceReplayCache()
-
 type negotiationRequest struct {
 	net.Conn
 	Method  byte
+	Command byte
 	Address string
 	Reader  *bufio.Reader
+	User    string
+
+	// protocol 是承载这个请求的隧道协议（指标标签），metrics 在 handleNegotiationRequest 中登记会话时创建。
+	protocol string
+	metrics  *streamMetrics
+
+	// route 是 forward 端本地分流的动作（目前只有 direct），为空表示请求来自隧道。
+	route string
+}
+
+// statsUser 返回统计与会话使用的名字：本地分流的请求按路由动作统计，其余按 User。
+func (r *negotiationRequest) statsUser() string {
+	if r.route != "" {
+		return r.route
+	}
+	return r.User
 }
 
 type sniffedConn struct {
@@ -43,6 +59,11 @@ func (c *sniffedConn) Read(p []byte) (int, error) {
 	return c.Conn.Read(p)
 }
 
+func (c *sniffedConn) CloseWrite() error {
+	tryCloseWrite(c.Conn)
+	return nil
+}
+
 type dummyAddr string
 
 func (a dummyAddr) Network() string {
@@ -56,18 +77,20 @@ func (a dummyAddr) String() string {
 type h2StreamConn struct {
 	ctx     context.Context
 	cancel  context.CancelFunc
-	reader  io.Reader
+	reader  io.ReadCloser
 	writer  io.Writer
 	flusher http.Flusher
+	local   net.Addr
 	remote  string
 	writeMu sync.Mutex
 }
 
 func newH2StreamConn(
 	ctx context.Context,
-	reader io.Reader,
+	reader io.ReadCloser,
 	writer io.Writer,
 	flusher http.Flusher,
+	local net.Addr,
 	remote string,
 ) *h2StreamConn {
 	streamCtx, cancel := context.WithCancel(ctx)
@@ -78,10 +101,17 @@ func newH2StreamConn(
 		reader:  reader,
 		writer:  writer,
 		flusher: flusher,
+		local:   local,
 		remote:  remote,
 	}
 }
 
+// localAddrFromRequest 返回收到 r 的连接的本地地址；h2 与 HTTP/3 服务端都会在请求 ctx 中设置。
+func localAddrFromRequest(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
 func (c *h2StreamConn) Read(p []byte) (int, error) {
 	select {
 	case <-c.ctx.Done():
@@ -113,11 +143,17 @@ func (c *h2StreamConn) Close() error {
 	if c.cancel != nil {
 		c.cancel()
 	}
+	// 关闭请求体以唤醒阻塞中的 Read，否则 stream 要等对端关闭才会结束。
+	_ = c.reader.Close()
 	return nil
 }
 
+// LocalAddr 返回承载这个 stream 的连接的本地地址（BIND 在这个地址上监听），未知时返回占位地址。
 func (c *h2StreamConn) LocalAddr() net.Addr {
-	return dummyAddr("h2-local")
+	if c.local == nil {
+		return dummyAddr("h2-local")
+	}
+	return c.local
 }
 
 func (c *h2StreamConn) RemoteAddr() net.Addr {
@@ -139,80 +175,218 @@ func (c *h2StreamConn) SetWriteDeadline(time.Time) error {
 	return nil
 }
 
-type nonceReplayCache struct {
-	mu    sync.Mutex
-	items map[string]time.Time
+// loadServerCertificate 读取证书与私钥，并把证书公钥写到 publicKeyFile 供客户端固定。
+func loadServerCertificate(serverCertFile, serverKeyFile, publicKeyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeCertificatePublicKey(x509Cert, publicKeyFile); err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
 }
 
-func newNonceReplayCache() *nonceReplayCache {
-	return &nonceReplayCache{
-		items: make(map[string]time.Time),
+func newServerTLSConfig(server *proxyServer) *tls.Config {
+	cfg := &tls.Config{
+		// 每次握手取当前证书，热加载后新握手立即使用新证书。
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return server.cert.Load(), nil
+		},
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		NextProtos: []string{protoH2, protoHTTP1},
+	}
+
+	// 启用 mTLS 时请求客户端证书（可以不出示，没有证书的连接仍可使用 HMAC 或看到回落站点），CA 随热加载更新。
+	// 未启用时不发送 CertificateRequest。
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		auth := server.runtime.Load().clientAuth
+		if auth == nil {
+			return nil, nil
+		}
+
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		c.ClientCAs = auth.roots
+
+		return c, nil
 	}
+
+	// session ticket 密钥显式设置，GetConfigForClient 中的 Clone 共用它们，会话恢复不受影响。
+	// 设置后 crypto/tls 不再自动轮换，由 rotateSessionTicketKeys 负责。
+	server.ticketKeys = [][32]byte{newSessionTicketKey()}
+	cfg.SetSessionTicketKeys(server.ticketKeys)
+
+	return cfg
 }
 
-func (c *nonceReplayCache) SeenOrAdd(nonce string, ttl time.Duration) bool {
-	now := time.Now()
+// 与 crypto/tls 自动轮换相同：每天换一个新密钥，ticket 最长可以在 7 天内恢复。
+const (
+	sessionTicketKeyRotation = 24 * time.Hour
+	sessionTicketKeyCount    = 7
+)
+
+func newSessionTicketKey() [32]byte {
+	var key [32]byte
+	_, _ = rand.Read(key[:])
+	return key
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// rotateSessionTicketKeys 每 sessionTicketKeyRotation 换一个新的 session ticket 密钥，
+// 旧密钥保留 sessionTicketKeyCount 个用于恢复已发出的 ticket，直到 ctx 结束。
+func (s *proxyServer) rotateSessionTicketKeys(ctx context.Context) {
+	ticker := time.NewTicker(sessionTicketKeyRotation)
+	defer ticker.Stop()
 
-	for k, exp := range c.items {
-		if now.After(exp) {
-			delete(c.items, k)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			keys := append([][32]byte{newSessionTicketKey()}, s.ticketKeys...)
+			s.ticketKeys = keys[:min(len(keys), sessionTicketKeyCount)]
+			s.tlsCfg.SetSessionTicketKeys(s.ticketKeys)
 		}
 	}
+}
 
-	if exp, ok := c.items[nonce]; ok && now.Before(exp) {
-		return true
-	}
+// proxyRuntime 是服务端运行期状态，在 proxy 启动时由 ListenConfig 构建。
+type proxyRuntime struct {
+	listenConfig *ListenConfig
+	inst         *instance
+	users        map[string]TunnelUser
+	policy       *accessPolicy
 
-	c.items[nonce] = now.Add(ttl)
-	return false
+	// clientAuth 非 nil 时启用 mTLS，见 ClientCAFile。
+	clientAuth *clientCertAuth
+
+	// authKeys 是 AuthorizedKeysFile 中的公钥，键是 base64 编码的公钥。
+	authKeys map[string]authorizedKey
+
+	// nonces 与服务端相同，热加载不会更换。
+	nonces NonceStore
+
+	// fallback 非 nil 时，不是隧道的请求交给它处理（FallbackURL 或 FallbackDir / FallbackFS）。
+	fallback http.Handler
 }
 
-func newServerTLSConfig(serverCertFile, serverKeyFile, publicKeyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+func newProxyRuntime(listenConfig *ListenConfig, inst *instance) (*proxyRuntime, error) {
+	users, err := newTunnelUserTable(listenConfig.Users)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(cert.Certificate) == 0 {
-		return nil, errors.New("no certificates found")
+	policy, err := newAccessPolicy(listenConfig, inst)
+	if err != nil {
+		return nil, err
 	}
 
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	fallback, err := newFallbackHandler(listenConfig, inst)
 	if err != nil {
 		return nil, err
 	}
 
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(x509Cert.PublicKey)
+	clientAuth, err := newClientCertAuth(listenConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	pemBytes := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	})
+	authKeys, err := loadAuthorizedKeys(listenConfig.AuthorizedKeysFile)
+	if err != nil {
+		return nil, err
+	}
 
-	if strings.TrimSpace(publicKeyFile) == "" {
-		publicKeyFile = "public.key"
+	return &proxyRuntime{
+		listenConfig: listenConfig,
+		inst:         inst,
+		users:        users,
+		policy:       policy,
+		fallback:     fallback,
+		clientAuth:   clientAuth,
+		authKeys:     authKeys,
+	}, nil
+}
+
+// proxyServer 持有服务端当前生效的运行期状态与证书，热加载时整体替换。
+// 已建立的连接继续使用旧状态，新的握手与 stream 使用新状态。
+type proxyServer struct {
+	inst *instance
+
+	runtime atomic.Pointer[proxyRuntime]
+	cert    atomic.Pointer[tls.Certificate]
+	tlsCfg  *tls.Config
+
+	// ticketKeys 是 tlsCfg 当前的 session ticket 密钥，第一个用于加密；只在 rotateSessionTicketKeys 中更新。
+	ticketKeys [][32]byte
+
+	// nonces 在创建时按 NonceStore / NonceStoreFile 选定，热加载不会更换。
+	nonces NonceStore
+
+	conns connTracker
+
+	// draining 在开始 drain 时关闭，h2 连接随之发送 GOAWAY。
+	draining <-chan struct{}
+}
+
+func newProxyServer(listenConfig *ListenConfig, inst *instance) (*proxyServer, error) {
+	nonces, err := newNonceStore(listenConfig, inst)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := os.WriteFile(publicKeyFile, pemBytes, 0644); err != nil {
+	server := &proxyServer{inst: inst, nonces: nonces}
+
+	if err := server.reload(listenConfig); err != nil {
+		server.closeNonceStore()
 		return nil, err
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
-		MaxVersion:   tls.VersionTLS13,
-		NextProtos:   []string{protoH2, protoHTTP1},
-	}, nil
+	server.tlsCfg = newServerTLSConfig(server)
+
+	return server, nil
+}
+
+func (s *proxyServer) env() *instance {
+	return s.inst
+}
+
+func (s *proxyServer) config() *ListenConfig {
+	return s.runtime.Load().listenConfig
 }
 
-func proxy(ctx context.Context, listenConfig *ListenConfig) error {
-	tlsCfg, err := newServerTLSConfig(
+// reload 先构建全部新状态，成功后再替换，失败时保留旧状态。
+func (s *proxyServer) reload(listenConfig *ListenConfig) error {
+	runtime, err := newProxyRuntime(listenConfig, s.inst)
+	if err != nil {
+		return err
+	}
+
+	generated, err := ensureServerCertificate(listenConfig)
+	if err != nil {
+		return fmt.Errorf("generate certificate: %w", err)
+	}
+
+	if generated {
+		s.inst.logger.Printf("[*] generated self-signed certificate [%s] key [%s]\n",
+			listenConfig.ServerCertFile,
+			listenConfig.ServerKeyFile,
+		)
+	}
+
+	cert, err := loadServerCertificate(
 		listenConfig.ServerCertFile,
 		listenConfig.ServerKeyFile,
 		listenConfig.PublicKeyFile,
@@ -221,9 +395,51 @@ func proxy(ctx context.Context, listenConfig *ListenConfig) error {
 		return err
 	}
 
-	ln, err := listen(listenConfig.ListenPort)
+	bans, err := compileBanConfig(listenConfig.Ban)
 	if err != nil {
-		return err
+		return fmt.Errorf("ban: %w", err)
+	}
+
+	runtime.nonces = s.nonces
+
+	s.cert.Store(cert)
+	s.runtime.Store(runtime)
+	s.inst.bans.configure(bans)
+
+	if c, ok := s.nonces.(interface{ setSize(int) }); ok {
+		c.setSize(listenConfig.ReplayCacheSize)
+	}
+
+	return nil
+}
+
+// serve 接受连接直到 ctx 结束，然后等待已有连接处理结束，force 结束时强制关闭剩余连接。
+func (s *proxyServer) serve(ctx context.Context, ln net.Listener, force context.Context) error {
+	logger := s.inst.logger
+
+	// 连接使用独立的 ctx，ctx 结束时不会立即关闭，drain 超时后由 closeAll 关闭。
+	connCtx, closeAll := context.WithCancel(context.WithoutCancel(ctx))
+
+	defer func() {
+		s.conns.drain(logger, force, closeAll)
+		closeAll()
+		s.closeNonceStore()
+	}()
+
+	s.draining = ctx.Done()
+
+	if store, ok := s.nonces.(*fileNonceStore); ok {
+		go store.run(ctx)
+	}
+
+	go s.inst.bans.run(ctx, s.inst)
+	go s.rotateSessionTicketKeys(ctx)
+
+	if s.config().EnableH3 {
+		if err := s.serveH3(ctx, connCtx, ln.Addr().String()); err != nil {
+			_ = ln.Close()
+			return fmt.Errorf("listen http3: %w", err)
+		}
 	}
 
 	go func() {
@@ -231,10 +447,10 @@ func proxy(ctx context.Context, listenConfig *ListenConfig) error {
 		_ = ln.Close()
 	}()
 
-	if listenConfig.WithHttp {
-		logger.Printf("[*] socks5/http proxy listen on: [%s]", listenConfig.ListenPort)
+	if s.config().WithHttp {
+		logger.Printf("[*] socks5/http proxy listen on: [%s]", ln.Addr().String())
 	} else {
-		logger.Printf("[*] socks5 proxy listen on: [%s]", listenConfig.ListenPort)
+		logger.Printf("[*] socks5 proxy listen on: [%s]", ln.Addr().String())
 	}
 
 	for {
@@ -248,18 +464,44 @@ func proxy(ctx context.Context, listenConfig *ListenConfig) error {
 			continue
 		}
 
+		if s.inst.bans.banned(conn0.RemoteAddr().String()) {
+			logger.PrintfX("[x] rejected banned client [%s]\n", conn0.RemoteAddr().String())
+			s.inst.bans.reject(ctx, conn0)
+			continue
+		}
+
 		logger.PrintfX("[+] new client [%s] connected [%s]\n",
 			conn0.RemoteAddr().String(),
 			conn0.LocalAddr().String(),
 		)
 
-		go handleRequest(ctx, conn0, listenConfig, tlsCfg)
+		s.conns.add()
+
+		go func() {
+			defer s.conns.done()
+			handleRequest(connCtx, conn0, s)
+		}()
+	}
+}
+
+// closeNonceStore 关闭 NonceStoreFile 打开的文件存储；ListenConfig.NonceStore 由调用方管理。
+func (s *proxyServer) closeNonceStore() {
+	store, ok := s.nonces.(*fileNonceStore)
+	if !ok {
+		return
+	}
+
+	if err := store.close(); err != nil {
+		s.inst.logger.Printf("[x] nonce store [%s] close failed: [%s]\n", store.path, err.Error())
 	}
 }
 
-func handleRequest(ctx context.Context, conn0 net.Conn, listenConfig *ListenConfig, tlsCfg *tls.Config) {
+func handleRequest(ctx context.Context, conn0 net.Conn, server *proxyServer) {
 	defer conn0.Close()
 
+	runtime := server.runtime.Load()
+	logger := server.inst.logger
+
 	reader := bufio.NewReader(conn0)
 
 	_ = conn0.SetReadDeadline(time.Now().Add(3 * time.Second))
@@ -275,7 +517,11 @@ func handleRequest(ctx context.Context, conn0 net.Conn, listenConfig *ListenConf
 	}
 
 	if isLikelyPlainHTTPFirstByte(first[0]) {
-		handlePlainHTTPFallback(conn0, reader)
+		if runtime.fallback != nil {
+			serveHTTP1Fallback(ctx, &replayConn{Conn: conn0, reader: reader}, runtime, server.draining)
+			return
+		}
+		handlePlainHTTPFallback(logger, conn0, reader)
 		return
 	}
 
@@ -284,15 +530,17 @@ func handleRequest(ctx context.Context, conn0 net.Conn, listenConfig *ListenConf
 			conn0.RemoteAddr().String(),
 			first[0],
 		)
+		server.inst.bans.strike(server.inst, conn0.RemoteAddr().String(), banReasonFirstByte)
 		return
 	}
 
 	tlsConn, err := tlsHandshake(&sniffedConn{
 		Conn:   conn0,
 		reader: reader,
-	}, tlsCfg)
+	}, server.tlsCfg, runtime.listenConfig.timeout(), logger)
 	if err != nil {
 		logger.PrintfX("[x] failed to handshake: [%s]\n", err.Error())
+		server.inst.bans.strike(server.inst, conn0.RemoteAddr().String(), banReasonHandshake)
 		return
 	}
 
@@ -302,10 +550,10 @@ func handleRequest(ctx context.Context, conn0 net.Conn, listenConfig *ListenConf
 
 	switch state.NegotiatedProtocol {
 	case protoH2:
-		handleH2Conn(ctx, tlsConn, listenConfig)
+		handleH2Conn(ctx, tlsConn, server)
 
 	case protoHTTP1, "":
-		handleHTTP1Conn(ctx, tlsConn, listenConfig)
+		handleHTTP1Conn(ctx, tlsConn, runtime, server.draining)
 
 	default:
 		logger.PrintfX("[x] unsupported ALPN protocol: [%s]\n", state.NegotiatedProtocol)
@@ -327,7 +575,7 @@ func isLikelyPlainHTTPFirstByte(b byte) bool {
 	}
 }
 
-func handlePlainHTTPFallback(conn net.Conn, reader *bufio.Reader) {
+func handlePlainHTTPFallback(logger *customLogger, conn net.Conn, reader *bufio.Reader) {
 	_ = conn.SetReadDeadline(time.Now().Add(8 * time.Second))
 	req, err := http.ReadRequest(reader)
 	_ = conn.SetReadDeadline(time.Time{})
@@ -345,10 +593,10 @@ func handlePlainHTTPFallback(conn net.Conn, reader *bufio.Reader) {
 	writeFallbackHTTP(conn, req)
 }
 
-func tlsHandshake(conn0 net.Conn, tlsCfg *tls.Config) (*tls.Conn, error) {
+func tlsHandshake(conn0 net.Conn, tlsCfg *tls.Config, timeout time.Duration, logger *customLogger) (*tls.Conn, error) {
 	tlsConn := tls.Server(conn0, tlsCfg)
 
-	if err := tlsConn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
+	if err := tlsConn.SetDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, err
 	}
 
@@ -370,7 +618,7 @@ func tlsHandshake(conn0 net.Conn, tlsCfg *tls.Config) (*tls.Conn, error) {
 	return tlsConn, nil
 }
 
-func handleHTTP1Conn(ctx context.Context, tlsConn *tls.Conn, listenConfig *ListenConfig) {
+func handleHTTP1Conn(ctx context.Context, tlsConn *tls.Conn, runtime *proxyRuntime, draining <-chan struct{}) {
 	done := make(chan struct{})
 
 	go func() {
@@ -383,7 +631,9 @@ func handleHTTP1Conn(ctx context.Context, tlsConn *tls.Conn, listenConfig *Liste
 
 	defer close(done)
 
-	reader, ok, err := authHTTP1Request(tlsConn, listenConfig)
+	logger := runtime.inst.logger
+
+	tunnel, replay, err := authHTTP1Request(tlsConn, runtime)
 	if err != nil {
 		logger.PrintfX("[x] http1 auth/read failed from [%s]: [%s]\n",
 			tlsConn.RemoteAddr().String(),
@@ -392,11 +642,17 @@ func handleHTTP1Conn(ctx context.Context, tlsConn *tls.Conn, listenConfig *Liste
 		return
 	}
 
-	if !ok {
+	if tunnel == nil {
+		// 配置了回落站点时 replay 从第一个请求重新读起，整个连接交给回落 handler。
+		if replay != nil {
+			serveHTTP1Fallback(ctx, &replayConn{Conn: tlsConn, reader: replay}, runtime, draining)
+		}
 		return
 	}
 
-	negReq, err := parseRequest(tlsConn, reader, listenConfig.WithHttp)
+	defer tunnel.conn.Close()
+
+	negReq, err := parseRequest(tunnel.conn, tunnel.reader, runtime.listenConfig.WithHttp)
 	if err != nil {
 		if err != io.EOF {
 			logger.Printf("[x] parse request error [%s]\n", err.Error())
@@ -404,85 +660,190 @@ func handleHTTP1Conn(ctx context.Context, tlsConn *tls.Conn, listenConfig *Liste
 		return
 	}
 
+	negReq.User = tunnel.user
+	negReq.protocol = tunnel.protocol
+
+	handleNegotiationRequest(ctx, runtime.policy, negReq)
+}
+
+func handleNegotiationRequest(ctx context.Context, policy *accessPolicy, negReq *negotiationRequest) {
+	stats := policy.inst.stats.userTunnelStats(negReq.statsUser())
+	stats.streamStart()
+	defer stats.streamEnd()
+
+	ctx, negReq.metrics = policy.inst.beginStream(ctx,
+		policy.role,
+		negReq.protocol,
+		negReq.statsUser(),
+		negReq.Conn.RemoteAddr().String(),
+		negReq.Address,
+	)
+	defer negReq.metrics.end()
+
 	switch negReq.Method {
 	case methodSocks5:
-		handleSocks5(ctx, negReq)
+		handleSocks5(ctx, policy, negReq)
 
 	case methodHttp:
-		handleHttpRequest(ctx, negReq)
+		handleHttpRequest(ctx, policy, negReq)
 
 	default:
 		_ = negReq.Conn.Close()
 	}
 }
 
-func authHTTP1Request(tlsConn *tls.Conn, listenConfig *ListenConfig) (*bufio.Reader, bool, error) {
-	reader := bufio.NewReader(tlsConn)
+// http1Tunnel 是通过认证的 HTTP/1.1 隧道：Upgrade 后的原始连接，或 WebSocket 帧连接。
+type http1Tunnel struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	user     string
+	protocol string
+}
+
+// authHTTP1Request 读取并验证第一个请求，成功时回复 101 并返回隧道。
+// 验证失败且配置了回落站点时，返回的 replay 从第一个请求的开头重新读起；未配置时直接写内置页面。
+func authHTTP1Request(tlsConn *tls.Conn, runtime *proxyRuntime) (*http1Tunnel, *bufio.Reader, error) {
+	recorder := &recordingReader{r: tlsConn}
+	reader := bufio.NewReader(recorder)
 
 	_ = tlsConn.SetReadDeadline(time.Now().Add(8 * time.Second))
 	req, err := http.ReadRequest(reader)
 	_ = tlsConn.SetReadDeadline(time.Time{})
 
+	read := recorder.stop()
+
 	if err != nil {
-		return reader, false, err
+		return nil, nil, err
 	}
 
-	defer req.Body.Close()
+	state := tlsConn.ConnectionState()
+	req.TLS = &state
+	req.RemoteAddr = tlsConn.RemoteAddr().String()
 
-	if !validateHTTP1TunnelRequest(req, listenConfig) {
+	user, websocket, ok := validateHTTP1TunnelRequest(req, runtime)
+	if !ok {
+		if runtime.fallback != nil {
+			return nil, bufio.NewReader(io.MultiReader(bytes.NewReader(read), tlsConn)), nil
+		}
+
+		_ = req.Body.Close()
 		writeFallbackHTTP(tlsConn, req)
-		return reader, false, nil
+		return nil, nil, nil
 	}
 
-	if _, err := tlsConn.Write([]byte(
-		"HTTP/1.1 101 Switching Protocols\r\n" +
+	defer req.Body.Close()
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: " + runtime.listenConfig.upgradeToken() + "\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"\r\n"
+
+	if websocket {
+		resp = "HTTP/1.1 101 Switching Protocols\r\n" +
 			"Connection: Upgrade\r\n" +
-			"Upgrade: " + tunnelUpgradeToken + "\r\n" +
-			"Cache-Control: no-store\r\n" +
-			"\r\n",
-	)); err != nil {
-		return reader, false, err
+			"Upgrade: websocket\r\n" +
+			"Sec-WebSocket-Accept: " + webSocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+			"\r\n"
+	}
+
+	if _, err := tlsConn.Write([]byte(resp)); err != nil {
+		return nil, nil, err
 	}
 
-	return reader, true, nil
+	runtime.inst.logger.PrintfX("[*] tunnel authenticated user=[%s] from [%s]\n", user, tlsConn.RemoteAddr().String())
+
+	if !websocket {
+		return &http1Tunnel{conn: tlsConn, reader: reader, user: user, protocol: metricsProtocolHTTP1}, nil, nil
+	}
+
+	conn := newWebSocketConn(tlsConn, reader, false)
+
+	return &http1Tunnel{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		user:     user,
+		protocol: metricsProtocolWebSocket,
+	}, nil, nil
 }
 
-func handleH2Conn(ctx context.Context, tlsConn *tls.Conn, listenConfig *ListenConfig) {
+func handleH2Conn(ctx context.Context, tlsConn *tls.Conn, server *proxyServer) {
+	// 每个 stream 单独认证，使用当前生效的用户表与 ACL。
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handleH2Request(ctx, listenConfig, w, r)
+		handleH2Request(ctx, server.runtime.Load(), w, r)
 	})
 
-	server := &http2.Server{
-		MaxConcurrentStreams: maxClientH2Streams,
+	listenConfig := server.config()
+
+	h2Server := &http2.Server{
+		MaxConcurrentStreams: uint32(listenConfig.maxH2Streams()),
 
 		// 不做运行时健康检查。空闲连接由 IdleTimeout 关闭。
-		IdleTimeout: 30 * time.Second,
+		IdleTimeout: listenConfig.h2IdleTimeout(),
 
-		MaxUploadBufferPerConnection: 1 << 20,
-		MaxUploadBufferPerStream:     256 << 10,
+		MaxUploadBufferPerConnection: listenConfig.h2MaxUploadBufferPerConnection(),
+		MaxUploadBufferPerStream:     listenConfig.h2MaxUploadBufferPerStream(),
 	}
 
-	server.ServeConn(tlsConn, &http2.ServeConnOpts{
-		Handler: handler,
+	// ConfigureServer 使 base.Shutdown 向这个连接发送 GOAWAY：不再接受新 stream，已有 stream 继续。
+	base := &http.Server{}
+	if err := http2.ConfigureServer(base, h2Server); err != nil {
+		server.inst.logger.PrintfX("[x] configure h2 server failed: [%s]\n", err.Error())
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-server.draining:
+			_ = base.Shutdown(context.Background())
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = tlsConn.Close()
+		case <-done:
+		}
+	}()
+
+	h2Server.ServeConn(tlsConn, &http2.ServeConnOpts{
+		Handler:    handler,
+		BaseConfig: base,
 	})
 }
 
 func handleH2Request(
 	ctx context.Context,
-	listenConfig *ListenConfig,
+	runtime *proxyRuntime,
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	if r.URL == nil || r.URL.Path != tunnelPath {
-		writeFallbackHTTPResponse(w, r)
+	if r.URL == nil || !runtime.listenConfig.acceptsTunnelPath(r.URL.Path) {
+		serveFallbackHTTP(runtime, w, r)
 		return
 	}
 
-	if !validateH2TunnelRequest(r, listenConfig) {
-		writeFallbackHTTPResponse(w, r)
+	// 封禁前建立的 h2 连接与 HTTP/3 连接在这里拦截。
+	if runtime.inst.bans.banned(r.RemoteAddr) {
+		serveFallbackHTTP(runtime, w, r)
+		return
+	}
+
+	user, ok := validateH2TunnelRequest(r, runtime)
+	if !ok {
+		serveFallbackHTTP(runtime, w, r)
 		return
 	}
 
+	logger := runtime.inst.logger
+
+	logger.PrintfX("[*] tunnel authenticated user=[%s] from [%s]\n", user, r.RemoteAddr)
+
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
@@ -510,13 +871,14 @@ func handleH2Request(
 		r.Body,
 		w,
 		flusher,
+		localAddrFromRequest(r),
 		r.RemoteAddr,
 	)
 
 	defer streamConn.Close()
 	defer r.Body.Close()
 
-	negReq, err := parseRequest(streamConn, bufio.NewReader(streamConn), listenConfig.WithHttp)
+	negReq, err := parseRequest(streamConn, bufio.NewReader(streamConn), runtime.listenConfig.WithHttp)
 	if err != nil {
 		if err != io.EOF {
 			logger.PrintfX("[x] h2 parse request error: [%s]\n", err.Error())
@@ -524,83 +886,151 @@ func handleH2Request(
 		return
 	}
 
-	switch negReq.Method {
-	case methodSocks5:
-		handleSocks5(streamCtx, negReq)
-
-	case methodHttp:
-		handleHttpRequest(streamCtx, negReq)
-
-	default:
-		_ = negReq.Conn.Close()
+	negReq.User = user
+	negReq.protocol = metricsProtocolH2
+	if r.ProtoMajor == 3 {
+		negReq.protocol = metricsProtocolH3
 	}
+
+	handleNegotiationRequest(streamCtx, runtime.policy, negReq)
 }
 
-func validateHTTP1TunnelRequest(req *http.Request, listenConfig *ListenConfig) bool {
+// validateHTTP1TunnelRequest 校验 HTTP/1.1 隧道请求；带 Sec-WebSocket-Key 的是 WebSocket 帧模式，websocket 为 true。
+func validateHTTP1TunnelRequest(req *http.Request, runtime *proxyRuntime) (user string, websocket bool, ok bool) {
 	if req.Method != http.MethodGet {
-		return false
+		return "", false, false
 	}
 
-	if req.URL == nil || req.URL.Path != tunnelPath {
-		return false
+	if req.URL == nil || !runtime.listenConfig.acceptsTunnelPath(req.URL.Path) {
+		return "", false, false
 	}
 
 	if !headerContainsToken(req.Header.Get("Connection"), "Upgrade") {
-		return false
+		return "", false, false
 	}
 
-	if !strings.EqualFold(req.Header.Get("Upgrade"), tunnelUpgradeToken) {
-		return false
+	if req.Header.Get("Sec-WebSocket-Key") != "" {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), protoWebSocket) ||
+			req.Header.Get("Sec-WebSocket-Version") != "13" {
+			return "", false, false
+		}
+
+		user, ok = authenticateTunnelRequest(req, runtime, protoWebSocket, false)
+		return user, true, ok
+	}
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), runtime.listenConfig.upgradeToken()) {
+		return "", false, false
 	}
 
-	return validateTunnelSignature(req, listenConfig, protoHTTP1, true)
+	user, ok = authenticateTunnelRequest(req, runtime, protoHTTP1, true)
+	return user, false, ok
 }
 
-func validateH2TunnelRequest(req *http.Request, listenConfig *ListenConfig) bool {
-	if req.ProtoMajor != 2 {
-		return false
+// validateH2TunnelRequest 校验 h2 与 HTTP/3 隧道请求，两者都是 POST 到隧道路径，签名中的协议不同。
+func validateH2TunnelRequest(req *http.Request, runtime *proxyRuntime) (string, bool) {
+	var proto string
+
+	switch req.ProtoMajor {
+	case 2:
+		proto = protoH2
+	case 3:
+		proto = protoH3
+	default:
+		return "", false
 	}
 
 	if req.Method != http.MethodPost {
-		return false
+		return "", false
 	}
 
-	if req.URL == nil || req.URL.Path != tunnelPath {
-		return false
+	if req.URL == nil || !runtime.listenConfig.acceptsTunnelPath(req.URL.Path) {
+		return "", false
 	}
 
-	return validateTunnelSignature(req, listenConfig, protoH2, false)
+	return authenticateTunnelRequest(req, runtime, proto, false)
 }
 
+// authenticateTunnelRequest 优先使用连接上已验证的客户端证书（mTLS），没有时校验请求签名。
+func authenticateTunnelRequest(
+	req *http.Request,
+	runtime *proxyRuntime,
+	proto string,
+	allowLegacy bool,
+) (string, bool) {
+	if user, ok := runtime.clientCertUser(req.TLS); ok {
+		return user, true
+	}
+
+	if runtime.listenConfig.RequireClientCert {
+		runtime.authFailed(req, "client_cert")
+		return "", false
+	}
+
+	return validateTunnelSignature(req, runtime, proto, allowLegacy)
+}
+
+// validateTunnelSignature 校验隧道请求签名（Secret / Users 的 HMAC，或 AuthorizedKeysFile 中公钥的 Ed25519 签名），
+// 成功时返回解析出的用户名。
 func validateTunnelSignature(
 	req *http.Request,
-	listenConfig *ListenConfig,
+	runtime *proxyRuntime,
 	proto string,
 	allowLegacy bool,
-) bool {
-	nonce := strings.TrimSpace(req.Header.Get(headerSessionID))
+) (string, bool) {
+	headers := runtime.listenConfig.tunnelHeaders()
+
+	nonce := strings.TrimSpace(req.Header.Get(headers.SessionID))
 	if nonce == "" || len(nonce) > 128 {
-		return false
+		runtime.authFailed(req, "malformed")
+		return "", false
 	}
 
-	tsText := strings.TrimSpace(req.Header.Get(headerRequestTime))
+	tsText := strings.TrimSpace(req.Header.Get(headers.RequestTime))
 	ts, err := strconv.ParseInt(tsText, 10, 64)
 	if err != nil {
-		return false
+		runtime.authFailed(req, "malformed")
+		return "", false
 	}
 
 	now := time.Now().Unix()
 	if ts < now-authClockSkewSeconds || ts > now+authClockSkewSeconds {
-		return false
+		runtime.authFailed(req, "clock_skew")
+		return "", false
 	}
 
-	gotSig := strings.TrimSpace(req.Header.Get(headerRequestSignature))
+	gotSig := strings.TrimSpace(req.Header.Get(headers.Signature))
 	if gotSig == "" || len(gotSig) > 256 {
-		return false
+		runtime.authFailed(req, "malformed")
+		return "", false
+	}
+
+	keyID := strings.TrimSpace(req.Header.Get(headers.KeyID))
+
+	if encoded, ok := strings.CutPrefix(keyID, authKeyIDPrefix); ok {
+		msg := tunnelAuthMessageV2(req.Method, req.URL.Path, req.Host, nonce, ts, proto)
+
+		user, reason, ok := runtime.verifyAuthKey(encoded, msg, gotSig)
+		if !ok {
+			runtime.authFailed(req, reason)
+			return "", false
+		}
+
+		if !runtime.checkNonce(req, nonce, ts) {
+			return "", false
+		}
+
+		return user, true
+	}
+
+	user, secret, ok := runtime.lookupTunnelSecret(keyID)
+	if !ok {
+		runtime.authFailed(req, "unknown_key")
+		return "", false
 	}
 
 	expectedV2 := makeTunnelAuthSignatureV2(
-		listenConfig.Secret,
+		secret,
 		req.Method,
 		req.URL.Path,
 		req.Host,
@@ -613,7 +1043,7 @@ func validateTunnelSignature(
 
 	if !valid && allowLegacy {
 		expectedV1 := makeTunnelAuthSignature(
-			listenConfig.Secret,
+			secret,
 			req.URL.Path,
 			req.Host,
 			nonce,
@@ -624,16 +1054,48 @@ func validateTunnelSignature(
 	}
 
 	if !valid {
+		runtime.authFailed(req, "bad_signature")
+		return "", false
+	}
+
+	if !runtime.checkNonce(req, nonce, ts) {
+		return "", false
+	}
+
+	return user, true
+}
+
+// checkNonce 在签名通过后记录 nonce，nonce 已使用过或无法记录时返回 false。
+func (r *proxyRuntime) checkNonce(req *http.Request, nonce string, ts int64) bool {
+	metrics := r.inst.metrics
+
+	// nonce 需要记住到请求时间超出允许偏差为止。
+	seen, err := r.nonces.SeenOrAdd(nonce, time.Until(time.Unix(ts+authClockSkewSeconds, 0)))
+	if err != nil {
+		if errors.Is(err, errReplayCacheFull) {
+			metrics.replayRejected("cache_full")
+		} else {
+			metrics.replayRejected("store_error")
+		}
+		r.inst.logger.PrintfX("[x] replay check failed: [%s]\n", err.Error())
 		return false
 	}
 
-	if replayMap.SeenOrAdd(nonce, time.Duration(authClockSkewSeconds)*time.Second) {
+	if seen {
+		metrics.replayRejected("duplicate")
+		r.inst.bans.strike(r.inst, req.RemoteAddr, banReasonReplay)
 		return false
 	}
 
 	return true
 }
 
+// authFailed 记录认证失败，并计入来源 IP 的失败次数。
+func (r *proxyRuntime) authFailed(req *http.Request, reason string) {
+	r.inst.metrics.authFailure(reason)
+	r.inst.bans.strike(r.inst, req.RemoteAddr, reason)
+}
+
 func writeFallbackHTTP(conn net.Conn, req *http.Request) {
 	path := "/"
 	if req != nil && req.URL != nil {
@@ -765,69 +1227,27 @@ func parseRequest(c net.Conn, r *bufio.Reader, withHttp bool) (*negotiationReque
 			return nil, errors.New("invalid socks5 request version")
 		}
 
-		if reqHdr[1] != 0x01 {
+		switch reqHdr[1] {
+		case socks5CmdConnect, socks5CmdBind, socks5CmdUDPAssociate:
+		default:
 			writeSocks5Reply(c, 0x07)
 			return nil, errors.New("unsupported socks5 command")
 		}
 
-		atyp := reqHdr[3]
-		var host string
-
-		switch atyp {
-		case 0x01:
-			var addr [4]byte
-
-			if _, err := io.ReadFull(r, addr[:]); err != nil {
-				return nil, err
-			}
-
-			host = net.IP(addr[:]).String()
-
-		case 0x04:
-			var addr [16]byte
-
-			if _, err := io.ReadFull(r, addr[:]); err != nil {
-				return nil, err
-			}
-
-			host = net.IP(addr[:]).String()
-
-		case 0x03:
-			lb, err := r.ReadByte()
-			if err != nil {
-				return nil, err
-			}
-
-			l := int(lb)
-			if l <= 0 {
-				return nil, errors.New("invalid domain length")
-			}
-
-			domain := make([]byte, l)
-
-			if _, err := io.ReadFull(r, domain); err != nil {
-				return nil, err
+		address, err := readSocks5Address(r, reqHdr[3])
+		if err != nil {
+			if errors.Is(err, errSocks5AddressType) {
+				writeSocks5Reply(c, 0x08)
 			}
-
-			host = string(domain)
-
-		default:
-			writeSocks5Reply(c, 0x08)
-			return nil, errors.New("unsupported socks5 address type")
-		}
-
-		var pb [2]byte
-
-		if _, err := io.ReadFull(r, pb[:]); err != nil {
 			return nil, err
 		}
 
-		port := int(binary.BigEndian.Uint16(pb[:]))
-
 		return &negotiationRequest{
 			Conn:    c,
 			Method:  methodSocks5,
-			Address: net.JoinHostPort(host, strconv.Itoa(port)),
+			Command: reqHdr[1],
+			Address: address,
+			Reader:  r,
 		}, nil
 	}
 
@@ -842,29 +1262,55 @@ func parseRequest(c net.Conn, r *bufio.Reader, withHttp bool) (*negotiationReque
 	return nil, errors.New("unsupported protocol")
 }
 
-func handleSocks5(ctx context.Context, negotiationRequest *negotiationRequest) {
-	conn1, err := net.DialTimeout("tcp", negotiationRequest.Address, time.Duration(timeout)*time.Second)
+func handleSocks5(ctx context.Context, policy *accessPolicy, negotiationRequest *negotiationRequest) {
+	switch negotiationRequest.Command {
+	case socks5CmdBind:
+		handleSocks5Bind(ctx, policy, negotiationRequest)
+		return
+
+	case socks5CmdUDPAssociate:
+		handleSocks5UDPAssociate(ctx, policy, negotiationRequest)
+		return
+	}
+
+	logger := policy.inst.logger
+	stats := policy.inst.stats.userTunnelStats(negotiationRequest.statsUser())
+
+	conn1, err := dialTarget(ctx, policy, negotiationRequest.User, "tcp", negotiationRequest.Address)
 	if err != nil {
-		logger.PrintfX("[x] connect [%s] error [%s]\n",
+		logger.PrintfX("[x] connect [%s] user=[%s] error [%s]\n",
 			negotiationRequest.Address,
+			negotiationRequest.User,
 			err.Error(),
 		)
 
-		writeSocks5Reply(negotiationRequest.Conn, 0x05)
+		stats.streamFail()
+		writeSocks5Reply(negotiationRequest.Conn, socks5ReplyForDialError(err))
 		return
 	}
 
-	logger.PrintfX("[+] connect to [%s] success\n", negotiationRequest.Address)
+	logger.PrintfX("[+] connect to [%s] user=[%s] success\n",
+		negotiationRequest.Address,
+		negotiationRequest.User,
+	)
 
 	writeSocks5Reply(negotiationRequest.Conn, 0x00)
 
-	mutualCopyIO(ctx, negotiationRequest.Conn, conn1)
+	mutualCopyIO(ctx, negotiationRequest.Conn, newStatsConn(conn1, stats, negotiationRequest.metrics), policy.idleTimeout)
 
-	logger.PrintfX("[-] client [%s] disconnected\n",
+	logger.PrintfX("[-] client [%s] user=[%s] disconnected\n",
 		negotiationRequest.Conn.RemoteAddr().String(),
+		negotiationRequest.User,
 	)
 }
 
+func socks5ReplyForDialError(err error) byte {
+	if errors.Is(err, errAccessDenied) {
+		return 0x02
+	}
+	return 0x05
+}
+
 func writeSocks5Reply(conn net.Conn, rep byte) {
 	_, _ = conn.Write([]byte{
 		0x05,
@@ -879,3 +1325,91 @@ func writeSocks5Reply(conn net.Conn, rep byte) {
 		0x00,
 	})
 }
+
+func writeSocks5ReplyAddr(conn net.Conn, rep byte, addr net.Addr) {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	_, _ = conn.Write(appendSocks5Addr([]byte{0x05, rep, 0x00}, ip, port))
+}
+
+func appendSocks5Addr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 0x01)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, 0x04)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, 0x01, 0x00, 0x00, 0x00, 0x00)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+var errSocks5AddressType = errors.New("unsupported socks5 address type")
+
+// readSocks5Address 读取 ATYP 之后的 DST.ADDR 与 DST.PORT，返回 host:port。
+func readSocks5Address(r io.Reader, atyp byte) (string, error) {
+	var host string
+
+	switch atyp {
+	case 0x01:
+		var addr [4]byte
+
+		if _, err := io.ReadFull(r, addr[:]); err != nil {
+			return "", err
+		}
+
+		host = net.IP(addr[:]).String()
+
+	case 0x04:
+		var addr [16]byte
+
+		if _, err := io.ReadFull(r, addr[:]); err != nil {
+			return "", err
+		}
+
+		host = net.IP(addr[:]).String()
+
+	case 0x03:
+		var lb [1]byte
+
+		if _, err := io.ReadFull(r, lb[:]); err != nil {
+			return "", err
+		}
+
+		l := int(lb[0])
+		if l <= 0 {
+			return "", errors.New("invalid domain length")
+		}
+
+		domain := make([]byte, l)
+
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+
+		host = string(domain)
+
+	default:
+		return "", errSocks5AddressType
+	}
+
+	var pb [2]byte
+
+	if _, err := io.ReadFull(r, pb[:]); err != nil {
+		return "", err
+	}
+
+	port := int(binary.BigEndian.Uint16(pb[:]))
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
@@ -0,0 +1,52 @@
+package csocks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadSocks5Address(t *testing.T) {
+	tests := []struct {
+		name    string
+		atyp    byte
+		input   []byte
+		want    string
+		wantErr error
+	}{
+		{name: "ipv4", atyp: 0x01, input: []byte{127, 0, 0, 1, 0x04, 0x38}, want: "127.0.0.1:1080"},
+		{name: "ipv6", atyp: 0x04, input: []byte{15: 1, 16: 0, 17: 80}, want: "[::1]:80"},
+		{name: "domain", atyp: 0x03, input: append([]byte{11}, "example.com\x01\xbb"...), want: "example.com:443"},
+		{name: "max domain", atyp: 0x03, input: append(append([]byte{255}, strings.Repeat("a", 255)...), 0, 80), want: strings.Repeat("a", 255) + ":80"},
+		{name: "unsupported type", atyp: 0x02, input: []byte{1, 2, 3, 4, 0, 80}, wantErr: errSocks5AddressType},
+		{name: "empty", atyp: 0x01, input: nil, wantErr: io.EOF},
+		{name: "truncated ipv4", atyp: 0x01, input: []byte{127, 0}, wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated ipv6", atyp: 0x04, input: make([]byte, 15), wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated domain", atyp: 0x03, input: []byte{5, 'a', 'b'}, wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated port", atyp: 0x01, input: []byte{127, 0, 0, 1, 0x04}, wantErr: io.ErrUnexpectedEOF},
+		{name: "zero domain length", atyp: 0x03, input: []byte{0, 0, 80}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readSocks5Address(bytes.NewReader(tt.input), tt.atyp)
+
+			if tt.want != "" {
+				if err != nil || got != tt.want {
+					t.Fatalf("readSocks5Address = %q, %v; want %q", got, err, tt.want)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("readSocks5Address = %q; want an error", got)
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readSocks5Address error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,469 @@
+package csocks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	routeActionTunnel = "tunnel"
+	routeActionDirect = "direct"
+	routeActionBlock  = "block"
+
+	routeReloadInterval = 30 * time.Second
+)
+
+// RouteRule 是 forward 端的一条分流规则，按顺序匹配，第一条命中的规则生效。
+//
+// 目标维度由 DomainSuffix、DomainKeyword、CIDRs 组成，三者之间是“或”；Ports 与目标维度是“与”。
+// CIDRs 对域名目标会在本地解析后匹配。
+type RouteRule struct {
+	Action string `json:"action" yaml:"action" toml:"action"`
+
+	DomainSuffix  []string `json:"domain_suffix" yaml:"domain_suffix" toml:"domain_suffix"`
+	DomainKeyword []string `json:"domain_keyword" yaml:"domain_keyword" toml:"domain_keyword"`
+	CIDRs         []string `json:"cidrs" yaml:"cidrs" toml:"cidrs"`
+	Ports         []string `json:"ports" yaml:"ports" toml:"ports"`
+}
+
+type compiledRouteRule struct {
+	action string
+
+	suffixes []string
+	keywords []string
+	prefixes []netip.Prefix
+	ports    []aclPortRange
+}
+
+// routeTable 是由一份 ListenConfig 编译出的完整分流表。
+type routeTable struct {
+	rules         []compiledRouteRule
+	defaultAction string
+
+	listenConfig *ListenConfig
+	modTimes     map[string]time.Time
+
+	// direct 是直连目标时使用的策略（不做访问限制）。
+	direct *accessPolicy
+}
+
+// forwardRouter 持有当前生效的分流表；规则文件变化或热加载时整体替换。
+type forwardRouter struct {
+	inst  *instance
+	table atomic.Pointer[routeTable]
+}
+
+func newForwardRouter(listenConfig *ListenConfig, inst *instance) (*forwardRouter, error) {
+	router := &forwardRouter{
+		inst: inst,
+	}
+
+	if err := router.reload(listenConfig); err != nil {
+		return nil, err
+	}
+
+	return router, nil
+}
+
+func (r *forwardRouter) reload(listenConfig *ListenConfig) error {
+	table, err := loadRouteTable(listenConfig, r.inst)
+	if err != nil {
+		return err
+	}
+
+	r.table.Store(table)
+	return nil
+}
+
+func (r *forwardRouter) directPolicy() *accessPolicy {
+	return r.table.Load().direct
+}
+
+func (r *forwardRouter) enabled() bool {
+	t := r.table.Load()
+	return len(t.rules) > 0 || t.defaultAction != routeActionTunnel
+}
+
+// watch 定期检查规则文件的修改时间，有变化时重新加载。加载失败时保留旧规则。
+func (r *forwardRouter) watch(ctx context.Context) {
+	ticker := time.NewTicker(routeReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := r.table.Load()
+
+		if !routeFilesChanged(current.listenConfig.RouteRuleFiles, current.modTimes) {
+			continue
+		}
+
+		table, err := loadRouteTable(current.listenConfig, r.inst)
+		if err != nil {
+			r.inst.logger.Printf("[x] route rules reload failed: [%s]\n", err.Error())
+			continue
+		}
+
+		// 期间如果发生了热加载，以热加载的结果为准。
+		if !r.table.CompareAndSwap(current, table) {
+			continue
+		}
+
+		r.inst.logger.Printf("[*] route rules reloaded: %d rules\n", len(table.rules))
+	}
+}
+
+func routeFilesChanged(files []string, modTimes map[string]time.Time) bool {
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		if !info.ModTime().Equal(modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func loadRouteTable(listenConfig *ListenConfig, inst *instance) (*routeTable, error) {
+	table := &routeTable{
+		defaultAction: routeActionTunnel,
+		listenConfig:  listenConfig,
+		modTimes:      make(map[string]time.Time, len(listenConfig.RouteRuleFiles)),
+		direct:        newDirectPolicy(listenConfig, inst),
+	}
+
+	if listenConfig.RouteDefault != "" {
+		action, err := parseRouteAction(listenConfig.RouteDefault)
+		if err != nil {
+			return nil, fmt.Errorf("route_default: %w", err)
+		}
+		table.defaultAction = action
+	}
+
+	for i, rule := range listenConfig.RouteRules {
+		compiled, err := compileRouteRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("route_rules[%d]: %w", i, err)
+		}
+		table.rules = append(table.rules, compiled)
+	}
+
+	for _, file := range listenConfig.RouteRuleFiles {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		rules, err := readRouteRuleFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		table.rules = append(table.rules, rules...)
+		table.modTimes[file] = info.ModTime()
+	}
+
+	return table, nil
+}
+
+// readRouteRuleFile 读取规则文件，每行一条规则：
+//
+//	<tunnel|direct|block> <domain-suffix|domain-keyword|cidr|port> <value>[,<value>...]
+//
+// 空行与 # 开头的行会被忽略。
+func readRouteRuleFile(file string) ([]compiledRouteRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var rules []compiledRouteRule
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"<action> <type> <value>\"", file, lineNo)
+		}
+
+		rule := RouteRule{Action: fields[0]}
+		values := strings.Split(fields[2], ",")
+
+		switch strings.ToLower(fields[1]) {
+		case "domain-suffix":
+			rule.DomainSuffix = values
+		case "domain-keyword":
+			rule.DomainKeyword = values
+		case "cidr":
+			rule.CIDRs = values
+		case "port":
+			rule.Ports = values
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown rule type %q", file, lineNo, fields[1])
+		}
+
+		compiled, err := compileRouteRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+		}
+
+		rules = append(rules, compiled)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseRouteAction(action string) (string, error) {
+	switch a := strings.ToLower(strings.TrimSpace(action)); a {
+	case routeActionTunnel, routeActionDirect, routeActionBlock:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown route action %q", action)
+	}
+}
+
+func compileRouteRule(rule RouteRule) (compiledRouteRule, error) {
+	var out compiledRouteRule
+
+	action, err := parseRouteAction(rule.Action)
+	if err != nil {
+		return out, err
+	}
+	out.action = action
+
+	for _, d := range rule.DomainSuffix {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d == "" {
+			return out, errors.New("empty domain suffix")
+		}
+		out.suffixes = append(out.suffixes, d)
+	}
+
+	for _, k := range rule.DomainKeyword {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k == "" {
+			return out, errors.New("empty domain keyword")
+		}
+		out.keywords = append(out.keywords, k)
+	}
+
+	for _, c := range rule.CIDRs {
+		prefix, err := parseACLPrefix(c)
+		if err != nil {
+			return out, err
+		}
+		out.prefixes = append(out.prefixes, prefix)
+	}
+
+	ports, err := parsePortRanges(rule.Ports)
+	if err != nil {
+		return out, err
+	}
+	out.ports = ports
+
+	return out, nil
+}
+
+// routeTarget 是一次路由判断的目标；域名目标的 IP 只在遇到 CIDR 规则时才解析一次。
+type routeTarget struct {
+	ctx     context.Context
+	timeout time.Duration
+	domain  string
+	port    int
+
+	ips      []netip.Addr
+	resolved bool
+}
+
+func (t *routeTarget) addrs() []netip.Addr {
+	if t.resolved {
+		return t.ips
+	}
+
+	t.resolved = true
+
+	lookupCtx, cancel := context.WithTimeout(t.ctx, t.timeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupNetIP(lookupCtx, "ip", t.domain)
+	if err != nil {
+		return nil
+	}
+
+	for _, ip := range ips {
+		t.ips = append(t.ips, ip.Unmap())
+	}
+
+	return t.ips
+}
+
+func (r *compiledRouteRule) match(target *routeTarget) bool {
+	if len(r.ports) > 0 && !portInRanges(r.ports, target.port) {
+		return false
+	}
+
+	if len(r.suffixes) == 0 && len(r.keywords) == 0 && len(r.prefixes) == 0 {
+		return true
+	}
+
+	if target.domain != "" {
+		for _, s := range r.suffixes {
+			if target.domain == s || strings.HasSuffix(target.domain, "."+s) {
+				return true
+			}
+		}
+
+		for _, k := range r.keywords {
+			if strings.Contains(target.domain, k) {
+				return true
+			}
+		}
+	}
+
+	if len(r.prefixes) == 0 {
+		return false
+	}
+
+	for _, ip := range target.addrs() {
+		for _, prefix := range r.prefixes {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// decide 返回 address（host:port）对应的路由动作。
+func (r *forwardRouter) decide(ctx context.Context, address string) string {
+	table := r.table.Load()
+
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return table.defaultAction
+	}
+
+	port, _ := strconv.Atoi(portText)
+
+	target := &routeTarget{
+		ctx:     ctx,
+		timeout: table.listenConfig.timeout(),
+		port:    port,
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		target.ips = []netip.Addr{ip.Unmap()}
+		target.resolved = true
+	} else {
+		target.domain = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+
+	for i := range table.rules {
+		if table.rules[i].match(target) {
+			return table.rules[i].action
+		}
+	}
+
+	return table.defaultAction
+}
+
+// httpProxyTarget 从 HTTP 代理请求中取出目标 host:port。
+func httpProxyTarget(req *http.Request) string {
+	host := req.Host
+	if req.URL != nil && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	if req.Method == http.MethodConnect || (req.URL != nil && req.URL.Scheme == "https") {
+		port = "443"
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// handleDirectSocks5Bind 在本地完成 BIND：监听与接受对端都在 forward 端进行。
+func handleDirectSocks5Bind(ctx context.Context, policy *accessPolicy, conn0 net.Conn, address string) {
+	defer conn0.Close()
+
+	handleNegotiationRequest(ctx, policy, &negotiationRequest{
+		Conn:    conn0,
+		Method:  methodSocks5,
+		Command: socks5CmdBind,
+		Address: address,
+
+		protocol: metricsProtocolDirect,
+		route:    routeActionDirect,
+	})
+}
+
+// handleDirectSocks5 直连目标并在本地回复 SOCKS5 应答。
+func handleDirectSocks5(ctx context.Context, policy *accessPolicy, conn0 net.Conn, address string) {
+	defer conn0.Close()
+
+	logger := policy.inst.logger
+	stats := policy.inst.stats.userTunnelStats(routeActionDirect)
+	stats.streamStart()
+	defer stats.streamEnd()
+
+	ctx, metrics := policy.inst.beginStream(ctx,
+		policy.role,
+		metricsProtocolDirect,
+		routeActionDirect,
+		conn0.RemoteAddr().String(),
+		address,
+	)
+	defer metrics.end()
+
+	conn1, err := dialTarget(ctx, policy, routeActionDirect, "tcp", address)
+	if err != nil {
+		logger.PrintfX("[x] direct connect [%s] error [%s]\n", address, err.Error())
+		stats.streamFail()
+		writeSocks5Reply(conn0, 0x05)
+		return
+	}
+
+	writeSocks5ReplyAddr(conn0, 0x00, conn1.LocalAddr())
+
+	mutualCopyIO(ctx, conn0, newStatsConn(conn1, stats, metrics), policy.idleTimeout)
+
+	logger.PrintfX("[-] direct [%s] closed\n", address)
+}
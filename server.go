@@ -0,0 +1,327 @@
+package csocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// service 是 proxyServer 或 forwardServer。
+type service interface {
+	reloader
+	// serve 在 ctx 结束时停止接受连接并开始 drain，force 结束时强制关闭剩余连接。
+	serve(ctx context.Context, ln net.Listener, force context.Context) error
+}
+
+// newService 按配置的模式构建服务端或 forward 端。
+func newService(ctx context.Context, listenConfig *ListenConfig, inst *instance) (service, error) {
+	if listenConfig.isForward() {
+		server, err := newForwardServer(ctx, listenConfig, inst)
+		if err != nil {
+			return nil, err
+		}
+		return server, nil
+	}
+
+	server, err := newProxyServer(listenConfig, inst)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// serveSideListeners 启动配置中的指标与管理接口监听，它们在 ctx 结束时关闭。
+func serveSideListeners(ctx context.Context, listenConfig *ListenConfig, inst *instance) error {
+	if err := serveMetrics(ctx, listenConfig, inst); err != nil {
+		return err
+	}
+	return serveAdmin(ctx, listenConfig, inst)
+}
+
+// Server 是一个服务端实例，拥有独立的日志、流量统计和防重放缓存，
+// 同一进程中可以运行多个 Server 与 Client。
+type Server struct {
+	listenConfig *ListenConfig
+
+	// Quiet、LogSink 与 SignalReload 在 Start 之前设置。
+	Quiet   bool
+	LogSink LogSink
+
+	// SignalReload 为 true 时收到 SIGHUP 热加载这个实例（NoSignalReload 仍然生效）。
+	// 默认不监听，以免一个信号热加载进程中的所有实例，或干扰宿主程序自己的信号处理。
+	SignalReload bool
+
+	node node
+}
+
+// NewServer 创建服务端实例，listenConfig 必须是服务端模式（设置了 ServerCertFile）。
+func NewServer(listenConfig *ListenConfig) *Server {
+	return &Server{listenConfig: listenConfig}
+}
+
+// Start 校验配置、开始监听并在后台接受连接，监听失败时返回错误。
+func (s *Server) Start() error {
+	if s.listenConfig.isForward() {
+		return errors.New("server_address / servers: not allowed for Server, use Client")
+	}
+	return s.node.start(s.listenConfig, s.Quiet, s.LogSink, s.SignalReload)
+}
+
+// Shutdown 停止接受新连接并等待已有连接处理结束，服务端 h2 连接发送 GOAWAY。
+// ctx 结束或超过 DrainTimeout（非 0 时）后关闭剩余连接；因 ctx 结束而关闭时返回 ctx.Err()。
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.node.shutdown(ctx)
+}
+
+// Addr 返回实际监听的地址，未启动时返回 nil。
+func (s *Server) Addr() net.Addr {
+	return s.node.addr()
+}
+
+// Reload 热加载配置，规则同包级的 Reload。
+func (s *Server) Reload(listenConfig *ListenConfig) error {
+	return s.node.reload(listenConfig)
+}
+
+// UserStats 返回这个实例按用户统计的流量。
+func (s *Server) UserStats() map[string]TunnelStatsSnapshot {
+	return s.node.stats().userSnapshots()
+}
+
+// ResetStats 清零累计统计，活跃数不变。
+func (s *Server) ResetStats() {
+	s.node.stats().reset()
+}
+
+// Sessions 返回活跃连接；user 非空时只返回该用户的。
+func (s *Server) Sessions(user string) []SessionInfo {
+	return s.node.sessions().list(user)
+}
+
+// CloseSession 关闭一个连接，不存在时返回 false。
+func (s *Server) CloseSession(id uint64) bool {
+	return s.node.sessions().close(id)
+}
+
+// CloseUserSessions 关闭 user 的所有连接，返回关闭的数量。
+func (s *Server) CloseUserSessions(user string) int {
+	return s.node.sessions().closeUser(user)
+}
+
+// Client 是一个 forward 端实例，拥有独立的日志、流量统计和服务端池。
+type Client struct {
+	listenConfig *ListenConfig
+
+	// Quiet、LogSink 与 SignalReload 在 Start 之前设置。
+	Quiet   bool
+	LogSink LogSink
+
+	// SignalReload 为 true 时收到 SIGHUP 热加载这个实例（NoSignalReload 仍然生效）。
+	// 默认不监听，以免一个信号热加载进程中的所有实例，或干扰宿主程序自己的信号处理。
+	SignalReload bool
+
+	node node
+}
+
+// NewClient 创建 forward 端实例，listenConfig 必须是客户端模式（设置了 ServerAddress 或 Servers）。
+func NewClient(listenConfig *ListenConfig) *Client {
+	return &Client{listenConfig: listenConfig}
+}
+
+// Start 校验配置、检查服务端是否可用、开始监听并在后台接受连接。
+func (c *Client) Start() error {
+	if !c.listenConfig.isForward() {
+		return errors.New("server_address: is required for Client")
+	}
+	return c.node.start(c.listenConfig, c.Quiet, c.LogSink, c.SignalReload)
+}
+
+// Shutdown 停止接受新连接并等待已有连接处理结束，服务端 h2 连接发送 GOAWAY。
+// ctx 结束或超过 DrainTimeout（非 0 时）后关闭剩余连接；因 ctx 结束而关闭时返回 ctx.Err()。
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.node.shutdown(ctx)
+}
+
+// Addr 返回本地实际监听的地址，未启动时返回 nil。
+func (c *Client) Addr() net.Addr {
+	return c.node.addr()
+}
+
+// Reload 热加载配置，规则同包级的 Reload。
+func (c *Client) Reload(listenConfig *ListenConfig) error {
+	return c.node.reload(listenConfig)
+}
+
+// Stats 返回这个实例的总体流量统计。
+func (c *Client) Stats() TunnelStatsSnapshot {
+	return c.node.stats().total.snapshot()
+}
+
+// UpstreamStats 返回这个实例各上游服务端的健康状态、延迟与选择情况。
+func (c *Client) UpstreamStats() []UpstreamStatsSnapshot {
+	return c.node.stats().upstreamSnapshots()
+}
+
+// ResetStats 清零累计统计，活跃数不变。
+func (c *Client) ResetStats() {
+	c.node.stats().reset()
+}
+
+// Sessions 返回活跃连接；user 非空时只返回该用户的。
+func (c *Client) Sessions(user string) []SessionInfo {
+	return c.node.sessions().list(user)
+}
+
+// CloseSession 关闭一个连接，不存在时返回 false。
+func (c *Client) CloseSession(id uint64) bool {
+	return c.node.sessions().close(id)
+}
+
+// CloseUserSessions 关闭 user 的所有连接，返回关闭的数量。
+func (c *Client) CloseUserSessions(user string) int {
+	return c.node.sessions().closeUser(user)
+}
+
+// node 是 Server 与 Client 共用的生命周期管理。
+type node struct {
+	mu     sync.Mutex
+	svc    service
+	ln     net.Listener
+	cancel context.CancelFunc
+	force  context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	errNotStarted     = errors.New("not started")
+	errAlreadyStarted = errors.New("already started")
+)
+
+func (n *node) start(listenConfig *ListenConfig, quiet bool, sink LogSink, signalReload bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.done != nil {
+		return errAlreadyStarted
+	}
+
+	if err := listenConfig.Validate(); err != nil {
+		return err
+	}
+
+	inst := newInstance(quiet, sink)
+
+	inst.logger.Printf("[*] csocks version: [%s]\n", Version)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	svc, err := newService(ctx, listenConfig, inst)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	ln, err := listen(listenConfig.ListenPort)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if err := serveSideListeners(ctx, listenConfig, inst); err != nil {
+		cancel()
+		_ = ln.Close()
+		return err
+	}
+
+	if signalReload && !listenConfig.NoSignalReload {
+		go watchReloadSignal(ctx, svc)
+	}
+
+	// 没有 DrainTimeout 时只由 Shutdown 的 ctx 决定何时强制关闭。
+	force := context.Background()
+	if listenConfig.drainTimeout() > 0 {
+		force = drainContext(ctx, listenConfig.drainTimeout())
+	}
+	force, forceCancel := context.WithCancel(force)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer forceCancel()
+		_ = svc.serve(ctx, ln, force)
+	}()
+
+	n.svc = svc
+	n.ln = ln
+	n.cancel = cancel
+	n.force = forceCancel
+	n.done = done
+
+	return nil
+}
+
+func (n *node) shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	cancel, force, done := n.cancel, n.force, n.done
+	n.mu.Unlock()
+
+	if done == nil {
+		return errNotStarted
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		force()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (n *node) addr() net.Addr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ln == nil {
+		return nil
+	}
+	return n.ln.Addr()
+}
+
+func (n *node) reload(listenConfig *ListenConfig) error {
+	n.mu.Lock()
+	svc := n.svc
+	n.mu.Unlock()
+
+	if svc == nil {
+		return errNotStarted
+	}
+	return applyReload(svc, listenConfig)
+}
+
+// sessions 返回实例的会话表；未启动时返回空表。
+func (n *node) sessions() *sessionRegistry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.svc == nil {
+		return &sessionRegistry{}
+	}
+	return &n.svc.env().sessions
+}
+
+// stats 返回实例的统计；未启动时返回空统计。
+func (n *node) stats() *instanceStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.svc == nil {
+		return &instanceStats{}
+	}
+	return n.svc.env().stats
+}
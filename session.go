@@ -0,0 +1,151 @@
+package csocks
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo 是一个活跃 stream 的快照。
+type SessionInfo struct {
+	ID       uint64 `json:"id"`
+	Role     string `json:"role"`
+	Protocol string `json:"protocol"`
+	User     string `json:"user"`
+
+	ClientAddress string `json:"client_address"`
+	TargetAddress string `json:"target_address"`
+
+	StartedAt time.Time `json:"started_at"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+}
+
+// session 是会话表中的一个活跃 stream，cancel 取消 stream 的 ctx，处理函数随之关闭两端连接。
+type session struct {
+	id         uint64
+	role       string
+	protocol   string
+	user       string
+	clientAddr string
+	start      time.Time
+
+	mu     sync.Mutex
+	target string
+
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
+
+	cancel context.CancelFunc
+}
+
+func (s *session) setTarget(target string) {
+	s.mu.Lock()
+	s.target = target
+	s.mu.Unlock()
+}
+
+func (s *session) info() SessionInfo {
+	s.mu.Lock()
+	target := s.target
+	s.mu.Unlock()
+
+	return SessionInfo{
+		ID:            s.id,
+		Role:          s.role,
+		Protocol:      s.protocol,
+		User:          s.user,
+		ClientAddress: s.clientAddr,
+		TargetAddress: target,
+		StartedAt:     s.start,
+		BytesUp:       s.bytesUp.Load(),
+		BytesDown:     s.bytesDown.Load(),
+	}
+}
+
+// sessionRegistry 记录一个实例的所有活跃 stream。
+type sessionRegistry struct {
+	nextID   atomic.Uint64
+	sessions sync.Map
+}
+
+// beginStream 登记一个 stream：计入指标并加入会话表。
+// 返回的 ctx 在会话被关闭时取消；stream 结束时调用 streamMetrics.end。
+func (inst *instance) beginStream(
+	ctx context.Context,
+	role, protocol, user, clientAddr, target string,
+) (context.Context, *streamMetrics) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &session{
+		id:         inst.sessions.nextID.Add(1),
+		role:       role,
+		protocol:   protocol,
+		user:       metricsUser(user),
+		clientAddr: clientAddr,
+		start:      time.Now(),
+		target:     target,
+		cancel:     cancel,
+	}
+
+	inst.sessions.sessions.Store(s.id, s)
+
+	metrics := inst.metrics.startStream(role, protocol, user)
+	metrics.session = s
+	metrics.sessions = &inst.sessions
+
+	return ctx, metrics
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.sessions.Delete(s.id)
+	s.cancel()
+}
+
+// list 返回活跃会话，按 ID 排序；user 非空时只返回该用户的。
+func (r *sessionRegistry) list(user string) []SessionInfo {
+	out := make([]SessionInfo, 0)
+
+	r.sessions.Range(func(_, v any) bool {
+		s := v.(*session)
+		if user == "" || s.user == user {
+			out = append(out, s.info())
+		}
+		return true
+	})
+
+	slices.SortFunc(out, func(a, b SessionInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return out
+}
+
+// close 关闭一个会话，不存在时返回 false。
+func (r *sessionRegistry) close(id uint64) bool {
+	v, ok := r.sessions.Load(id)
+	if !ok {
+		return false
+	}
+
+	v.(*session).cancel()
+	return true
+}
+
+// closeUser 关闭 user 的所有会话，返回关闭的数量。
+func (r *sessionRegistry) closeUser(user string) int {
+	n := 0
+
+	r.sessions.Range(func(_, v any) bool {
+		if s := v.(*session); s.user == user {
+			s.cancel()
+			n++
+		}
+		return true
+	})
+
+	return n
+}
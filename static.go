@@ -0,0 +1,164 @@
+package csocks
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const fallbackNotFoundPage = "404.html"
+
+// staticSite 像普通网站一样提供一个目录：index.html、Content-Type、ETag / Last-Modified、Range 请求，
+// 找不到时使用目录中的 404.html。不列目录。
+type staticSite struct {
+	fsys fs.FS
+}
+
+// newStaticSite 使用 fsys；fsys 为 nil 时使用目录 dir。
+func newStaticSite(dir string, fsys fs.FS) (*staticSite, error) {
+	if fsys == nil {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%q is not a directory", dir)
+		}
+
+		fsys = os.DirFS(dir)
+	}
+
+	return &staticSite{fsys: fsys}, nil
+}
+
+func (s *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, info, err := s.open(name)
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	if info.IsDir() {
+		_ = f.Close()
+
+		// 目录需要以 / 结尾，页面中的相对链接才正确。
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+
+		f, info, err = s.open(path.Join(name, "index.html"))
+		if err != nil || info.IsDir() {
+			if f != nil {
+				_ = f.Close()
+			}
+			s.notFound(w, r)
+			return
+		}
+	}
+
+	defer f.Close()
+
+	s.serveFile(w, r, f, info)
+}
+
+func (s *staticSite) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+func (s *staticSite) notFound(w http.ResponseWriter, r *http.Request) {
+	f, info, err := s.open(fallbackNotFoundPage)
+	if err != nil || info.IsDir() {
+		if f != nil {
+			_ = f.Close()
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("<!doctype html><html><head><meta charset=\"utf-8\"><title>Not Found</title></head><body><h1>404 Not Found</h1></body></html>"))
+		return
+	}
+
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(content)
+	}
+}
+
+// serveFile 由 http.ServeContent 处理 Content-Type、条件请求与 Range。
+func (s *staticSite) serveFile(w http.ResponseWriter, r *http.Request, f fs.File, info fs.FileInfo) {
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	etag, err := staticETag(content, info)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+}
+
+// staticETag 由大小与修改时间生成；没有修改时间（例如 embed.FS）时使用内容的哈希。
+func staticETag(content io.ReadSeeker, info fs.FileInfo) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()), nil
+	}
+
+	h := fnv.New64a()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, h.Sum64(), info.Size()), nil
+}
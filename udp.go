@@ -0,0 +1,531 @@
+package csocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// UDP ASSOCIATE 的数据报在隧道内按帧传输：
+//
+//	LEN(2, big endian) | ATYP | ADDR | PORT | DATA
+//
+// 即 SOCKS5 UDP 请求头去掉 RSV 与 FRAG。上行帧里的地址是目标地址，下行帧里的地址是来源地址。
+
+const (
+	maxUDPFramePayload = 65535
+
+	// ATYP + IPv6 + PORT，服务端回包帧的最大地址开销。
+	maxSocks5IPAddrLen = 1 + 16 + 2
+
+	// 每个关联最多缓存的目标地址解析结果（服务端）或分流结果（forward 端）。
+	maxUDPResolveCache = 256
+)
+
+func writeUDPFrame(w io.Writer, payload []byte) error {
+	if len(payload) > maxUDPFramePayload {
+		return errors.New("udp frame too large")
+	}
+
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	copy(frame[2:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readUDPFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var hdr [2]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(buf) {
+		return nil, errors.New("udp frame too large")
+	}
+
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// splitUDPPayload 拆出帧内的地址与数据。
+func splitUDPPayload(payload []byte) (string, []byte, error) {
+	if len(payload) == 0 {
+		return "", nil, errors.New("empty udp frame")
+	}
+
+	r := bytes.NewReader(payload[1:])
+
+	address, err := readSocks5Address(r, payload[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return address, payload[len(payload)-r.Len():], nil
+}
+
+// udpIdleTimer 在关联空闲超过 idle 后调用 onIdle。
+type udpIdleTimer struct {
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func newUDPIdleTimer(idle time.Duration, onIdle func()) *udpIdleTimer {
+	return &udpIdleTimer{
+		timer: time.AfterFunc(idle, onIdle),
+		idle:  idle,
+	}
+}
+
+func (t *udpIdleTimer) touch() {
+	t.timer.Reset(t.idle)
+}
+
+func (t *udpIdleTimer) stop() {
+	t.timer.Stop()
+}
+
+// udpRoute 是 forward 端对一个 UDP 目标的分流结果；direct 时 dst 是解析后的地址。
+type udpRoute struct {
+	action string
+	dst    *net.UDPAddr
+}
+
+// udpRouteCache 按目标缓存一个关联内的分流结果，直连目标解析失败时不缓存，下一个数据报重试。
+type udpRouteCache struct {
+	router *forwardRouter
+	logger *customLogger
+	routes map[string]udpRoute
+}
+
+func (c *udpRouteCache) lookup(ctx context.Context, address string) (udpRoute, error) {
+	if route, ok := c.routes[address]; ok {
+		return route, nil
+	}
+
+	route := udpRoute{action: c.router.decide(ctx, address)}
+
+	if route.action == routeActionDirect {
+		dst, err := resolveUDPTarget(ctx, c.router.directPolicy(), "", address)
+		if err != nil {
+			return route, err
+		}
+		route.dst = dst
+	}
+
+	if route.action != routeActionTunnel {
+		c.logger.PrintfX("[*] route [%s] udp target=[%s]\n", route.action, address)
+	}
+
+	if len(c.routes) >= maxUDPResolveCache {
+		clear(c.routes)
+	}
+	c.routes[address] = route
+
+	return route, nil
+}
+
+// handleForwardUDPAssociate 在本地开启 UDP 中继，并把数据报按帧通过一条隧道 stream 发给服务端。
+// 配置了分流时按每个数据报的目标分流：block 丢弃，direct 从本地的另一个 UDP socket 直接发出。
+// 关联在控制连接关闭或空闲超时后结束。
+func handleForwardUDPAssociate(
+	ctx context.Context,
+	conn0 net.Conn,
+	pool *upstreamPool,
+	router *forwardRouter,
+) {
+	defer conn0.Close()
+
+	logger := pool.inst.logger
+	stats := &pool.inst.stats.total
+
+	localIP := net.IPv4zero
+	if addr, ok := conn0.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+
+	var clientIP net.IP
+	if addr, ok := conn0.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		logger.PrintfX("[x] udp relay listen failed: [%s]\n", err.Error())
+		writeSocks5Reply(conn0, 0x01)
+		return
+	}
+
+	defer udpConn.Close()
+
+	tunnel, err := openUDPTunnel(ctx, pool)
+	if err != nil {
+		logger.PrintfX("[x] udp tunnel failed: [%s]\n", err.Error())
+		writeSocks5Reply(conn0, 0x01)
+		return
+	}
+
+	defer tunnel.Close()
+
+	writeSocks5ReplyAddr(conn0, 0x00, udpConn.LocalAddr())
+
+	stats.udpAssociationStart()
+	defer stats.udpAssociationEnd()
+
+	logger.PrintfX("[+] udp association [%s] relay on [%s]\n",
+		conn0.RemoteAddr().String(),
+		udpConn.LocalAddr().String(),
+	)
+
+	assocCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	idle := newUDPIdleTimer(udpAssociationIdleTimeout, cancel)
+	defer idle.stop()
+
+	go func() {
+		<-assocCtx.Done()
+		_ = udpConn.Close()
+		_ = tunnel.Close()
+		_ = conn0.Close()
+	}()
+
+	// 控制连接上不会再有数据，读到 EOF 即表示客户端结束了关联。
+	go func() {
+		_, _ = io.Copy(io.Discard, conn0)
+		cancel()
+	}()
+
+	var clientAddr atomic.Pointer[net.UDPAddr]
+
+	go func() {
+		defer cancel()
+
+		buf := make([]byte, maxUDPFramePayload)
+		packet := make([]byte, 3+maxUDPFramePayload)
+
+		for {
+			payload, err := readUDPFrame(tunnel, buf)
+			if err != nil {
+				return
+			}
+
+			dst := clientAddr.Load()
+			if dst == nil {
+				continue
+			}
+
+			n := copy(packet[3:], payload)
+			if _, err := udpConn.WriteToUDP(packet[:3+n], dst); err != nil {
+				return
+			}
+
+			idle.touch()
+			stats.udpPacketDown()
+		}
+	}()
+
+	routes := &udpRouteCache{
+		router: router,
+		logger: logger,
+		routes: make(map[string]udpRoute),
+	}
+
+	// direct 在第一个直连的数据报时创建，回包由 relayDirectUDP 写回客户端。
+	var direct *net.UDPConn
+	defer func() {
+		if direct != nil {
+			_ = direct.Close()
+		}
+	}()
+
+	buf := make([]byte, 3+maxUDPFramePayload)
+
+	for {
+		n, src, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		if clientIP != nil && !src.IP.Equal(clientIP) {
+			continue
+		}
+
+		// 不支持分片：FRAG 非 0 的数据报直接丢弃。
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+
+		clientAddr.Store(src)
+
+		payload := buf[3:n]
+
+		if router.enabled() {
+			address, data, err := splitUDPPayload(payload)
+			if err != nil {
+				continue
+			}
+
+			route, err := routes.lookup(assocCtx, address)
+			if err != nil {
+				logger.PrintfX("[x] udp direct resolve [%s] error [%s]\n", address, err.Error())
+				continue
+			}
+
+			switch route.action {
+			case routeActionBlock:
+				continue
+
+			case routeActionDirect:
+				if direct == nil {
+					if direct, err = net.ListenUDP("udp", nil); err != nil {
+						logger.PrintfX("[x] udp direct listen failed: [%s]\n", err.Error())
+						continue
+					}
+					go relayDirectUDP(direct, udpConn, &clientAddr, idle, stats)
+				}
+
+				if _, err := direct.WriteToUDP(data, route.dst); err != nil {
+					logger.PrintfX("[x] udp direct send [%s] error [%s]\n", address, err.Error())
+					continue
+				}
+
+				idle.touch()
+				stats.udpPacketUp()
+				continue
+			}
+		}
+
+		if err := writeUDPFrame(tunnel, payload); err != nil {
+			break
+		}
+
+		idle.touch()
+		stats.udpPacketUp()
+	}
+
+	logger.PrintfX("[-] udp association [%s] closed\n", conn0.RemoteAddr().String())
+}
+
+// relayDirectUDP 把直连目标的回包加上 SOCKS5 UDP 请求头写回客户端，直到 direct 被关闭。
+func relayDirectUDP(
+	direct, udpConn *net.UDPConn,
+	clientAddr *atomic.Pointer[net.UDPAddr],
+	idle *udpIdleTimer,
+	stats *tunnelStats,
+) {
+	buf := make([]byte, maxUDPFramePayload)
+	packet := make([]byte, 0, 3+maxSocks5IPAddrLen+maxUDPFramePayload)
+
+	for {
+		n, src, err := direct.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		dst := clientAddr.Load()
+		if dst == nil {
+			continue
+		}
+
+		packet = appendSocks5Addr(append(packet[:0], 0x00, 0x00, 0x00), src.IP, src.Port)
+		packet = append(packet, buf[:n]...)
+
+		if _, err := udpConn.WriteToUDP(packet, dst); err != nil {
+			return
+		}
+
+		idle.touch()
+		stats.udpPacketDown()
+	}
+}
+
+// openUDPTunnel 通过现有的 h2 / HTTP/1.1 通道建立一条 stream，并完成 UDP ASSOCIATE 协商。
+func openUDPTunnel(
+	ctx context.Context,
+	pool *upstreamPool,
+) (net.Conn, error) {
+	local, remote := net.Pipe()
+
+	go handleForwardTunnel(ctx, remote, pool, "")
+
+	_ = local.SetDeadline(time.Now().Add(2 * pool.listenConfig.timeout()))
+
+	req := append([]byte{}, socks5NoAuthGreeting...)
+	req = append(req, 0x05, socks5CmdUDPAssociate, 0x00)
+	req = appendSocks5Addr(req, net.IPv4zero, 0)
+
+	if _, err := local.Write(req); err != nil {
+		_ = local.Close()
+		return nil, err
+	}
+
+	var resp [6]byte
+
+	if _, err := io.ReadFull(local, resp[:]); err != nil {
+		_ = local.Close()
+		return nil, err
+	}
+
+	if resp[0] != 0x05 || resp[1] != 0x00 {
+		_ = local.Close()
+		return nil, errors.New("udp associate auth rejected")
+	}
+
+	if resp[3] != 0x00 {
+		_ = local.Close()
+		return nil, errors.New("udp associate rejected by server")
+	}
+
+	if _, err := readSocks5Address(local, resp[5]); err != nil {
+		_ = local.Close()
+		return nil, err
+	}
+
+	_ = local.SetDeadline(time.Time{})
+
+	return local, nil
+}
+
+// handleSocks5UDPAssociate 在服务端解开隧道内的 UDP 帧，转发给目标，并把回包按帧写回隧道。
+func handleSocks5UDPAssociate(ctx context.Context, policy *accessPolicy, negotiationRequest *negotiationRequest) {
+	conn := negotiationRequest.Conn
+	logger := policy.inst.logger
+	stats := policy.inst.stats.userTunnelStats(negotiationRequest.statsUser())
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.PrintfX("[x] udp associate listen failed: [%s]\n", err.Error())
+		stats.streamFail()
+		writeSocks5Reply(conn, 0x01)
+		return
+	}
+
+	defer udpConn.Close()
+
+	writeSocks5Reply(conn, 0x00)
+
+	stats.udpAssociationStart()
+	defer stats.udpAssociationEnd()
+
+	logger.PrintfX("[+] udp associate for [%s] user=[%s] on [%s]\n",
+		conn.RemoteAddr().String(),
+		negotiationRequest.User,
+		udpConn.LocalAddr().String(),
+	)
+
+	assocCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	idle := newUDPIdleTimer(udpAssociationIdleTimeout, cancel)
+	defer idle.stop()
+
+	go func() {
+		<-assocCtx.Done()
+		_ = udpConn.Close()
+		_ = conn.Close()
+	}()
+
+	go func() {
+		defer cancel()
+
+		buf := make([]byte, maxUDPFramePayload-maxSocks5IPAddrLen)
+		payload := make([]byte, 0, maxUDPFramePayload)
+
+		for {
+			n, src, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			payload = appendSocks5Addr(payload[:0], src.IP, src.Port)
+			payload = append(payload, buf[:n]...)
+
+			if err := writeUDPFrame(conn, payload); err != nil {
+				return
+			}
+
+			idle.touch()
+			stats.udpPacketDown()
+			stats.addBytesDown(uint64(n))
+		}
+	}()
+
+	reader := negotiationRequest.Reader
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+
+	resolved := make(map[string]*net.UDPAddr)
+	buf := make([]byte, maxUDPFramePayload)
+
+	for {
+		payload, err := readUDPFrame(reader, buf)
+		if err != nil {
+			break
+		}
+
+		address, data, err := splitUDPPayload(payload)
+		if err != nil {
+			continue
+		}
+
+		dst, ok := resolved[address]
+		if !ok {
+			dst, err = resolveUDPTarget(assocCtx, policy, negotiationRequest.User, address)
+			if err != nil {
+				logger.PrintfX("[x] udp resolve [%s] user=[%s] error [%s]\n",
+					address,
+					negotiationRequest.User,
+					err.Error(),
+				)
+				continue
+			}
+
+			// 只缓存成功的解析，临时的 DNS 失败在下一个数据报时重试。
+			if len(resolved) >= maxUDPResolveCache {
+				clear(resolved)
+			}
+			resolved[address] = dst
+		}
+
+		if _, err := udpConn.WriteToUDP(data, dst); err != nil {
+			logger.PrintfX("[x] udp send [%s] error [%s]\n", address, err.Error())
+			continue
+		}
+
+		idle.touch()
+		stats.udpPacketUp()
+		stats.addBytesUp(uint64(len(data)))
+	}
+
+	logger.PrintfX("[-] udp associate for [%s] user=[%s] closed\n",
+		conn.RemoteAddr().String(),
+		negotiationRequest.User,
+	)
+}
+
+func resolveUDPTarget(ctx context.Context, policy *accessPolicy, user, address string) (*net.UDPAddr, error) {
+	if policy.unrestricted {
+		return net.ResolveUDPAddr("udp", address)
+	}
+
+	addrs, err := policy.resolveTarget(ctx, user, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.UDPAddrFromAddrPort(addrs[0]), nil
+}
@@ -0,0 +1,120 @@
+package csocks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestUDPFrameRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 512, maxUDPFramePayload} {
+		payload := bytes.Repeat([]byte{0xab}, n)
+
+		var buf bytes.Buffer
+		if err := writeUDPFrame(&buf, payload); err != nil {
+			t.Fatalf("writeUDPFrame(%d bytes): %v", n, err)
+		}
+
+		got, err := readUDPFrame(&buf, make([]byte, maxUDPFramePayload))
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("readUDPFrame(%d bytes) = %d bytes, %v", n, len(got), err)
+		}
+	}
+}
+
+func TestWriteUDPFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+
+	if err := writeUDPFrame(&buf, make([]byte, maxUDPFramePayload+1)); err == nil {
+		t.Fatal("writeUDPFrame accepted an oversize payload")
+	}
+
+	if buf.Len() != 0 {
+		t.Fatalf("writeUDPFrame wrote %d bytes for an oversize payload", buf.Len())
+	}
+}
+
+func TestReadUDPFrameMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		buf   int
+		want  error
+	}{
+		{name: "empty", input: nil, buf: 16, want: io.EOF},
+		{name: "truncated length", input: []byte{0x00}, buf: 16, want: io.ErrUnexpectedEOF},
+		{name: "truncated payload", input: []byte{0x00, 0x04, 1, 2}, buf: 16, want: io.ErrUnexpectedEOF},
+		{name: "missing payload", input: []byte{0x00, 0x04}, buf: 16, want: io.EOF},
+		{name: "longer than buffer", input: []byte{0x00, 0x11}, buf: 16},
+		{name: "maximum length", input: []byte{0xff, 0xff}, buf: 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readUDPFrame(bytes.NewReader(tt.input), make([]byte, tt.buf))
+			if err == nil {
+				t.Fatal("readUDPFrame succeeded")
+			}
+
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("readUDPFrame error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitUDPPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		address string
+		data    string
+		wantErr bool
+	}{
+		{
+			name:    "ipv4",
+			payload: []byte{0x01, 192, 0, 2, 1, 0x00, 0x35, 'h', 'i'},
+			address: "192.0.2.1:53",
+			data:    "hi",
+		},
+		{
+			name:    "ipv6",
+			payload: append([]byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 12: 0, 16: 1, 17: 0x01, 18: 0xbb}, 'x'),
+			address: "[2001:db8::1]:443",
+			data:    "x",
+		},
+		{
+			name:    "domain",
+			payload: []byte{0x03, 4, 'h', 'o', 's', 't', 0x1f, 0x90},
+			address: "host:8080",
+			data:    "",
+		},
+		{name: "empty", payload: nil, wantErr: true},
+		{name: "unknown address type", payload: []byte{0x05, 1, 2, 3, 4, 0, 80}, wantErr: true},
+		{name: "truncated ipv4", payload: []byte{0x01, 192, 0, 2}, wantErr: true},
+		{name: "truncated ipv6", payload: []byte{0x04, 0x20, 0x01}, wantErr: true},
+		{name: "missing port", payload: []byte{0x01, 192, 0, 2, 1}, wantErr: true},
+		{name: "short port", payload: []byte{0x01, 192, 0, 2, 1, 0x00}, wantErr: true},
+		{name: "zero domain length", payload: []byte{0x03, 0, 0, 80}, wantErr: true},
+		{name: "domain longer than frame", payload: []byte{0x03, 200, 'a', 'b', 0, 80}, wantErr: true},
+		{name: "missing domain length", payload: []byte{0x03}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, data, err := splitUDPPayload(tt.payload)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("splitUDPPayload = %q, %q; want an error", address, data)
+				}
+				return
+			}
+
+			if err != nil || address != tt.address || string(data) != tt.data {
+				t.Fatalf("splitUDPPayload = %q, %q, %v; want %q, %q", address, data, err, tt.address, tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package csocks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// legacyTunnelUser 是只使用 ListenConfig.Secret、不带 KeyID 的客户端的用户名。
+const legacyTunnelUser = "default"
+
+// legacyDefaultSecret 是早期版本 NewListenConfig 的 Secret 默认值，服务端拒绝使用。
+const legacyDefaultSecret = "anonymous"
+
+type TunnelUser struct {
+	Name      string    `json:"name" yaml:"name" toml:"name"`
+	Secret    string    `json:"secret" yaml:"secret" toml:"secret"`
+	ExpiresAt time.Time `json:"expires_at" yaml:"expires_at" toml:"expires_at"`
+	Disabled  bool      `json:"disabled" yaml:"disabled" toml:"disabled"`
+}
+
+func newTunnelUserTable(users []TunnelUser) (map[string]TunnelUser, error) {
+	table := make(map[string]TunnelUser, len(users))
+
+	for i, u := range users {
+		name := strings.TrimSpace(u.Name)
+		if name == "" {
+			return nil, fmt.Errorf("users[%d]: name is empty", i)
+		}
+
+		if name == legacyTunnelUser {
+			return nil, fmt.Errorf("users[%d]: name %q is reserved", i, name)
+		}
+
+		if u.Secret == "" {
+			return nil, fmt.Errorf("users[%d] %q: secret is empty", i, name)
+		}
+
+		if _, ok := table[name]; ok {
+			return nil, fmt.Errorf("users[%d]: duplicate name %q", i, name)
+		}
+
+		u.Name = name
+		table[name] = u
+	}
+
+	return table, nil
+}
+
+// lookupTunnelSecret 按 KeyID 找出签名密钥；禁用、过期或不存在的用户返回 false。
+// 不带 KeyID 时使用 Secret，未设置 Secret（没有默认值）时返回 false。
+func (r *proxyRuntime) lookupTunnelSecret(keyID string) (string, string, bool) {
+	if keyID == "" {
+		if r.listenConfig.Secret == "" {
+			return "", "", false
+		}
+		return legacyTunnelUser, r.listenConfig.Secret, true
+	}
+
+	u, ok := r.users[keyID]
+	if !ok || u.Disabled {
+		return "", "", false
+	}
+
+	if !u.ExpiresAt.IsZero() && time.Now().After(u.ExpiresAt) {
+		return "", "", false
+	}
+
+	return u.Name, u.Secret, true
+}
+
+// userActive 在 name 不在 Users 中，或在 Users 中且未被禁用、未过期时返回 true。
+// 用于 mTLS 与 Ed25519 公钥认证：这些用户可以不在 Users 中，在其中时遵守它的禁用与过期设置。
+func (r *proxyRuntime) userActive(name string) bool {
+	u, ok := r.users[name]
+	if !ok {
+		return true
+	}
+	return !u.Disabled && (u.ExpiresAt.IsZero() || time.Now().Before(u.ExpiresAt))
+}
+
+// GetUserTunnelStats 返回 StartServer 启动、仍在运行的实例按用户统计的流量，同名用户相加。
+func GetUserTunnelStats() map[string]TunnelStatsSnapshot {
+	out := make(map[string]TunnelStatsSnapshot)
+
+	for _, inst := range defaultInstances() {
+		for user, snap := range inst.stats.userSnapshots() {
+			sum := out[user]
+			sum.add(snap)
+			out[user] = sum
+		}
+	}
+
+	return out
+}
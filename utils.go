@@ -21,22 +21,24 @@ const (
 	methodSocks5 byte = 0x00
 	methodHttp   byte = 0x01
 
-	timeout int = 10
-	Version     = "v0.0.4"
+	socks5CmdConnect      byte = 0x01
+	socks5CmdBind         byte = 0x02
+	socks5CmdUDPAssociate byte = 0x03
+
+	Version = "v0.0.4"
 
 	protoH2    = "h2"
+	protoH3    = "h3"
 	protoHTTP1 = "http/1.1"
 
-	tunnelPath         = "/assets/update"
-	tunnelUpgradeToken = "websocket"
+	authClockSkewSeconds = 120
 
-	headerSessionID        = "X-Session-Id"
-	headerRequestTime      = "X-Request-Time"
-	headerRequestSignature = "X-Request-Signature"
+	// forward 端本地读缓冲，需要能容纳一个完整的 HTTP 代理请求头用于认证。
+	localReaderSize = 16 << 10
 
-	authClockSkewSeconds = 120
+	udpAssociationIdleTimeout = 60 * time.Second
 
-	maxClientH2Streams = 64
+	bindAcceptTimeout = 2 * time.Minute
 )
 
 type deadlineConn struct {
@@ -84,9 +86,9 @@ func tryCloseWrite(conn net.Conn) {
 	_ = conn.Close()
 }
 
-func mutualCopyIO(ctx context.Context, conn0, conn1 net.Conn) {
-	w0 := newDeadlineConn(conn0, 60*time.Second)
-	w1 := newDeadlineConn(conn1, 60*time.Second)
+func mutualCopyIO(ctx context.Context, conn0, conn1 net.Conn, idleTimeout time.Duration) {
+	w0 := newDeadlineConn(conn0, idleTimeout)
+	w1 := newDeadlineConn(conn1, idleTimeout)
 
 	done := make(chan struct{})
 
@@ -200,18 +202,21 @@ func makeTunnelAuthSignature(secret, path, host, nonce string, ts int64) string
 	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func makeTunnelAuthSignatureV2(secret, method, path, host, nonce string, ts int64, proto string) string {
-	msg := strings.Join([]string{
+// tunnelAuthMessageV2 是 V2 签名覆盖的内容，HMAC 与 Ed25519 签名使用同一份。
+func tunnelAuthMessageV2(method, path, host, nonce string, ts int64, proto string) []byte {
+	return []byte(strings.Join([]string{
 		method,
 		path,
 		host,
 		nonce,
 		strconv.FormatInt(ts, 10),
 		proto,
-	}, "\n")
+	}, "\n"))
+}
 
+func makeTunnelAuthSignatureV2(secret, method, path, host, nonce string, ts int64, proto string) string {
 	mac := hmac.New(sha256.New, []byte(secret))
-	_, _ = mac.Write([]byte(msg))
+	_, _ = mac.Write(tunnelAuthMessageV2(method, path, host, nonce, ts, proto))
 
 	return hex.EncodeToString(mac.Sum(nil))
 }
@@ -226,11 +231,16 @@ func headerContainsToken(v, token string) bool {
 }
 
 type TunnelStatsSnapshot struct {
-	ActiveStreams int64
-	TotalStreams  uint64
-	FailedStreams uint64
-	BytesUp       uint64
-	BytesDown     uint64
+	ActiveStreams int64  `json:"active_streams"`
+	TotalStreams  uint64 `json:"total_streams"`
+	FailedStreams uint64 `json:"failed_streams"`
+	BytesUp       uint64 `json:"bytes_up"`
+	BytesDown     uint64 `json:"bytes_down"`
+
+	ActiveUDPAssociations int64  `json:"active_udp_associations"`
+	TotalUDPAssociations  uint64 `json:"total_udp_associations"`
+	UDPPacketsUp          uint64 `json:"udp_packets_up"`
+	UDPPacketsDown        uint64 `json:"udp_packets_down"`
 }
 
 type tunnelStats struct {
@@ -239,37 +249,133 @@ type tunnelStats struct {
 	failedStreams uint64
 	bytesUp       uint64
 	bytesDown     uint64
-}
 
-var globalTunnelStats tunnelStats
+	activeUDPAssociations int64
+	totalUDPAssociations  uint64
+	udpPacketsUp          uint64
+	udpPacketsDown        uint64
+}
 
+// GetTunnelStats 返回 StartServer 启动、仍在运行的实例的总体流量统计之和。
 func GetTunnelStats() TunnelStatsSnapshot {
+	var out TunnelStatsSnapshot
+	for _, inst := range defaultInstances() {
+		out.add(inst.stats.total.snapshot())
+	}
+	return out
+}
+
+func (s *TunnelStatsSnapshot) add(o TunnelStatsSnapshot) {
+	s.ActiveStreams += o.ActiveStreams
+	s.TotalStreams += o.TotalStreams
+	s.FailedStreams += o.FailedStreams
+	s.BytesUp += o.BytesUp
+	s.BytesDown += o.BytesDown
+
+	s.ActiveUDPAssociations += o.ActiveUDPAssociations
+	s.TotalUDPAssociations += o.TotalUDPAssociations
+	s.UDPPacketsUp += o.UDPPacketsUp
+	s.UDPPacketsDown += o.UDPPacketsDown
+}
+
+func (s *tunnelStats) snapshot() TunnelStatsSnapshot {
 	return TunnelStatsSnapshot{
-		ActiveStreams: atomic.LoadInt64(&globalTunnelStats.activeStreams),
-		TotalStreams:  atomic.LoadUint64(&globalTunnelStats.totalStreams),
-		FailedStreams: atomic.LoadUint64(&globalTunnelStats.failedStreams),
-		BytesUp:       atomic.LoadUint64(&globalTunnelStats.bytesUp),
-		BytesDown:     atomic.LoadUint64(&globalTunnelStats.bytesDown),
+		ActiveStreams: atomic.LoadInt64(&s.activeStreams),
+		TotalStreams:  atomic.LoadUint64(&s.totalStreams),
+		FailedStreams: atomic.LoadUint64(&s.failedStreams),
+		BytesUp:       atomic.LoadUint64(&s.bytesUp),
+		BytesDown:     atomic.LoadUint64(&s.bytesDown),
+
+		ActiveUDPAssociations: atomic.LoadInt64(&s.activeUDPAssociations),
+		TotalUDPAssociations:  atomic.LoadUint64(&s.totalUDPAssociations),
+		UDPPacketsUp:          atomic.LoadUint64(&s.udpPacketsUp),
+		UDPPacketsDown:        atomic.LoadUint64(&s.udpPacketsDown),
 	}
 }
 
-func recordStreamStart() {
-	atomic.AddInt64(&globalTunnelStats.activeStreams, 1)
-	atomic.AddUint64(&globalTunnelStats.totalStreams, 1)
+// reset 清零累计值，活跃数保持不变。
+func (s *tunnelStats) reset() {
+	atomic.StoreUint64(&s.totalStreams, 0)
+	atomic.StoreUint64(&s.failedStreams, 0)
+	atomic.StoreUint64(&s.bytesUp, 0)
+	atomic.StoreUint64(&s.bytesDown, 0)
+	atomic.StoreUint64(&s.totalUDPAssociations, 0)
+	atomic.StoreUint64(&s.udpPacketsUp, 0)
+	atomic.StoreUint64(&s.udpPacketsDown, 0)
+}
+
+func (s *tunnelStats) streamStart() {
+	atomic.AddInt64(&s.activeStreams, 1)
+	atomic.AddUint64(&s.totalStreams, 1)
+}
+
+func (s *tunnelStats) streamEnd() {
+	atomic.AddInt64(&s.activeStreams, -1)
 }
 
-func recordStreamEnd() {
-	atomic.AddInt64(&globalTunnelStats.activeStreams, -1)
+func (s *tunnelStats) streamFail() {
+	atomic.AddUint64(&s.failedStreams, 1)
 }
 
-func recordStreamFail() {
-	atomic.AddUint64(&globalTunnelStats.failedStreams, 1)
+func (s *tunnelStats) addBytesUp(n uint64) {
+	atomic.AddUint64(&s.bytesUp, n)
 }
 
-func recordBytesUp(n uint64) {
-	atomic.AddUint64(&globalTunnelStats.bytesUp, n)
+func (s *tunnelStats) addBytesDown(n uint64) {
+	atomic.AddUint64(&s.bytesDown, n)
+}
+
+func (s *tunnelStats) udpAssociationStart() {
+	atomic.AddInt64(&s.activeUDPAssociations, 1)
+	atomic.AddUint64(&s.totalUDPAssociations, 1)
+}
+
+func (s *tunnelStats) udpAssociationEnd() {
+	atomic.AddInt64(&s.activeUDPAssociations, -1)
+}
+
+func (s *tunnelStats) udpPacketUp() {
+	atomic.AddUint64(&s.udpPacketsUp, 1)
+}
+
+func (s *tunnelStats) udpPacketDown() {
+	atomic.AddUint64(&s.udpPacketsDown, 1)
+}
+
+// statsConn 包装到远端（目标或服务端）的连接：写入计为上行，读取计为下行。
+type statsConn struct {
+	net.Conn
+	stats   *tunnelStats
+	metrics *streamMetrics
+}
+
+func newStatsConn(conn net.Conn, stats *tunnelStats, metrics *streamMetrics) *statsConn {
+	return &statsConn{
+		Conn:    conn,
+		stats:   stats,
+		metrics: metrics,
+	}
+}
+
+func (c *statsConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.stats.addBytesDown(uint64(n))
+		c.metrics.addBytesDown(n)
+	}
+	return n, err
+}
+
+func (c *statsConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.stats.addBytesUp(uint64(n))
+		c.metrics.addBytesUp(n)
+	}
+	return n, err
 }
 
-func recordBytesDown(n uint64) {
-	atomic.AddUint64(&globalTunnelStats.bytesDown, n)
+func (c *statsConn) CloseWrite() error {
+	tryCloseWrite(c.Conn)
+	return nil
 }
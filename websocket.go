@@ -0,0 +1,319 @@
+package csocks
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WebSocket（RFC 6455）帧模式，用于经过会检查 WebSocket 流量的 CDN 与反向代理。
+const (
+	protoWebSocket = "websocket"
+
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xa
+
+	wsMaxFramePayload   = 32 << 10
+	wsMaxControlPayload = 125
+
+	// 客户端定期发送 ping，避免 CDN 因空闲断开连接。
+	wsPingInterval = 30 * time.Second
+
+	wsCloseTimeout = time.Second
+)
+
+var wsCloseNormal = []byte{0x03, 0xe8} // 1000
+
+func newWebSocketKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn 在 WebSocket 连接上传输字节流：写入作为二进制帧发送，读取时拼接数据帧的内容。
+// 客户端发送的帧带掩码，并要求收到的帧不带掩码；服务端相反。
+// 收到 close 帧后 Read 返回 io.EOF，自己的 close 帧在 CloseWrite 或 Close 时发送。
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	client bool
+
+	// 读状态只在 Read 中使用。
+	remain  int64
+	masked  bool
+	mask    [4]byte
+	maskPos int
+	readErr error
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newWebSocketConn 包装已完成握手的连接，reader 是读取握手时使用的缓冲。
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *wsConn {
+	c := &wsConn{
+		Conn:   conn,
+		reader: reader,
+		client: client,
+		done:   make(chan struct{}),
+	}
+
+	if client {
+		go c.keepalive()
+	}
+
+	return c
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remain == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+
+	n, err := c.reader.Read(p)
+
+	if c.masked {
+		for i := range n {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+
+	c.remain -= int64(n)
+
+	if err == io.EOF && c.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// nextFrame 读取下一个帧头，处理控制帧；返回 nil 时 remain 是数据帧的内容长度（可能为 0）。
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.reader, hdr[:]); err != nil {
+		return err
+	}
+
+	if hdr[0]&0x70 != 0 {
+		return errors.New("websocket: unexpected reserved bits")
+	}
+
+	opcode := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+
+	if masked == c.client {
+		return errors.New("websocket: invalid frame masking")
+	}
+
+	length := int64(hdr[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.reader, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.reader, b[:]); err != nil {
+			return err
+		}
+		v := binary.BigEndian.Uint64(b[:])
+		if v>>63 != 0 {
+			return errors.New("websocket: invalid frame length")
+		}
+		length = int64(v)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	if opcode >= wsOpClose {
+		// 控制帧不分片，内容不超过 125 字节。
+		if hdr[0]&0x80 == 0 || length > wsMaxControlPayload {
+			return errors.New("websocket: invalid control frame")
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+		}
+
+		switch opcode {
+		case wsOpPing:
+			// 已经发送 close 帧（CloseWrite）之后不能再发 pong，忽略这个 ping 继续读取对端的数据。
+			if err := c.writeFrame(wsOpPong, payload); err != nil && !errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			return nil
+		case wsOpPong:
+			return nil
+		case wsOpClose:
+			return io.EOF
+		default:
+			return errors.New("websocket: unknown control opcode")
+		}
+	}
+
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+	default:
+		return errors.New("websocket: unknown opcode")
+	}
+
+	c.remain = length
+	c.masked = masked
+	c.mask = mask
+	c.maskPos = 0
+
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p[:min(len(p), wsMaxFramePayload)]
+
+		if err := c.writeFrame(wsOpBinary, chunk); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if !c.client {
+		buf = append(buf, payload...)
+		_, err := c.Conn.Write(buf)
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+
+	buf = append(buf, mask[:]...)
+	start := len(buf)
+	buf = append(buf, payload...)
+
+	for i := range payload {
+		buf[start+i] ^= mask[i&3]
+	}
+
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// CloseWrite 发送 close 帧，之后不再发送数据；对端读完剩余数据后回复 close。
+func (c *wsConn) CloseWrite() error {
+	return c.writeFrame(wsOpClose, wsCloseNormal)
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		_ = c.writeFrame(wsOpClose, wsCloseNormal)
+	})
+
+	return c.Conn.Close()
+}
+
+func (c *wsConn) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package csocks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+var wsTestMask = [4]byte{0x12, 0x34, 0x56, 0x78}
+
+// wsTestFrame 构建一个帧，masked 为 true 时使用 wsTestMask。lenBytes 为 2 或 8 时强制使用扩展长度。
+func wsTestFrame(b0 byte, payload []byte, masked bool, lenBytes int) []byte {
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+
+	frame := []byte{b0}
+
+	switch {
+	case lenBytes == 8 || len(payload) > 0xffff:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	case lenBytes == 2 || len(payload) >= 126:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|byte(len(payload)))
+	}
+
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame = append(frame, wsTestMask[:]...)
+	for i, v := range payload {
+		frame = append(frame, v^wsTestMask[i&3])
+	}
+
+	return frame
+}
+
+func newTestWSConn(input []byte, client bool) (*wsConn, *recordConn) {
+	conn := &recordConn{}
+
+	return &wsConn{
+		Conn:   conn,
+		reader: bufio.NewReader(bytes.NewReader(input)),
+		client: client,
+		done:   make(chan struct{}),
+	}, conn
+}
+
+func TestWebSocketRead(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789"), 40)
+	closeFrame := wsTestFrame(0x80|wsOpClose, wsCloseNormal, true, 0)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		client  bool
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "masked binary",
+			input: concatBytes(wsTestFrame(0x80|wsOpBinary, []byte("hello"), true, 0), closeFrame),
+			want:  "hello",
+		},
+		{
+			name:   "unmasked frame to client",
+			input:  concatBytes(wsTestFrame(0x80|wsOpBinary, []byte("hello"), false, 0), wsTestFrame(0x80|wsOpClose, nil, false, 0)),
+			client: true,
+			want:   "hello",
+		},
+		{
+			name:  "fragmented message",
+			input: concatBytes(wsTestFrame(wsOpText, []byte("he"), true, 0), wsTestFrame(wsOpContinuation, nil, true, 0), wsTestFrame(0x80|wsOpContinuation, []byte("llo"), true, 0), closeFrame),
+			want:  "hello",
+		},
+		{
+			name:  "16-bit length",
+			input: concatBytes(wsTestFrame(0x80|wsOpBinary, long, true, 0), closeFrame),
+			want:  string(long),
+		},
+		{
+			name:  "64-bit length",
+			input: concatBytes(wsTestFrame(0x80|wsOpBinary, []byte("hello"), true, 8), closeFrame),
+			want:  "hello",
+		},
+		{
+			name:  "pong between data frames",
+			input: concatBytes(wsTestFrame(0x80|wsOpBinary, []byte("he"), true, 0), wsTestFrame(0x80|wsOpPong, []byte("p"), true, 0), wsTestFrame(0x80|wsOpBinary, []byte("llo"), true, 0), closeFrame),
+			want:  "hello",
+		},
+		{name: "end of stream", input: nil},
+		{
+			name:    "unmasked frame to server",
+			input:   wsTestFrame(0x80|wsOpBinary, []byte("hello"), false, 0),
+			wantErr: "invalid frame masking",
+		},
+		{
+			name:    "masked frame to client",
+			input:   wsTestFrame(0x80|wsOpBinary, []byte("hello"), true, 0),
+			client:  true,
+			wantErr: "invalid frame masking",
+		},
+		{
+			name:    "reserved bits",
+			input:   wsTestFrame(0xc0|wsOpBinary, []byte("hello"), true, 0),
+			wantErr: "reserved bits",
+		},
+		{
+			name:    "unknown data opcode",
+			input:   wsTestFrame(0x80|0x3, []byte("hello"), true, 0),
+			wantErr: "unknown opcode",
+		},
+		{
+			name:    "unknown control opcode",
+			input:   wsTestFrame(0x80|0xb, nil, true, 0),
+			wantErr: "unknown control opcode",
+		},
+		{
+			name:    "fragmented control frame",
+			input:   wsTestFrame(wsOpPing, []byte("p"), true, 0),
+			wantErr: "invalid control frame",
+		},
+		{
+			name:    "oversize control frame",
+			input:   wsTestFrame(0x80|wsOpPing, bytes.Repeat([]byte{'p'}, wsMaxControlPayload+1), true, 0),
+			wantErr: "invalid control frame",
+		},
+		{
+			name:    "64-bit length with the top bit set",
+			input:   concatBytes([]byte{0x80 | wsOpBinary, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 0}, wsTestMask[:]),
+			wantErr: "invalid frame length",
+		},
+		{
+			name:    "oversize length with truncated payload",
+			input:   concatBytes([]byte{0x80 | wsOpBinary, 0x80 | 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wsTestMask[:], []byte("abc")),
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "truncated header",
+			input:   []byte{0x80 | wsOpBinary},
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "truncated 16-bit length",
+			input:   []byte{0x80 | wsOpBinary, 0x80 | 126, 0x01},
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "truncated 64-bit length",
+			input:   []byte{0x80 | wsOpBinary, 0x80 | 127, 0, 0, 0},
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "truncated mask",
+			input:   []byte{0x80 | wsOpBinary, 0x80 | 5, 0x12, 0x34},
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "truncated payload",
+			input:   wsTestFrame(0x80|wsOpBinary, []byte("hello"), true, 0)[:8],
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "truncated control payload",
+			input:   wsTestFrame(0x80|wsOpPing, []byte("ping"), true, 0)[:7],
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestWSConn(tt.input, tt.client)
+
+			got, err := io.ReadAll(c)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ReadAll = %q, %v; want error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("ReadAll = %q, %v; want %q", got, err, tt.want)
+			}
+
+			// 读到 EOF 之后继续返回 EOF。
+			if n, err := c.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Fatalf("Read after EOF = %d, %v", n, err)
+			}
+		})
+	}
+}
+
+// 收到 ping 时回复内容相同的 pong，服务端的帧不带掩码，客户端的带掩码。
+func TestWebSocketPing(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		input := concatBytes(
+			wsTestFrame(0x80|wsOpPing, []byte("ping"), !client, 0),
+			wsTestFrame(0x80|wsOpBinary, []byte("data"), !client, 0),
+		)
+
+		c, conn := newTestWSConn(input, client)
+
+		buf := make([]byte, 16)
+		if n, err := c.Read(buf); err != nil || string(buf[:n]) != "data" {
+			t.Fatalf("client=%v: Read = %q, %v", client, buf[:n], err)
+		}
+
+		reply, _ := newTestWSConn(conn.out.Bytes(), !client)
+		if err := reply.nextFrame(); err != nil {
+			t.Fatalf("client=%v: reading pong: %v", client, err)
+		}
+
+		if pong := conn.out.Bytes(); pong[0] != 0x80|wsOpPong || (pong[1]&0x80 != 0) != client {
+			t.Fatalf("client=%v: pong header = % x", client, pong[:2])
+		}
+	}
+}
+
+// 服务端 CloseWrite 之后客户端的 keepalive ping 不能中断仍在进行的上传。
+func TestWebSocketPingAfterCloseWrite(t *testing.T) {
+	input := concatBytes(
+		wsTestFrame(0x80|wsOpBinary, []byte("up"), true, 0),
+		wsTestFrame(0x80|wsOpPing, []byte("ping"), true, 0),
+		wsTestFrame(0x80|wsOpBinary, []byte("load"), true, 0),
+		wsTestFrame(0x80|wsOpClose, wsCloseNormal, true, 0),
+	)
+
+	c, conn := newTestWSConn(input, false)
+
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	sent := conn.out.Len()
+
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "upload" {
+		t.Fatalf("ReadAll after CloseWrite = %q, %v; want \"upload\"", got, err)
+	}
+
+	if conn.out.Len() != sent {
+		t.Fatalf("wrote %d bytes after the close frame", conn.out.Len()-sent)
+	}
+}
+
+// 客户端写出的帧能被服务端读回，超过 wsMaxFramePayload 的数据拆成多个帧。
+func TestWebSocketWriteRoundTrip(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		data := bytes.Repeat([]byte("abcdefgh"), wsMaxFramePayload/4)
+
+		w, conn := newTestWSConn(nil, client)
+
+		if n, err := w.Write(data); n != len(data) || err != nil {
+			t.Fatalf("client=%v: Write = %d, %v", client, n, err)
+		}
+
+		if err := w.CloseWrite(); err != nil {
+			t.Fatalf("client=%v: CloseWrite: %v", client, err)
+		}
+
+		if _, err := w.Write([]byte("x")); err == nil {
+			t.Fatalf("client=%v: Write after CloseWrite succeeded", client)
+		}
+
+		r, _ := newTestWSConn(conn.out.Bytes(), !client)
+
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("client=%v: ReadAll = %d bytes, %v; want %d bytes", client, len(got), err, len(data))
+		}
+	}
+}